@@ -0,0 +1,214 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/controller"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+type BacklinksResponse struct {
+	Target    string      `json:"target"`
+	Backlinks []Backlink  `json:"backlinks,omitempty"`
+	Hosts     []HostGroup `json:"hosts,omitempty"`
+	Next      string      `json:"next,omitempty"`
+}
+
+type Backlink struct {
+	Source string   `json:"source"`
+	Text   string   `json:"text,omitempty"`
+	Rel    []string `json:"rel,omitempty"`
+	Title  string   `json:"title,omitempty"`
+}
+
+// HostGroup gathers the backlinks of a page coming from the same host
+type HostGroup struct {
+	Host      string     `json:"host"`
+	Backlinks []Backlink `json:"backlinks"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server expose the webgraph over HTTP
+type Server struct {
+	reader controller.GraphReader
+	mux    *http.ServeMux
+}
+
+func NewServer(reader controller.GraphReader) *Server {
+	s := &Server{
+		reader: reader,
+		mux:    http.NewServeMux(),
+	}
+	s.mux.HandleFunc("GET /backlinks", s.handleBacklinks)
+	return s
+}
+
+// Handle registers another handler on the server, for example the WebSub callbacks
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(w, req)
+}
+
+// Serve listens on addr until the context is canceled
+func (s *Server) Serve(ctx context.Context, addr string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("API server is listening on http://%s\n", addr)
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) handleBacklinks(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+
+	target, err := parseTarget(params.Get("url"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit, err := parseLimit(params.Get("limit"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var excludeRel []string
+	if params.Get("exclude_rel") != "" {
+		excludeRel = strings.Split(strings.ToLower(params.Get("exclude_rel")), ",")
+	}
+
+	page, err := s.reader.Backlinks(req.Context(), controller.LinkQuery{
+		URL:        target,
+		Limit:      limit,
+		Cursor:     params.Get("cursor"),
+		ExcludeRel: excludeRel,
+	})
+	if errors.Is(err, controller.ErrInvalidCursor) {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to query backlinks of %s: %s", target, err))
+		writeError(w, http.StatusInternalServerError, errors.New("failed to query backlinks"))
+		return
+	}
+
+	resp := BacklinksResponse{Target: target.String(), Next: page.Next}
+	switch params.Get("group") {
+	case "":
+		resp.Backlinks = toBacklinks(page.Links)
+	case "host":
+		resp.Hosts = groupByHost(page.Links)
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("group must be empty or host"))
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Targets go through the same normalization as the crawler otherwise they would not match
+func parseTarget(raw string) (*url.URL, error) {
+	if raw == "" {
+		return nil, errors.New("url parameter is required")
+	}
+	target, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	target, err = commons.NormalizeUrl(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	return target, nil
+}
+
+func parseLimit(raw string) (int, error) {
+	if raw == "" {
+		return DefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > MaxLimit {
+		return 0, fmt.Errorf("limit must be an integer between 1 and %d", MaxLimit)
+	}
+	return limit, nil
+}
+
+func toBacklink(link commons.Link) Backlink {
+	return Backlink{
+		Source: link.From.String(),
+		Text:   link.Text,
+		Rel:    link.Rel,
+		Title:  link.Title,
+	}
+}
+
+func toBacklinks(links []commons.Link) []Backlink {
+	backlinks := make([]Backlink, 0, len(links))
+	for _, link := range links {
+		backlinks = append(backlinks, toBacklink(link))
+	}
+	return backlinks
+}
+
+// Groups are ordered by first appearance so the order of the page is preserved
+func groupByHost(links []commons.Link) []HostGroup {
+	groups := make([]HostGroup, 0)
+	index := make(map[string]int)
+	for _, link := range links {
+		host := link.From.Hostname()
+		i, ok := index[host]
+		if !ok {
+			i = len(groups)
+			index[host] = i
+			groups = append(groups, HostGroup{Host: host, Backlinks: make([]Backlink, 0, 1)})
+		}
+		groups[i].Backlinks = append(groups[i].Backlinks, toBacklink(link))
+	}
+	return groups
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("failed to write response: %s", err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
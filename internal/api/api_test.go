@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/controller"
+)
+
+func newTestServer(t *testing.T, links map[string][]string) *Server {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	store := controller.NewInMemoryController(ctx, 0, controller.RevisitPolicy{}, 0, controller.RevisitPolicy{})
+	// Sources are added in order since links are sorted by discovery by default
+	for _, from := range slices.Sorted(maps.Keys(links)) {
+		group := &commons.LinkGroup{From: mustParse(t, from)}
+		for _, to := range links[from] {
+			group.Links = append(group.Links, commons.Link{To: mustParse(t, to)})
+		}
+		store.Add(group)
+	}
+	return NewServer(store)
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("invalid test url %s: %s", rawURL, err)
+	}
+	return u
+}
+
+func get(t *testing.T, s *Server, target string) (int, BacklinksResponse) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	s.ServeHTTP(recorder, httptest.NewRequest("GET", target, nil))
+
+	var resp BacklinksResponse
+	if recorder.Code == http.StatusOK {
+		err := json.NewDecoder(recorder.Body).Decode(&resp)
+		if err != nil {
+			t.Fatalf("invalid json response: %s", err)
+		}
+	}
+	return recorder.Code, resp
+}
+
+func TestBacklinks(t *testing.T) {
+	s := newTestServer(t, map[string][]string{
+		"http://a.com/1": {"http://target.com/page"},
+		"http://b.com/1": {"http://target.com/page", "http://target.com/other"},
+		"http://c.com/1": {"http://target.com/other"},
+	})
+
+	// The target is normalized like in the crawler
+	status, resp := get(t, s, "/backlinks?url="+url.QueryEscape("http://target.com:80/page#frag"))
+	if status != http.StatusOK {
+		t.Fatalf("bad status: want 200; got %d", status)
+	}
+	if resp.Target != "http://target.com/page" {
+		t.Fatalf("bad target: got %s", resp.Target)
+	}
+	if len(resp.Backlinks) != 2 || resp.Backlinks[0].Source != "http://a.com/1" || resp.Backlinks[1].Source != "http://b.com/1" {
+		t.Fatalf("bad backlinks: got %+v", resp.Backlinks)
+	}
+	if resp.Next != "" {
+		t.Fatalf("unexpected next cursor: %s", resp.Next)
+	}
+}
+
+func TestBacklinksPagination(t *testing.T) {
+	s := newTestServer(t, map[string][]string{
+		"http://a.com/1": {"http://target.com"},
+		"http://b.com/1": {"http://target.com"},
+		"http://c.com/1": {"http://target.com"},
+	})
+
+	sources := make([]string, 0)
+	next := ""
+	for i := 0; i < 3; i++ {
+		status, resp := get(t, s, "/backlinks?limit=2&url=target.com&cursor="+next)
+		if status != http.StatusOK {
+			t.Fatalf("bad status: want 200; got %d", status)
+		}
+		for _, backlink := range resp.Backlinks {
+			sources = append(sources, backlink.Source)
+		}
+		next = resp.Next
+		if next == "" {
+			break
+		}
+	}
+	if len(sources) != 3 || sources[2] != "http://c.com/1" {
+		t.Fatalf("bad paginated backlinks: got %s", sources)
+	}
+}
+
+func TestBacklinksGroupByHost(t *testing.T) {
+	s := newTestServer(t, map[string][]string{
+		"http://a.com/1": {"http://target.com"},
+		"http://a.com/2": {"http://target.com"},
+		"http://b.com/1": {"http://target.com"},
+	})
+
+	status, resp := get(t, s, "/backlinks?group=host&url=target.com")
+	if status != http.StatusOK {
+		t.Fatalf("bad status: want 200; got %d", status)
+	}
+	if len(resp.Hosts) != 2 || resp.Hosts[0].Host != "a.com" || len(resp.Hosts[0].Backlinks) != 2 {
+		t.Fatalf("bad host groups: got %+v", resp.Hosts)
+	}
+}
+
+func TestBacklinksAttributesAndExcludeRel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := controller.NewInMemoryController(ctx, 0, controller.RevisitPolicy{}, 0, controller.RevisitPolicy{})
+	target := mustParse(t, "http://target.com")
+	store.Add(&commons.LinkGroup{
+		From:  mustParse(t, "http://a.com"),
+		Links: []commons.Link{{To: target, Text: "a great site", Title: "Target"}},
+	})
+	store.Add(&commons.LinkGroup{
+		From:  mustParse(t, "http://b.com"),
+		Links: []commons.Link{{To: target, Text: "buy now", Rel: []string{"sponsored"}}},
+	})
+	s := NewServer(store)
+
+	status, resp := get(t, s, "/backlinks?url=target.com")
+	if status != http.StatusOK {
+		t.Fatalf("bad status: want 200; got %d", status)
+	}
+	if len(resp.Backlinks) != 2 {
+		t.Fatalf("bad number of backlinks: want 2; got %d", len(resp.Backlinks))
+	}
+	first := resp.Backlinks[0]
+	if first.Text != "a great site" || first.Title != "Target" || len(first.Rel) != 0 {
+		t.Fatalf("bad link attributes: got %+v", first)
+	}
+
+	status, resp = get(t, s, "/backlinks?url=target.com&exclude_rel=nofollow,Sponsored")
+	if status != http.StatusOK {
+		t.Fatalf("bad status: want 200; got %d", status)
+	}
+	if len(resp.Backlinks) != 1 || resp.Backlinks[0].Source != "http://a.com" {
+		t.Fatalf("sponsored link was not excluded: got %+v", resp.Backlinks)
+	}
+}
+
+func TestBacklinksBadRequest(t *testing.T) {
+	s := newTestServer(t, nil)
+
+	tests := map[string]string{
+		"missing url":    "/backlinks",
+		"invalid url":    "/backlinks?url=" + url.QueryEscape("ftp://test.com"),
+		"invalid limit":  "/backlinks?url=test.com&limit=0",
+		"invalid cursor": "/backlinks?url=test.com&cursor=%25%25",
+		"invalid group":  "/backlinks?url=test.com&group=nope",
+	}
+	for name, target := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			status, _ := get(t, s, target)
+			if status != http.StatusBadRequest {
+				t.Fatalf("bad status: want 400; got %d", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+// ValidatorsOf returns the validators in the headers of a response to make the next
+// request conditional.
+func ValidatorsOf(header http.Header) commons.Validators {
+	return commons.Validators{
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+}
+
+// MaxAge returns how long a response stays fresh according to its Cache-Control or
+// Expires header, minus its Age (RFC 9111 section 4.2). It returns 0 if the response
+// must be revalidated or if its freshness is unknown.
+func MaxAge(header http.Header) time.Duration {
+	var lifetime time.Duration
+	maxAgeFound := false
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store", "no-cache":
+				return 0
+			case "max-age":
+				seconds, err := strconv.Atoi(strings.Trim(arg, `"`))
+				if err != nil || seconds < 0 {
+					return 0
+				}
+				lifetime = time.Duration(seconds) * time.Second
+				maxAgeFound = true
+			}
+		}
+	}
+
+	// max-age takes precedence over Expires, which is relative to the Date of the response
+	if !maxAgeFound {
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		lifetime = expires.Sub(date)
+	}
+
+	age, err := strconv.Atoi(header.Get("Age"))
+	if err == nil && age > 0 {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	return max(lifetime, 0)
+}
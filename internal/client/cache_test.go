@@ -0,0 +1,46 @@
+package client
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMaxAge(t *testing.T) {
+	tests := map[string]struct {
+		header   http.Header
+		expected time.Duration
+	}{
+		"none":           {http.Header{}, 0},
+		"max-age":        {http.Header{"Cache-Control": {"public, max-age=3600"}}, time.Hour},
+		"quoted max-age": {http.Header{"Cache-Control": {`max-age="60"`}}, time.Minute},
+		"no-cache":       {http.Header{"Cache-Control": {"max-age=3600, no-cache"}}, 0},
+		"no-store":       {http.Header{"Cache-Control": {"no-store"}}, 0},
+		"invalid":        {http.Header{"Cache-Control": {"max-age=soon"}}, 0},
+		"age":            {http.Header{"Cache-Control": {"max-age=3600"}, "Age": {"600"}}, 50 * time.Minute},
+		"stale":          {http.Header{"Cache-Control": {"max-age=60"}, "Age": {"600"}}, 0},
+		"expires": {
+			http.Header{"Date": {"Fri, 01 Mar 2024 10:00:00 GMT"}, "Expires": {"Fri, 01 Mar 2024 12:00:00 GMT"}},
+			2 * time.Hour,
+		},
+		"max-age over expires": {
+			http.Header{
+				"Cache-Control": {"max-age=60"},
+				"Date":          {"Fri, 01 Mar 2024 10:00:00 GMT"},
+				"Expires":       {"Fri, 01 Mar 2024 12:00:00 GMT"},
+			},
+			time.Minute,
+		},
+		"expired": {http.Header{"Expires": {"0"}}, 0},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := MaxAge(test.header)
+			if got != test.expected {
+				t.Fatalf("bad max age: want %s; got %s", test.expected, got)
+			}
+		})
+	}
+}
@@ -2,57 +2,35 @@ package client
 
 import (
 	"context"
-	"net"
 	"net/http"
 	"time"
 
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/politeness"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type Fetcher interface {
-	Head(url string) (resp *http.Response, err error)
-	Get(url string) (resp *http.Response, err error)
+// HostPacer paces the requests to each host, like politeness.Limiters. It is told how
+// the hosts answer and when they ask us to come back later.
+type HostPacer interface {
+	Wait(ctx context.Context, method string, host string) error
+	Delay(host string, until time.Time)
+	Observe(host string, outcome politeness.Outcome, latency time.Duration)
 }
 
-// Wrap the default http client with crawling specific feature:
-//   - per domain rate limiting
-//   - automated retry
-//   - custom user agent
-//
-// NOTE: HEAD and GET requests have different request limiters otherwise all GET requests
-// will be stopped by HEAD requests (wich are queued first) instead of working in tandem.
+// Wrap the default http client with crawling specific features, added by the layers of
+// its Pipeline.
 type CrawlClient struct {
-	ctx    context.Context
 	client *http.Client
 }
 
-func NewCrawlClient(
-	ctx context.Context,
-	timeout time.Duration,
-) *CrawlClient {
-	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          2000,
-		MaxIdleConnsPerHost:   1,
-		IdleConnTimeout:       10 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	http_client := &http.Client{Transport: transport, Timeout: timeout}
-
-	inFlightGauge := prometheus.NewGauge(prometheus.GaugeOpts{
+var (
+	inFlightGauge = prometheus.NewGauge(prometheus.GaugeOpts{
 		Namespace: "backlinkbot",
 		Name:      "client_requests_in_flight",
 		Help:      "A gauge of in-flight requests for the wrapped client.",
 	})
 
-	counter := prometheus.NewCounterVec(
+	counter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "backlinkbot",
 			Name:      "client_requests_total",
@@ -65,7 +43,7 @@ func NewCrawlClient(
 	// It has an instance label "event", which is set in the
 	// DNSStart and DNSDonehook functions defined in the
 	// InstrumentTrace struct below.
-	dnsLatencyVec := prometheus.NewHistogramVec(
+	dnsLatencyVec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "backlinkbot",
 			Name:      "client_dns_duration_seconds",
@@ -79,7 +57,7 @@ func NewCrawlClient(
 	// It has an instance label "event", which is set in the
 	// TLSHandshakeStart and TLSHandshakeDone hook functions defined in the
 	// InstrumentTrace struct below.
-	tlsLatencyVec := prometheus.NewHistogramVec(
+	tlsLatencyVec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "backlinkbot",
 			Name:      "client_tls_duration_seconds",
@@ -90,7 +68,7 @@ func NewCrawlClient(
 	)
 
 	// histVec has no labels, making it a zero-dimensional ObserverVec.
-	histVec := prometheus.NewHistogramVec(
+	histVec = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "backlinkbot",
 			Name:      "client_conds",
@@ -100,66 +78,58 @@ func NewCrawlClient(
 		[]string{},
 	)
 
-	// Register all of the metrics in the standard registry.
-	prometheus.MustRegister(counter, tlsLatencyVec, dnsLatencyVec, histVec, inFlightGauge)
-
-	// Define functions for the available httptrace.ClientTrace hook
-	// functions that we want to instrument.
-	trace := &promhttp.InstrumentTrace{
-		DNSStart: func(t float64) {
-			dnsLatencyVec.WithLabelValues("dns_start").Observe(t)
-		},
-		DNSDone: func(t float64) {
-			dnsLatencyVec.WithLabelValues("dns_done").Observe(t)
-		},
-		TLSHandshakeStart: func(t float64) {
-			tlsLatencyVec.WithLabelValues("tls_handshake_start").Observe(t)
-		},
-		TLSHandshakeDone: func(t float64) {
-			tlsLatencyVec.WithLabelValues("tls_handshake_done").Observe(t)
+	retriesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "backlinkbot",
+			Name:      "client_retries_total",
+			Help:      "A counter for the requests retried by the wrapped client, by reason.",
 		},
-	}
+		[]string{"reason"},
+	)
 
-	// Wrap the default RoundTripper with middleware.
-	roundTripper := promhttp.InstrumentRoundTripperInFlight(inFlightGauge,
-		promhttp.InstrumentRoundTripperCounter(counter,
-			promhttp.InstrumentRoundTripperTrace(trace,
-				promhttp.InstrumentRoundTripperDuration(histVec, http.DefaultTransport),
-			),
-		),
+	giveUpCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "backlinkbot",
+			Name:      "client_retries_exhausted_total",
+			Help:      "A counter for the requests that still failed after all their retries, by reason.",
+		},
+		[]string{"reason"},
 	)
+)
 
-	// Set the RoundTripper on our client.
-	http_client.Transport = roundTripper
+// Metrics are registered once so that several clients can be created
+func init() {
+	prometheus.MustRegister(
+		counter, tlsLatencyVec, dnsLatencyVec, histVec, inFlightGauge, retriesCounter, giveUpCounter,
+	)
+}
 
-	return &CrawlClient{
-		ctx:    ctx,
-		client: http_client,
-	}
+// NewCrawlClient creates a client that sends its requests through the DefaultPipeline
+// and the transport of NewTransport.
+func NewCrawlClient(
+	ctx context.Context,
+	timeout time.Duration,
+	maxRetry int,
+	pacer HostPacer,
+) *CrawlClient {
+	return NewCrawlClientWithPipeline(NewTransport(), DefaultPipeline(ctx, timeout, maxRetry, pacer))
 }
 
-func (c *CrawlClient) Do(req *http.Request) (*http.Response, error) {
-	resp, err := c.client.Do(req)
-	if err != nil {
-		return nil, err
+// NewCrawlClientWithPipeline creates a client that sends its requests through the layers
+// of the pipeline and then the transport, for example the DefaultPipeline with extra
+// layers inserted.
+func NewCrawlClientWithPipeline(transport http.RoundTripper, pipeline Pipeline) *CrawlClient {
+	return &CrawlClient{
+		// The timeout layer bounds each attempt, a timeout here would bound all of them
+		client: &http.Client{Transport: pipeline.Wrap(transport), CheckRedirect: checkRedirect},
 	}
-	return resp, nil
 }
 
-func (c *CrawlClient) Get(url string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("User-Agent", "	")
-	return c.Do(req)
+func (c *CrawlClient) Fetch(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	return fetch(ctx, c, req)
 }
 
-func (c *CrawlClient) Head(url string) (resp *http.Response, err error) {
-	req, err := http.NewRequest("HEAD", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("User-Agent", "BacklinksBot")
-	return c.Do(req)
+// Do sends the request through the pipeline, following the redirects.
+func (c *CrawlClient) Do(req *http.Request) (*http.Response, error) {
+	return c.client.Do(req)
 }
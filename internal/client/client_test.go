@@ -1,406 +1,299 @@
 package client
 
-// import (
-// 	"context"
-// 	"errors"
-// 	"net/http"
-// 	"net/http/httptest"
-// 	"strconv"
-// 	"strings"
-// 	"testing"
-// 	"time"
-
-// 	"github.com/TheBigRoomXXL/backlinks-engine/internal"
-// 	"golang.org/x/time/rate"
-// )
-
-// func NewResponse(statusCode int) *http.Response {
-// 	recorder := httptest.NewRecorder()
-// 	recorder.Header().Set("Content-Type", "text/html")
-// 	recorder.WriteHeader(statusCode)
-// 	recorder.WriteString(`
-// 	<!DOCTYPE html>
-// 	<html lang="en">
-// 		<head>
-// 		<meta charset="utf-8">
-// 		<title>Tested!</title>
-// 		<link rel="stylesheet" href="style.css">
-// 		</head>
-// 		<body>
-// 		blablabla
-// 		</body>
-// 	</html>
-// 	`)
-// 	return recorder.Result()
-// }
-
-// var noRetryStatus = []int{200, 201, 202, 203, 204, 205, 206, 207, 208, 400, 401, 402, 403, 404, 405, 406, 407, 409, 410, 411, 412, 413, 414, 415, 416, 417, 418, 421, 422, 423, 501, 505, 506, 507, 508, 510, 511}
-
-// func TestCrawlClientGetSuccessfull(t *testing.T) {
-// 	for _, statusCode := range append(retryStatus, noRetryStatus...) {
-// 		t.Run("GET "+strconv.Itoa(statusCode), func(t *testing.T) {
-// 			t.Parallel()
-// 			response := NewResponse(statusCode)
-// 			client := NewCrawlClient(
-// 				context.Background(),
-// 				rate.Limit(100000),
-// 				0,
-// 				time.Second,
-// 			)
-// 			client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 			result, err := client.Get("http://test.com/truc")
-// 			if err != nil {
-// 				t.Fatalf("Unexpected error calling CrawlClient.Get : %s", err)
-// 			}
-// 			if result != response {
-// 				t.Fatalf(
-// 					"CrawlClient.Head return a bad response : expected %s, got %s",
-// 					response.Status,
-// 					result.Status,
-// 				)
-// 			}
-// 		})
-// 	}
-// }
-
-// func TestCrawlClientHeadSuccessfull(t *testing.T) {
-// 	for _, statusCode := range append(retryStatus, noRetryStatus...) {
-// 		t.Run("HEAD "+strconv.Itoa(statusCode), func(t *testing.T) {
-// 			t.Parallel()
-
-// 			// Setup
-// 			response := NewResponse(statusCode)
-// 			client := NewCrawlClient(
-// 				context.Background(),
-// 				rate.Limit(100000),
-// 				0,
-// 				time.Second,
-// 			)
-// 			client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 			// Test
-// 			result, err := client.Head("http://test.com/truc")
-// 			if err != nil {
-// 				t.Fatalf("Unexpected error calling CrawlClient.Head : %s", err)
-// 			}
-// 			if result != response {
-// 				t.Fatalf(
-// 					"CrawlClient.Head return a bad response : expected %s, got %s",
-// 					response.Status,
-// 					result.Status,
-// 				)
-// 			}
-// 		})
-// 	}
-// }
-
-// func TestCrawlClientGetFailed(t *testing.T) {
-// 	// Setup
-// 	err := errors.New("test-error")
-// 	client := NewCrawlClient(context.Background(), rate.Limit(100000), 0, time.Second)
-// 	client.client.Transport = internal.NewMockTransport(nil, err)
-
-// 	// Test
-// 	result, errResult := client.Get("http://test.com/truc")
-// 	if !strings.Contains(errResult.Error(), err.Error()) {
-// 		t.Fatalf("Bad error from CrawlClient : want %s ; got %s", err, errResult)
-// 	}
-// 	if result != nil {
-// 		t.Fatalf("Unexepted response from CrawlClient, want nil; got %s", result.Status)
-// 	}
-// }
-
-// func TestCrawlClientHeadFailed(t *testing.T) {
-// 	// Setup
-// 	err := errors.New("test-error")
-// 	client := NewCrawlClient(context.Background(), rate.Limit(100000), 0, time.Second)
-// 	client.client.Transport = internal.NewMockTransport(nil, err)
-
-// 	// Test
-// 	result, errResult := client.Head("http://test.com/truc")
-// 	if !strings.Contains(errResult.Error(), err.Error()) {
-// 		t.Fatalf("Bad error from CrawlClient : want %s ; got %s", err, errResult)
-// 	}
-// 	if result != nil {
-// 		t.Fatalf("Unexepted response from CrawlClient, want nil; got %s", result.Status)
-// 	}
-// }
-
-// func TestCrawlRateLimitGet(t *testing.T) {
-// 	// Setup
-// 	response := NewResponse(200)
-// 	client := NewCrawlClient(
-// 		context.Background(),
-// 		rate.Limit(rate.Every(10*time.Millisecond)),
-// 		0,
-// 		time.Second,
-// 	)
-// 	client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 	// Test
-// 	t0 := time.Now()
-// 	client.Get("http://test.com/truc")
-// 	client.Get("http://test.com/truc")
-// 	client.Get("http://test.com/truc")
-// 	result := time.Since(t0)
-// 	if result < 20*time.Millisecond || result > 25*time.Millisecond {
-// 		t.Fatalf("GET Request are not properly rate limited: 3 request in %s", result)
-// 	}
-// }
-
-// func TestCrawlRateLimitGetAndHead(t *testing.T) {
-// 	// Setup
-// 	response := NewResponse(200)
-// 	client := NewCrawlClient(
-// 		context.Background(),
-// 		rate.Limit(rate.Every(10*time.Millisecond)),
-// 		0,
-// 		time.Second,
-// 	)
-// 	client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 	// Test
-// 	t0 := time.Now()
-// 	client.Get("http://test.com/truc")
-// 	client.Head("http://test.com/truc")
-// 	result := time.Since(t0)
-// 	if result > 5*time.Millisecond {
-// 		t.Fatalf("GET and HEAD requests should not share the same rate limiter: 2 request in %s", result)
-// 	}
-// }
-
-// func TestCrawlRateLimitMultiDomainGet(t *testing.T) {
-// 	// Setup
-// 	response := NewResponse(200)
-// 	client := NewCrawlClient(
-// 		context.Background(),
-// 		rate.Limit(rate.Every(10*time.Millisecond)),
-// 		0,
-// 		time.Second,
-// 	)
-// 	client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 	// Test
-// 	t0 := time.Now()
-// 	client.Get("http://test.com/truc")
-// 	client.Get("http://no-test.com/truc")
-// 	client.Get("http://another-test.com/truc")
-// 	result := time.Since(t0)
-// 	if result > 5*time.Millisecond {
-// 		t.Fatalf("GET Request share rate limit between different domain: 3 request in %s", result)
-// 	}
-// }
-
-// func TestCrawlRateLimitMultiDomainGet2(t *testing.T) {
-// 	// Setup
-// 	response := NewResponse(200)
-// 	client := NewCrawlClient(
-// 		context.Background(),
-// 		rate.Limit(rate.Every(10*time.Millisecond)),
-// 		0,
-// 		time.Second,
-// 	)
-// 	client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 	// Test
-// 	t0 := time.Now()
-// 	client.Get("http://test.com/truc")
-// 	client.Get("http://no-test.com/truc")
-// 	client.Get("http://another-test.com/truc")
-// 	client.Get("http://test.com/truc")
-// 	client.Get("http://no-test.com/truc")
-// 	client.Get("http://another-test.com/truc")
-// 	client.Get("http://test.com/truc")
-// 	client.Get("http://no-test.com/truc")
-// 	client.Get("http://another-test.com/truc")
-// 	result := time.Since(t0)
-// 	if result < 20*time.Millisecond {
-// 		t.Fatalf("GET Request are not properly rate limited: 9 request between 3 domains in %s", result)
-// 	}
-// }
-
-// func TestCrawlRateLimitMultiDomainHead(t *testing.T) {
-// 	// Setup
-// 	response := NewResponse(200)
-// 	client := NewCrawlClient(
-// 		context.Background(),
-// 		rate.Limit(rate.Every(10*time.Millisecond)),
-// 		0,
-// 		time.Second,
-// 	)
-// 	client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 	// Test
-// 	t0 := time.Now()
-// 	client.Head("http://test.com/truc")
-// 	client.Head("http://no-test.com/truc")
-// 	client.Head("http://another-test.com/truc")
-// 	result := time.Since(t0)
-// 	if result > 5*time.Millisecond {
-// 		t.Fatalf("GET Request share rate limit between different domain: 3 request in %s", result)
-// 	}
-// }
-
-// func TestCrawlRateLimitMultiDomainHead2(t *testing.T) {
-// 	// Setup
-// 	response := NewResponse(200)
-// 	client := NewCrawlClient(
-// 		context.Background(),
-// 		rate.Limit(rate.Every(10*time.Millisecond)),
-// 		0,
-// 		time.Second,
-// 	)
-// 	client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 	// Test
-// 	t0 := time.Now()
-// 	client.Head("http://test.com/truc")
-// 	client.Head("http://no-test.com/truc")
-// 	client.Head("http://another-test.com/truc")
-// 	client.Head("http://test.com/truc")
-// 	client.Head("http://no-test.com/truc")
-// 	client.Head("http://another-test.com/truc")
-// 	client.Head("http://test.com/truc")
-// 	client.Head("http://no-test.com/truc")
-// 	client.Head("http://another-test.com/truc")
-// 	result := time.Since(t0)
-// 	if result < 20*time.Millisecond {
-// 		t.Fatalf("GET Request are not properly rate limited: 9 request between 3 domains in %s", result)
-// 	}
-// }
-
-// func TestCrawlDynamicRateLimiting(t *testing.T) {
-// 	// Setup
-// 	requestFrequence := rate.Limit(10)
-// 	client := NewCrawlClient(context.Background(), requestFrequence, 0, time.Second)
-// 	client.client.Transport = internal.NewMockTransport(NewResponse(429), nil)
-
-// 	// Test
-// 	client.Get("http://test.com/truc")
-// 	v, ok := client.rateLimiters.Load("GETtest.com")
-// 	if !ok {
-// 		t.Fatal("rate limit was not initialized")
-// 	}
-// 	result := v.(*rate.Limiter).Limit()
-// 	if result != 5.0 {
-// 		t.Fatalf("bad rate limit: want 50req/s; got %.2freq/s ", result)
-// 	}
-// }
-
-// func TestCrawlRetryStopAfterGoodResponse(t *testing.T) {
-// 	responseA := NewResponse(408)
-// 	responseB := NewResponse(200)
-// 	callback := func(m *internal.MockTransport) {
-// 		if m.NbCall > 0 {
-// 			m.Response = responseB
-// 		}
-// 	}
-// 	mock := internal.NewMockTransportWithCallback(responseA, nil, callback)
-// 	client := NewCrawlClient(
-// 		context.Background(),
-// 		rate.Limit(1000000000),
-// 		10,
-// 		time.Second,
-// 	)
-// 	client.client.Transport = mock
-
-// 	responseC, err := client.Get("http://test.com/truc")
-// 	if err != nil {
-// 		t.Fatalf("unexpected error: %s", err)
-// 	}
-// 	if responseC != responseB {
-// 		t.Fatalf("bad response: want %s, got %s", responseB.Status, responseC.Status)
-// 	}
-// 	if mock.NbCall != 2 {
-// 		t.Fatalf("bad number of retry: want 2, got %d", mock.NbCall)
-// 	}
-// }
-
-// func TestCrawlRetryCount(t *testing.T) {
-// 	n := 5
-// 	for _, statusCode := range retryStatus {
-// 		t.Run("Retry after  "+strconv.Itoa(statusCode), func(t *testing.T) {
-// 			t.Parallel()
-// 			response := NewResponse(statusCode)
-// 			mock := internal.NewMockTransport(response, nil)
-// 			client := NewCrawlClient(
-// 				context.Background(), rate.Limit(1000000000), n, time.Second,
-// 			)
-// 			client.client.Transport = mock
-
-// 			client.Get("http://test.com/truc")
-// 			// +1 is for initial call
-// 			if mock.NbCall != 5+1 {
-// 				t.Fatalf("Retried wrong number of time: want %d, got %d", n, mock.NbCall)
-// 			}
-// 		})
-// 	}
-// }
-// func TestCrawlRetryBackoff(t *testing.T) {
-// 	// Setup
-// 	response := NewResponse(408)
-// 	requestFrequence := rate.Limit(rate.Every(10 * time.Millisecond))
-// 	client := NewCrawlClient(
-// 		context.Background(), requestFrequence, 3, time.Second,
-// 	)
-// 	client.client.Transport = internal.NewMockTransport(response, nil)
-
-// 	// Test
-// 	t0 := time.Now()
-// 	client.Get("http://test.com/truc")
-// 	result := time.Since(t0)
-
-// 	// First call should be instantaneous, then wait 10ms, 100ms, 1000ms
-// 	if result < 1110*time.Millisecond || result < 130*time.Millisecond {
-// 		t.Fatalf("GET request do not follow exponential backoff when retrying: want ~1110ms; got %s", result)
-// 	}
-// }
-
-// func TestExponentialBackoff(t *testing.T) {
-// 	tests := map[string]struct {
-// 		limit  rate.Limit
-// 		retry  int
-// 		expect float64
-// 	}{
-// 		"1reqPerSec/firstRetry": {
-// 			limit:  rate.Limit(rate.Every(time.Second)),
-// 			retry:  0,
-// 			expect: 1,
-// 		},
-// 		"1reqPerSec/secondRetry": {
-// 			limit:  rate.Limit(rate.Every(time.Second)),
-// 			retry:  1,
-// 			expect: 10,
-// 		},
-// 		"1reqPerSec/thirdRetry": {
-// 			limit:  rate.Limit(rate.Every(time.Second)),
-// 			retry:  2,
-// 			expect: 100,
-// 		},
-// 		"0.1reqPerSec/firstRetry": {
-// 			limit:  rate.Limit(rate.Every(10 * time.Second)),
-// 			retry:  0,
-// 			expect: 10,
-// 		},
-// 		"0.1reqPerSec/secondRetry": {
-// 			limit:  rate.Limit(rate.Every(10 * time.Second)),
-// 			retry:  1,
-// 			expect: 100,
-// 		},
-// 		"0.1reqPerSec/thirdRetry": {
-// 			limit:  rate.Limit(rate.Every(10 * time.Second)),
-// 			retry:  2,
-// 			expect: 1000,
-// 		},
-// 	}
-
-// 	for name, test := range tests {
-// 		t.Run(name, func(t *testing.T) {
-// 			t.Parallel()
-// 			if got, expected := exponentialBackoff(test.limit, test.retry), test.expect; got != expected {
-// 				t.Fatalf("exponentialBackoff(%f, %d) failed: want %f; got %f", test.limit, test.retry, expected, got)
-// 			}
-// 		})
-// 	}
-// }
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/politeness"
+)
+
+func NewResponse(statusCode int) *http.Response {
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("Content-Type", "text/html")
+	recorder.WriteHeader(statusCode)
+	recorder.WriteString(`
+	<!DOCTYPE html>
+	<html lang="en">
+		<head>
+		<meta charset="utf-8">
+		<title>Tested!</title>
+		<link rel="stylesheet" href="style.css">
+		</head>
+		<body>
+		blablabla
+		</body>
+	</html>
+	`)
+	return recorder.Result()
+}
+
+// A client that retries without waiting so that tests stay fast
+func newTestClient(transport http.RoundTripper, maxRetry int, pacer HostPacer) *CrawlClient {
+	pipeline := DefaultPipeline(context.Background(), time.Second, maxRetry, pacer).
+		Replace(LayerRetry, Layer{LayerRetry, Retry(context.Background(), maxRetry, time.Microsecond)})
+	return NewCrawlClientWithPipeline(transport, pipeline)
+}
+
+type pacerRecorder struct {
+	mu       sync.Mutex
+	delays   map[string]time.Time
+	outcomes []politeness.Outcome
+}
+
+func (p *pacerRecorder) Wait(ctx context.Context, method string, host string) error {
+	return nil
+}
+
+func (p *pacerRecorder) Delay(host string, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.delays[host] = until
+}
+
+func (p *pacerRecorder) Observe(host string, outcome politeness.Outcome, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outcomes = append(p.outcomes, outcome)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var retryStatus = []int{429, 502, 503, 504}
+
+var noRetryStatus = []int{200, 201, 202, 203, 204, 205, 206, 207, 208, 400, 401, 402, 403, 404, 405, 406, 407, 408, 409, 410, 411, 412, 413, 414, 415, 416, 417, 418, 421, 422, 423, 500, 501, 505, 506, 507, 508, 510, 511}
+
+func TestCrawlClientGetSuccessfull(t *testing.T) {
+	for _, statusCode := range noRetryStatus {
+		t.Run("GET "+strconv.Itoa(statusCode), func(t *testing.T) {
+			t.Parallel()
+			response := NewResponse(statusCode)
+			mock := internal.NewMockTransport(response, nil)
+			client := newTestClient(mock, 3, nil)
+
+			result, err := client.Fetch(context.Background(), FetchRequest{URL: "http://test.com/truc"})
+			if err != nil {
+				t.Fatalf("Unexpected error calling CrawlClient.Fetch : %s", err)
+			}
+			if result.Status != statusCode {
+				t.Fatalf("CrawlClient.Fetch return a bad response : expected %d, got %d", statusCode, result.Status)
+			}
+			if mock.NbCall != 1 {
+				t.Fatalf("status %d should not be retried: got %d calls", statusCode, mock.NbCall)
+			}
+		})
+	}
+}
+
+func TestCrawlClientHeadFailed(t *testing.T) {
+	err := errors.New("test-error")
+	mock := internal.NewMockTransport(nil, err)
+	client := newTestClient(mock, 3, nil)
+
+	result, errResult := client.Fetch(context.Background(), FetchRequest{Method: "HEAD", URL: "http://test.com/truc"})
+	if !errors.Is(errResult, err) {
+		t.Fatalf("Bad error from CrawlClient : want %s ; got %s", err, errResult)
+	}
+	if result.Status != 0 || result.Err.Kind != ErrorOther {
+		t.Fatalf("Unexepted response from CrawlClient, want no status; got %d (%s)", result.Status, result.Err.Kind)
+	}
+	if mock.NbCall != 1 {
+		t.Fatalf("permanent errors should not be retried: got %d calls", mock.NbCall)
+	}
+}
+
+func TestCrawlRetryStopAfterGoodResponse(t *testing.T) {
+	responseA := NewResponse(503)
+	responseB := NewResponse(200)
+	callback := func(m *internal.MockTransport) {
+		if m.NbCall > 0 {
+			m.Response = responseB
+		}
+	}
+	mock := internal.NewMockTransportWithCallback(responseA, nil, callback)
+	client := newTestClient(mock, 10, nil)
+
+	result, err := client.Fetch(context.Background(), FetchRequest{URL: "http://test.com/truc"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.Status != responseB.StatusCode {
+		t.Fatalf("bad response: want %d, got %d", responseB.StatusCode, result.Status)
+	}
+	if mock.NbCall != 2 {
+		t.Fatalf("bad number of calls: want 2, got %d", mock.NbCall)
+	}
+}
+
+func TestCrawlRetryCount(t *testing.T) {
+	n := 5
+	for _, statusCode := range retryStatus {
+		t.Run("Retry after "+strconv.Itoa(statusCode), func(t *testing.T) {
+			t.Parallel()
+			response := NewResponse(statusCode)
+			mock := internal.NewMockTransport(response, nil)
+			client := newTestClient(mock, n, nil)
+
+			result, err := client.Fetch(context.Background(), FetchRequest{URL: "http://test.com/truc"})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if result.Status != statusCode {
+				t.Fatalf("the last response should be returned: got %d", result.Status)
+			}
+			// +1 is for initial call
+			if mock.NbCall != n+1 {
+				t.Fatalf("Retried wrong number of time: want %d, got %d", n, mock.NbCall-1)
+			}
+		})
+	}
+}
+
+func TestCrawlRetryTimeout(t *testing.T) {
+	mock := internal.NewMockTransport(nil, timeoutError{})
+	client := newTestClient(mock, 2, nil)
+
+	result, err := client.Fetch(context.Background(), FetchRequest{URL: "http://test.com/truc"})
+	if err == nil || result.Err.Kind != ErrorTimeout {
+		t.Fatalf("expected a timeout error: got %v", err)
+	}
+	if mock.NbCall != 3 {
+		t.Fatalf("timeouts should be retried: want 3 calls, got %d", mock.NbCall)
+	}
+}
+
+func TestCrawlRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mock := internal.NewMockTransportWithCallback(NewResponse(503), nil, func(*internal.MockTransport) {
+		cancel()
+	})
+	client := newTestClient(mock, 5, nil)
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://test.com/truc", nil)
+	client.Do(req)
+	if mock.NbCall != 1 {
+		t.Fatalf("canceled requests should not be retried: got %d calls", mock.NbCall)
+	}
+}
+
+func TestCrawlRetryAfter(t *testing.T) {
+	tests := map[string]struct {
+		retryAfter string
+		calls      int
+		delayed    time.Duration
+	}{
+		"short wait": {"0", 2, 0},
+		"long wait":  {"30", 1, 30 * time.Second},
+		"very long":  {"3600", 1, time.Hour},
+		"http date":  {time.Now().Add(2 * time.Hour).UTC().Format(http.TimeFormat), 1, 2 * time.Hour},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			response := NewResponse(429)
+			response.Header.Set("Retry-After", test.retryAfter)
+			mock := internal.NewMockTransport(response, nil)
+			pacer := &pacerRecorder{delays: make(map[string]time.Time)}
+			client := newTestClient(mock, 1, pacer)
+
+			client.Fetch(context.Background(), FetchRequest{URL: "http://test.com/truc"})
+			if mock.NbCall != test.calls {
+				t.Fatalf("bad number of calls: want %d, got %d", test.calls, mock.NbCall)
+			}
+			until, ok := pacer.delays["test.com"]
+			if !ok {
+				t.Fatal("the host was not delayed")
+			}
+			if d := time.Until(until); d > test.delayed || d < test.delayed-5*time.Second {
+				t.Fatalf("bad delay: want ~%s; got %s", test.delayed, d)
+			}
+		})
+	}
+}
+
+func TestCrawlClientObserve(t *testing.T) {
+	responseA := NewResponse(503)
+	responseB := NewResponse(404)
+	callback := func(m *internal.MockTransport) {
+		switch m.NbCall {
+		case 1:
+			m.Response, m.Err = nil, timeoutError{}
+		case 2:
+			m.Response, m.Err = responseB, nil
+		}
+	}
+	mock := internal.NewMockTransportWithCallback(responseA, nil, callback)
+	pacer := &pacerRecorder{delays: make(map[string]time.Time)}
+	client := newTestClient(mock, 5, pacer)
+
+	client.Fetch(context.Background(), FetchRequest{URL: "http://test.com/truc"})
+	expected := []politeness.Outcome{politeness.Overloaded, politeness.TimedOut, politeness.Success}
+	if !slices.Equal(pacer.outcomes, expected) {
+		t.Fatalf("bad outcomes: want %v; got %v", expected, pacer.outcomes)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := map[string]struct {
+		header   string
+		expected time.Duration
+		ok       bool
+	}{
+		"seconds":   {"120", 2 * time.Minute, true},
+		"spaces":    {" 5 ", 5 * time.Second, true},
+		"date":      {"Fri, 01 Mar 2024 10:30:00 GMT", 30 * time.Minute, true},
+		"past date": {"Fri, 01 Mar 2024 09:00:00 GMT", 0, true},
+		"empty":     {"", 0, false},
+		"negative":  {"-1", 0, false},
+		"invalid":   {"soon", 0, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got, ok := parseRetryAfter(test.header, now)
+			if ok != test.ok || got != test.expected {
+				t.Fatalf("bad Retry-After: want %s, %t; got %s, %t", test.expected, test.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := map[string]struct {
+		attempt int
+		min     time.Duration
+		max     time.Duration
+	}{
+		"firstRetry":  {0, 250 * time.Millisecond, 500 * time.Millisecond},
+		"secondRetry": {1, 500 * time.Millisecond, time.Second},
+		"thirdRetry":  {2, time.Second, 2 * time.Second},
+		"capped":      {10, maxBackoff / 2, maxBackoff},
+		"overflow":    {100, maxBackoff / 2, maxBackoff},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for range 100 {
+				got := backoff(500*time.Millisecond, test.attempt)
+				if got < test.min || got > test.max {
+					t.Fatalf("bad backoff: want between %s and %s; got %s", test.min, test.max, got)
+				}
+			}
+		})
+	}
+}
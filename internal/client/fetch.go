@@ -0,0 +1,252 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+// Redirects followed before giving up with ErrTooManyRedirects, unless the request asks
+// for less
+const maxRedirects = 10
+
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+type Fetcher interface {
+	// Fetch sends the request and reads the response. The result is never nil, when the
+	// error is not nil it is the FetchError of the result and the result holds what was
+	// received before the failure.
+	Fetch(ctx context.Context, req FetchRequest) (*FetchResult, error)
+}
+
+// Doer sends HTTP requests, like http.Client.
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// FetchRequest describes a request sent by a Fetcher.
+type FetchRequest struct {
+	Method string // GET if empty
+	URL    string
+	// The request is conditional if the validators are not zero: the server answers
+	// 304 Not Modified if the page did not change since the response they come from.
+	Validators commons.Validators
+	// Bytes of the decoded body that are read, the rest is truncated. The body is not
+	// read if it is 0 or if the status is not 2xx.
+	MaxBodySize int64
+	// Redirects followed before giving up with ErrTooManyRedirects, the default of the
+	// client if 0. It is only enforced by a CrawlClient.
+	MaxRedirects int
+}
+
+// FetchResult is the response to a FetchRequest.
+type FetchResult struct {
+	Status    int
+	URL       *url.URL   // Final url, after the redirects
+	Redirects []*url.URL // Urls that redirected to the final one, in order
+	Header    http.Header
+	Body      []byte // Decoded from its Content-Encoding by the decompression layer
+	Truncated bool   // The body was larger than the MaxBodySize of the request
+	Timings   Timings
+	Err       *FetchError // Nil if the response was received and read
+}
+
+// Timings of a fetch, retries included.
+type Timings struct {
+	Start   time.Time
+	Headers time.Duration // Until the headers of the response were received
+	Total   time.Duration // Until the body was read
+}
+
+// ErrorKind classifies why a fetch failed.
+type ErrorKind string
+
+const (
+	ErrorInvalidRequest   ErrorKind = "invalid-request"
+	ErrorCanceled         ErrorKind = "canceled"
+	ErrorTimeout          ErrorKind = "timeout"
+	ErrorDNS              ErrorKind = "dns"
+	ErrorConnection       ErrorKind = "connection"
+	ErrorTLS              ErrorKind = "tls"
+	ErrorTooManyRedirects ErrorKind = "too-many-redirects"
+	ErrorBody             ErrorKind = "body"
+	ErrorOther            ErrorKind = "other"
+)
+
+type FetchError struct {
+	Kind ErrorKind
+	URL  string
+	Err  error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("failed to fetch %s (%s): %s", e.URL, e.Kind, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// NewFetcher returns a Fetcher that sends its requests with doer, for example an
+// http.Client in tests.
+func NewFetcher(doer Doer) Fetcher {
+	return &doerFetcher{doer: doer}
+}
+
+type doerFetcher struct {
+	doer Doer
+}
+
+func (f *doerFetcher) Fetch(ctx context.Context, req FetchRequest) (*FetchResult, error) {
+	return fetch(ctx, f.doer, req)
+}
+
+func fetch(ctx context.Context, doer Doer, fetchReq FetchRequest) (*FetchResult, error) {
+	result := &FetchResult{Timings: Timings{Start: time.Now()}}
+	req, err := newRequest(ctx, fetchReq)
+	if err != nil {
+		return result.fail(fetchReq.URL, ErrorInvalidRequest, err)
+	}
+	result.URL = req.URL
+
+	resp, err := doer.Do(req)
+	result.Timings.Headers = time.Since(result.Timings.Start)
+	if resp != nil {
+		// A response comes with an error when the redirects are stopped, it is the last one
+		defer resp.Body.Close()
+		result.read(resp)
+	}
+	if err != nil {
+		result.Timings.Total = result.Timings.Headers
+		return result.fail(fetchReq.URL, classify(ctx, err), err)
+	}
+
+	if fetchReq.MaxBodySize > 0 && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		result.Body, result.Truncated, err = readBody(resp, fetchReq.MaxBodySize)
+		result.Timings.Total = time.Since(result.Timings.Start)
+		if err != nil {
+			// The connection may have failed too, but what matters is that the body is unusable
+			kind := classify(ctx, err)
+			if kind != ErrorCanceled && kind != ErrorTimeout {
+				kind = ErrorBody
+			}
+			return result.fail(fetchReq.URL, kind, err)
+		}
+	}
+	result.Timings.Total = time.Since(result.Timings.Start)
+	return result, nil
+}
+
+func newRequest(ctx context.Context, fetchReq FetchRequest) (*http.Request, error) {
+	method := fetchReq.Method
+	if method == "" {
+		method = "GET"
+	}
+	if fetchReq.MaxRedirects > 0 {
+		ctx = context.WithValue(ctx, maxRedirectsKey{}, fetchReq.MaxRedirects)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fetchReq.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if fetchReq.Validators.ETag != "" {
+		req.Header.Set("If-None-Match", fetchReq.Validators.ETag)
+	}
+	// Servers ignore it when If-None-Match is present, it is only a fallback
+	if fetchReq.Validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", fetchReq.Validators.LastModified)
+	}
+	return req, nil
+}
+
+// Keep the status, headers and urls of the response
+func (r *FetchResult) read(resp *http.Response) {
+	r.Status = resp.StatusCode
+	r.Header = resp.Header
+	if resp.Request == nil {
+		return
+	}
+	if resp.Request.URL != nil {
+		r.URL = resp.Request.URL
+	}
+	// Each request made after a redirect points to the response that caused it
+	for req := resp.Request; req.Response != nil && req.Response.Request != nil; req = req.Response.Request {
+		r.Redirects = append(r.Redirects, req.Response.Request.URL)
+	}
+	slices.Reverse(r.Redirects)
+}
+
+func (r *FetchResult) fail(url string, kind ErrorKind, err error) (*FetchResult, error) {
+	r.Err = &FetchError{Kind: kind, URL: url, Err: err}
+	return r, r.Err
+}
+
+// Read at most limit bytes of the body
+func readBody(resp *http.Response, limit int64) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(buf.Len()) > limit {
+		return buf.Bytes()[:limit], true, nil
+	}
+	return buf.Bytes(), false, nil
+}
+
+func classify(ctx context.Context, err error) ErrorKind {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	switch {
+	case errors.Is(err, context.Canceled) || ctx.Err() == context.Canceled:
+		return ErrorCanceled
+	case errors.Is(err, ErrTooManyRedirects):
+		return ErrorTooManyRedirects
+	case errors.As(err, &dnsErr):
+		return ErrorDNS
+	case errors.As(err, &netErr) && netErr.Timeout(), errors.Is(err, context.DeadlineExceeded):
+		return ErrorTimeout
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &certErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ErrorTLS
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &opErr):
+		return ErrorConnection
+	}
+	return ErrorOther
+}
+
+// Context key of the MaxRedirects of a request
+type maxRedirectsKey struct{}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	limit := maxRedirects
+	if n, ok := req.Context().Value(maxRedirectsKey{}).(int); ok && n < limit {
+		limit = n
+	}
+	if len(via) > limit {
+		return fmt.Errorf("stopped after %d redirects: %w", limit, ErrTooManyRedirects)
+	}
+	return nil
+}
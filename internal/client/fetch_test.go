@@ -0,0 +1,209 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+func TestFetchRedirects(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle("/a", http.RedirectHandler("/b", http.StatusMovedPermanently))
+	mux.Handle("/b", http.RedirectHandler("/c", http.StatusFound))
+	mux.HandleFunc("/c", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<html></html>")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	client := NewCrawlClient(context.Background(), 0, 0, nil)
+
+	result, err := client.Fetch(context.Background(), FetchRequest{URL: server.URL + "/a", MaxBodySize: 1024})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.Status != 200 || string(result.Body) != "<html></html>" || result.Header.Get("Content-Type") != "text/html" {
+		t.Fatalf("bad response: got status %d, body %q and headers %v", result.Status, result.Body, result.Header)
+	}
+	if result.URL.Path != "/c" {
+		t.Fatalf("bad final url: want /c; got %s", result.URL)
+	}
+	if len(result.Redirects) != 2 || result.Redirects[0].Path != "/a" || result.Redirects[1].Path != "/b" {
+		t.Fatalf("bad redirect chain: want [/a /b]; got %s", result.Redirects)
+	}
+	if result.Timings.Start.IsZero() || result.Timings.Headers <= 0 || result.Timings.Total < result.Timings.Headers {
+		t.Fatalf("bad timings: got %+v", result.Timings)
+	}
+}
+
+func TestFetchTooManyRedirects(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.RedirectHandler("/loop", http.StatusFound))
+	defer server.Close()
+	client := NewCrawlClient(context.Background(), 0, 0, nil)
+
+	result, err := client.Fetch(context.Background(), FetchRequest{URL: server.URL + "/loop"})
+	if !errors.Is(err, ErrTooManyRedirects) || result.Err.Kind != ErrorTooManyRedirects {
+		t.Fatalf("expected too many redirects: got %v", err)
+	}
+	if result.Status != http.StatusFound {
+		t.Fatalf("the last redirect should be kept: got status %d", result.Status)
+	}
+}
+
+func TestFetchMaxRedirects(t *testing.T) {
+	tests := map[string]struct {
+		redirects int
+		err       error
+	}{
+		"below": {4, nil},
+		"limit": {5, nil},
+		"above": {6, ErrTooManyRedirects},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			mux := http.NewServeMux()
+			for i := 0; i < test.redirects; i++ {
+				mux.Handle(fmt.Sprintf("/%d", i), http.RedirectHandler(fmt.Sprintf("/%d", i+1), http.StatusFound))
+			}
+			mux.HandleFunc(fmt.Sprintf("/%d", test.redirects), func(w http.ResponseWriter, req *http.Request) {})
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			client := NewCrawlClient(context.Background(), 0, 0, nil)
+
+			result, err := client.Fetch(context.Background(), FetchRequest{URL: server.URL + "/0", MaxRedirects: 5})
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad error: want %v; got %v", test.err, err)
+			}
+			if test.err == nil && len(result.Redirects) != test.redirects {
+				t.Fatalf("bad redirect chain: want %d redirects; got %s", test.redirects, result.Redirects)
+			}
+		})
+	}
+}
+
+func TestFetchConditional(t *testing.T) {
+	t.Parallel()
+	validators := commons.Validators{ETag: `"abc"`, LastModified: "Fri, 01 Mar 2024 10:30:00 GMT"}
+	var header http.Header
+	mock := internal.NewMockTransportWithCallback(NewResponse(304), nil, func(*internal.MockTransport) {})
+	fetcher := NewFetcher(&http.Client{Transport: RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		header = req.Header
+		return mock.RoundTrip(req)
+	})})
+
+	result, err := fetcher.Fetch(context.Background(), FetchRequest{URL: "http://test.com", Validators: validators})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.Status != 304 {
+		t.Fatalf("bad status: want 304; got %d", result.Status)
+	}
+	if header.Get("If-None-Match") != validators.ETag ||
+		header.Get("If-Modified-Since") != validators.LastModified {
+		t.Fatalf("bad request headers: got %v", header)
+	}
+
+	_, err = fetcher.Fetch(context.Background(), FetchRequest{URL: "http://test.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if header.Get("If-None-Match") != "" || header.Get("If-Modified-Since") != "" {
+		t.Fatalf("a request without validators should not be conditional: got %v", header)
+	}
+}
+
+func TestFetchBody(t *testing.T) {
+	tests := map[string]struct {
+		status    int
+		body      []byte
+		limit     int64
+		expected  string
+		truncated bool
+	}{
+		"plain":       {200, []byte("content"), 1024, "content", false},
+		"truncated":   {200, []byte("content"), 4, "cont", true},
+		"not read":    {200, []byte("content"), 0, "", false},
+		"not success": {404, []byte("not found"), 1024, "", false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			recorder := httptest.NewRecorder()
+			recorder.WriteHeader(test.status)
+			recorder.Write(test.body)
+			fetcher := NewFetcher(&http.Client{Transport: internal.NewMockTransport(recorder.Result(), nil)})
+
+			result, err := fetcher.Fetch(context.Background(), FetchRequest{URL: "http://test.com", MaxBodySize: test.limit})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if string(result.Body) != test.expected || result.Truncated != test.truncated {
+				t.Fatalf("bad body: want %q (truncated %t); got %q (truncated %t)", test.expected, test.truncated, result.Body, result.Truncated)
+			}
+		})
+	}
+}
+
+func TestFetchCanceled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client := NewCrawlClient(context.Background(), 0, 3, nil)
+
+	result, err := client.Fetch(ctx, FetchRequest{URL: "http://test.com"})
+	if err == nil || result.Err.Kind != ErrorCanceled {
+		t.Fatalf("expected a canceled error: got %v", err)
+	}
+}
+
+func TestFetchInvalidRequest(t *testing.T) {
+	t.Parallel()
+	fetcher := NewFetcher(http.DefaultClient)
+	result, err := fetcher.Fetch(context.Background(), FetchRequest{URL: "http://test.com/%zz"})
+	if err == nil || result.Err.Kind != ErrorInvalidRequest {
+		t.Fatalf("expected an invalid request error: got %v", err)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		expected ErrorKind
+	}{
+		"canceled":  {fmt.Errorf("wrapped: %w", context.Canceled), ErrorCanceled},
+		"deadline":  {context.DeadlineExceeded, ErrorTimeout},
+		"timeout":   {timeoutError{}, ErrorTimeout},
+		"dns":       {&net.DNSError{Err: "no such host", Name: "test.com", IsNotFound: true}, ErrorDNS},
+		"refused":   {&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, ErrorConnection},
+		"reset":     {fmt.Errorf("read: %w", syscall.ECONNRESET), ErrorConnection},
+		"tls":       {x509.UnknownAuthorityError{}, ErrorTLS},
+		"redirects": {fmt.Errorf("get: %w", ErrTooManyRedirects), ErrorTooManyRedirects},
+		"other":     {errors.New("unexpected"), ErrorOther},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := classify(context.Background(), test.err)
+			if got != test.expected {
+				t.Fatalf("bad classification of %q: want %s; got %s", strings.TrimSpace(test.err.Error()), test.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+package client
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/politeness"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Product token sent as User-Agent
+const userAgent = "BacklinksBot"
+
+// Bytes of a decoded body the client accepts to read, bigger responses fail
+const defaultMaxBodySize = 64 * 1024 * 1024
+
+var ErrBodyTooLarge = errors.New("response body larger than the limit of the client")
+
+// Middleware wraps a RoundTripper in another one that adds a feature to the requests
+// going through it.
+type Middleware func(next http.RoundTripper) http.RoundTripper
+
+// RoundTripperFunc is an adapter to use a function as a RoundTripper, like
+// http.HandlerFunc.
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Layer is a named middleware of a Pipeline.
+type Layer struct {
+	Name       string
+	Middleware Middleware
+}
+
+// Names of the layers of the default pipeline
+const (
+	LayerUserAgent     = "user-agent"
+	LayerRetry         = "retry"
+	LayerRateLimit     = "rate-limit"
+	LayerMetrics       = "metrics"
+	LayerTimeout       = "timeout"
+	LayerBodyLimit     = "body-limit"
+	LayerDecompression = "decompression"
+)
+
+// Pipeline is an ordered list of layers, from the outermost one which sees the requests
+// first to the innermost one which hands them to the transport. The methods that edit it
+// return a copy and panic if there is no layer with the name, that is a programming error.
+type Pipeline []Layer
+
+// DefaultPipeline returns the layers of the CrawlClient:
+//   - user-agent: sets the User-Agent of the requests that have none
+//   - retry: retries transient failures up to maxRetry times with an exponential backoff,
+//     until the context is canceled
+//   - rate-limit: waits for the pacer before each attempt, tells it how the host answered
+//     and holds back the hosts that answer with a Retry-After header (it can be nil)
+//   - metrics: exports the prometheus metrics of each attempt
+//   - timeout: bounds each attempt to timeout, reading the body included (0 means none)
+//   - body-limit: fails the responses bigger than defaultMaxBodySize once decoded
+//   - decompression: asks for compressed responses and decodes them
+//
+// Redirects are followed by the client above the pipeline, each one goes through all the
+// layers.
+func DefaultPipeline(
+	ctx context.Context,
+	timeout time.Duration,
+	maxRetry int,
+	pacer HostPacer,
+) Pipeline {
+	return Pipeline{
+		{LayerUserAgent, UserAgent(userAgent)},
+		{LayerRetry, Retry(ctx, maxRetry, defaultBackoffBase)},
+		{LayerRateLimit, RateLimit(pacer)},
+		{LayerMetrics, Metrics()},
+		{LayerTimeout, Timeout(timeout)},
+		{LayerBodyLimit, BodyLimit(defaultMaxBodySize)},
+		{LayerDecompression, Decompression()},
+	}
+}
+
+// InsertBefore adds the layers right outside the named one.
+func (p Pipeline) InsertBefore(name string, layers ...Layer) Pipeline {
+	return slices.Insert(slices.Clone(p), p.index(name), layers...)
+}
+
+// InsertAfter adds the layers right inside the named one.
+func (p Pipeline) InsertAfter(name string, layers ...Layer) Pipeline {
+	return slices.Insert(slices.Clone(p), p.index(name)+1, layers...)
+}
+
+// Replace swaps the named layer for another one.
+func (p Pipeline) Replace(name string, layer Layer) Pipeline {
+	i := p.index(name)
+	p = slices.Clone(p)
+	p[i] = layer
+	return p
+}
+
+// Remove drops the named layer.
+func (p Pipeline) Remove(name string) Pipeline {
+	i := p.index(name)
+	return slices.Delete(slices.Clone(p), i, i+1)
+}
+
+// Wrap returns a RoundTripper that sends the requests through all the layers and then
+// through the transport.
+func (p Pipeline) Wrap(transport http.RoundTripper) http.RoundTripper {
+	roundTripper := transport
+	for _, layer := range slices.Backward(p) {
+		roundTripper = layer.Middleware(roundTripper)
+	}
+	return roundTripper
+}
+
+func (p Pipeline) index(name string) int {
+	i := slices.IndexFunc(p, func(layer Layer) bool { return layer.Name == name })
+	if i < 0 {
+		panic(fmt.Sprintf("no layer %q in the pipeline", name))
+	}
+	return i
+}
+
+// NewTransport creates the transport of the CrawlClient, tuned to open connections to
+// many hosts while keeping few of them idle.
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          2000,
+		MaxIdleConnsPerHost:   1,
+		IdleConnTimeout:       10 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		// The decompression layer does it, for deflate too
+		DisableCompression: true,
+	}
+}
+
+// UserAgent sets the User-Agent of the requests that have none.
+func UserAgent(agent string) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("User-Agent") != "" {
+				return next.RoundTrip(req)
+			}
+			// A RoundTripper must not modify the request it is given
+			req = req.Clone(req.Context())
+			req.Header.Set("User-Agent", agent)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+// Retry sends the requests again on transient failures, up to maxRetry times, waiting an
+// exponential backoff from backoffBase. A response asking to wait longer than the backoff
+// with Retry-After is returned right away: the host is held back by the rate-limit layer
+// instead of a goroutine. It stops when the request or ctx is canceled.
+func Retry(ctx context.Context, maxRetry int, backoffBase time.Duration) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return &retryTransport{ctx: ctx, next: next, maxRetry: maxRetry, backoffBase: backoffBase}
+	}
+}
+
+type retryTransport struct {
+	ctx         context.Context
+	next        http.RoundTripper
+	maxRetry    int
+	backoffBase time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(attemptReq)
+
+		reason := retryReason(req, resp, err)
+		if reason == "" {
+			return resp, err
+		}
+		if attempt >= t.maxRetry || !canReplay(req) {
+			giveUpCounter.WithLabelValues(reason).Inc()
+			return resp, err
+		}
+		wait := backoff(t.backoffBase, attempt)
+		if after, ok := retryAfter(resp); ok && after > wait {
+			giveUpCounter.WithLabelValues(reason).Inc()
+			return resp, err
+		}
+		if resp != nil {
+			// Drain the body so that the connection can be reused
+			io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainSize))
+			resp.Body.Close()
+		}
+		retriesCounter.WithLabelValues(reason).Inc()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-t.ctx.Done():
+			timer.Stop()
+			return nil, t.ctx.Err()
+		case <-timer.C:
+		}
+		attemptReq, err = replay(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// RateLimit waits for the pacer before sending the requests, tells it how the hosts
+// answer and holds back the hosts that ask us to come back later. Without pacer the
+// requests go through.
+func RateLimit(pacer HostPacer) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		if pacer == nil {
+			return next
+		}
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			err := pacer.Wait(req.Context(), req.Method, req.URL.Host)
+			if err != nil {
+				return nil, err
+			}
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			observe(pacer, req, resp, err, time.Since(start))
+			if after, ok := retryAfter(resp); ok {
+				pacer.Delay(req.URL.Host, time.Now().Add(after))
+			}
+			return resp, err
+		})
+	}
+}
+
+// Tell the pacer how the host answered. Other errors and statuses say nothing about the
+// load of the host.
+func observe(pacer HostPacer, req *http.Request, resp *http.Response, err error, latency time.Duration) {
+	if req.Context().Err() != nil {
+		return
+	}
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			pacer.Observe(req.URL.Host, politeness.TimedOut, latency)
+		}
+		return
+	}
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+		pacer.Observe(req.URL.Host, politeness.Overloaded, latency)
+	case resp.StatusCode < 500:
+		pacer.Observe(req.URL.Host, politeness.Success, latency)
+	}
+}
+
+// Metrics exports the number, duration, DNS and TLS latencies and concurrency of the
+// requests.
+func Metrics() Middleware {
+	// Define functions for the available httptrace.ClientTrace hook
+	// functions that we want to instrument.
+	trace := &promhttp.InstrumentTrace{
+		DNSStart: func(t float64) {
+			dnsLatencyVec.WithLabelValues("dns_start").Observe(t)
+		},
+		DNSDone: func(t float64) {
+			dnsLatencyVec.WithLabelValues("dns_done").Observe(t)
+		},
+		TLSHandshakeStart: func(t float64) {
+			tlsLatencyVec.WithLabelValues("tls_handshake_start").Observe(t)
+		},
+		TLSHandshakeDone: func(t float64) {
+			tlsLatencyVec.WithLabelValues("tls_handshake_done").Observe(t)
+		},
+	}
+	return func(next http.RoundTripper) http.RoundTripper {
+		return promhttp.InstrumentRoundTripperInFlight(inFlightGauge,
+			promhttp.InstrumentRoundTripperCounter(counter,
+				promhttp.InstrumentRoundTripperTrace(trace,
+					promhttp.InstrumentRoundTripperDuration(histVec, next),
+				),
+			),
+		)
+	}
+}
+
+// Timeout bounds each request to the given duration, until its body is closed. A
+// duration of 0 or less means no timeout.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		if timeout <= 0 {
+			return next
+		}
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			ctx, cancel := context.WithTimeout(req.Context(), timeout)
+			resp, err := next.RoundTrip(req.WithContext(ctx))
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+			return resp, nil
+		})
+	}
+}
+
+// Release the context of the request once its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// BodyLimit makes the reads of the bodies bigger than limit fail with ErrBodyTooLarge.
+func BodyLimit(limit int64) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+			resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: limit}
+			return resp, nil
+		})
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// A body of exactly the limit is fine, only fail if there is more
+		var extra [1]byte
+		n, err := b.ReadCloser.Read(extra[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// Decompression asks for gzip or deflate compressed responses and decodes them. The
+// requests that already have an Accept-Encoding are left alone, like http.Transport does.
+func Decompression() Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.Header.Get("Accept-Encoding") != "" {
+				return next.RoundTrip(req)
+			}
+			req = req.Clone(req.Context())
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				return nil, err
+			}
+
+			var newReader func(io.Reader) (io.ReadCloser, error)
+			switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+			case "gzip", "x-gzip":
+				newReader = func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+			case "deflate":
+				newReader = zlib.NewReader
+			default:
+				return resp, nil
+			}
+			resp.Body = &decodedBody{body: resp.Body, newReader: newReader}
+			resp.Header.Del("Content-Encoding")
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+			resp.Uncompressed = true
+			return resp, nil
+		})
+	}
+}
+
+// The decoder is created on the first read: it reads the header of the encoding, which
+// is not there for responses without body like the ones to HEAD requests.
+type decodedBody struct {
+	body      io.ReadCloser
+	newReader func(io.Reader) (io.ReadCloser, error)
+	reader    io.ReadCloser
+	err       error
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.reader == nil && b.err == nil {
+		reader, err := b.newReader(b.body)
+		if err != nil {
+			// The readers are typed nil pointers on error
+			b.err = err
+		} else {
+			b.reader = reader
+		}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.reader.Read(p)
+}
+
+func (b *decodedBody) Close() error {
+	if b.reader != nil {
+		b.reader.Close()
+	}
+	return b.body.Close()
+}
+
+// Exchange is a request that went through a Record layer and what came back.
+type Exchange struct {
+	Request  *http.Request
+	Response *http.Response // Nil if Err is not; its body is left to the caller
+	Err      error
+	Start    time.Time
+	Duration time.Duration // Until the headers of the response were received
+}
+
+// Record calls record with each exchange that goes through it, for example to log or
+// store them while debugging. It is not part of the default pipeline, it can be inserted
+// where the exchanges should be seen: outside the retry layer for one exchange per
+// request, inside it for one per attempt.
+func Record(record func(Exchange)) Middleware {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+			record(Exchange{Request: req, Response: resp, Err: err, Start: start, Duration: time.Since(start)})
+			return resp, err
+		})
+	}
+}
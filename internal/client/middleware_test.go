@@ -0,0 +1,245 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal"
+)
+
+// A layer that appends its name to calls when a request goes through it
+func tracingLayer(name string, calls *[]string) Layer {
+	return Layer{name, func(next http.RoundTripper) http.RoundTripper {
+		return RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			*calls = append(*calls, name)
+			return next.RoundTrip(req)
+		})
+	}}
+}
+
+func layerNames(pipeline Pipeline) []string {
+	names := make([]string, 0, len(pipeline))
+	for _, layer := range pipeline {
+		names = append(names, layer.Name)
+	}
+	return names
+}
+
+func TestPipelineEdit(t *testing.T) {
+	var calls []string
+	pipeline := Pipeline{tracingLayer("a", &calls), tracingLayer("b", &calls)}
+	tests := map[string]struct {
+		edited   Pipeline
+		expected []string
+	}{
+		"insert before": {pipeline.InsertBefore("b", tracingLayer("c", &calls)), []string{"a", "c", "b"}},
+		"insert after":  {pipeline.InsertAfter("b", tracingLayer("c", &calls)), []string{"a", "b", "c"}},
+		"replace":       {pipeline.Replace("a", tracingLayer("c", &calls)), []string{"c", "b"}},
+		"remove":        {pipeline.Remove("a"), []string{"b"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := layerNames(test.edited); !slices.Equal(got, test.expected) {
+				t.Fatalf("bad layers: want %v; got %v", test.expected, got)
+			}
+		})
+	}
+	if got := layerNames(pipeline); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("the edits should not modify the pipeline: got %v", got)
+	}
+}
+
+func TestPipelineEditUnknownLayer(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("editing an unknown layer should panic")
+		}
+	}()
+	Pipeline{}.Remove("unknown")
+}
+
+func TestPipelineOrder(t *testing.T) {
+	var calls []string
+	pipeline := DefaultPipeline(context.Background(), time.Second, 0, nil).
+		InsertBefore(LayerUserAgent, tracingLayer("outermost", &calls)).
+		InsertAfter(LayerDecompression, tracingLayer("innermost", &calls))
+	mock := internal.NewMockTransport(NewResponse(200), nil)
+	client := NewCrawlClientWithPipeline(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		calls = append(calls, "transport")
+		return mock.RoundTrip(req)
+	}), pipeline)
+
+	_, err := client.Fetch(context.Background(), FetchRequest{URL: "http://test.com"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := []string{"outermost", "innermost", "transport"}
+	if !slices.Equal(calls, expected) {
+		t.Fatalf("bad order: want %v; got %v", expected, calls)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	tests := map[string]struct {
+		header   string
+		expected string
+	}{
+		"default": {"", userAgent},
+		"custom":  {"OtherBot", "OtherBot"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var got string
+			transport := UserAgent(userAgent)(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				got = req.Header.Get("User-Agent")
+				return NewResponse(200), nil
+			}))
+			req, _ := http.NewRequest("GET", "http://test.com", nil)
+			if test.header != "" {
+				req.Header.Set("User-Agent", test.header)
+			}
+
+			transport.RoundTrip(req)
+			if got != test.expected {
+				t.Fatalf("bad User-Agent: want %q; got %q", test.expected, got)
+			}
+			if req.Header.Get("User-Agent") != test.header {
+				t.Fatal("the request should not be modified")
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	transport := Timeout(10 * time.Millisecond)(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}))
+	req, _ := http.NewRequest("GET", "http://test.com", nil)
+
+	_, err := transport.RoundTrip(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout: got %v", err)
+	}
+	if retryReason(req, nil, err) != "timeout" {
+		t.Fatal("the timeout of an attempt should be retried")
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	tests := map[string]struct {
+		limit int64
+		err   error
+	}{
+		"smaller": {8, nil},
+		"exact":   {7, nil},
+		"larger":  {6, ErrBodyTooLarge},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			transport := BodyLimit(test.limit)(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader("content"))}, nil
+			}))
+			req, _ := http.NewRequest("GET", "http://test.com", nil)
+
+			resp, _ := transport.RoundTrip(req)
+			_, err := io.ReadAll(resp.Body)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("bad error: want %v; got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestDecompression(t *testing.T) {
+	var gzipped, deflated bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write([]byte("decoded content"))
+	gzipWriter.Close()
+	zlibWriter := zlib.NewWriter(&deflated)
+	zlibWriter.Write([]byte("decoded content"))
+	zlibWriter.Close()
+
+	tests := map[string]struct {
+		method   string
+		encoding string
+		body     []byte
+		expected string
+		err      bool
+	}{
+		"plain":       {"GET", "", []byte("content"), "content", false},
+		"gzip":        {"GET", "gzip", gzipped.Bytes(), "decoded content", false},
+		"deflate":     {"GET", "deflate", deflated.Bytes(), "decoded content", false},
+		"bad gzip":    {"GET", "gzip", []byte("content"), "", true},
+		"unsupported": {"GET", "br", []byte("content"), "content", false},
+		"head":        {"HEAD", "gzip", nil, "", false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			var acceptEncoding string
+			transport := Decompression()(RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				acceptEncoding = req.Header.Get("Accept-Encoding")
+				recorder := httptest.NewRecorder()
+				if test.encoding != "" {
+					recorder.Header().Set("Content-Encoding", test.encoding)
+				}
+				recorder.Write(test.body)
+				return recorder.Result(), nil
+			}))
+			req, _ := http.NewRequest(test.method, "http://test.com", nil)
+
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			defer resp.Body.Close()
+			if acceptEncoding != "gzip, deflate" {
+				t.Fatalf("compressed responses should be asked for: got %q", acceptEncoding)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if (err != nil) != test.err {
+				t.Fatalf("bad error: want error %t; got %v", test.err, err)
+			}
+			if !test.err && string(body) != test.expected {
+				t.Fatalf("bad body: want %q; got %q", test.expected, body)
+			}
+		})
+	}
+}
+
+func TestRecord(t *testing.T) {
+	var exchanges []Exchange
+	pipeline := DefaultPipeline(context.Background(), time.Second, 2, nil).
+		Replace(LayerRetry, Layer{LayerRetry, Retry(context.Background(), 2, time.Microsecond)}).
+		InsertAfter(LayerRetry, Layer{"record", Record(func(exchange Exchange) {
+			exchanges = append(exchanges, exchange)
+		})})
+	client := NewCrawlClientWithPipeline(internal.NewMockTransport(NewResponse(503), nil), pipeline)
+
+	client.Fetch(context.Background(), FetchRequest{URL: "http://test.com/truc"})
+	if len(exchanges) != 3 {
+		t.Fatalf("each attempt should be recorded inside the retry layer: got %d exchanges", len(exchanges))
+	}
+	for _, exchange := range exchanges {
+		if exchange.Response.StatusCode != 503 || exchange.Request.URL.Path != "/truc" || exchange.Start.IsZero() {
+			t.Fatalf("bad exchange: got %+v", exchange)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// Base of the exponential backoff, the first retry waits between 0.5 and 1 times it
+	defaultBackoffBase = 500 * time.Millisecond
+	maxBackoff         = 30 * time.Second
+	// Bodies of retried responses bigger than that are not drained
+	maxDrainSize = 64 * 1024
+)
+
+// Return why the request should be retried, or "" if it should not
+func retryReason(req *http.Request, resp *http.Response, err error) string {
+	if req.Context().Err() != nil {
+		return ""
+	}
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return "timeout"
+		}
+		if errors.Is(err, syscall.ECONNRESET) {
+			return "connection_reset"
+		}
+		return ""
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return strconv.Itoa(resp.StatusCode)
+	}
+	return ""
+}
+
+// A request with a body can only be sent again if the body can be recreated
+func canReplay(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// Copy of the request to send it again, with a new body
+func replay(req *http.Request) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	return clone, nil
+}
+
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	return RetryAfter(resp.StatusCode, resp.Header)
+}
+
+// RetryAfter returns how long the host asks us to wait before the next request, if the
+// status of its response says it is overloaded and it has a valid Retry-After header.
+func RetryAfter(status int, header http.Header) (time.Duration, bool) {
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	return parseRetryAfter(header.Get("Retry-After"), time.Now())
+}
+
+// Exponential backoff with jitter: a random duration between half and all of
+// base * 2^attempt, capped at maxBackoff.
+func backoff(base time.Duration, attempt int) time.Duration {
+	wait := maxBackoff
+	if attempt < 32 && base<<attempt > 0 && base<<attempt < maxBackoff {
+		wait = base << attempt
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// Parse the Retry-After header, either a number of seconds or an HTTP-date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(header)
+	if err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(header)
+	if err != nil {
+		return 0, false
+	}
+	return max(date.Sub(now), 0), true
+}
@@ -10,13 +10,81 @@ import (
 	"time"
 )
 
+// LinkGroup holds all the links found on a page, their From is the page url, and the
+// feeds it advertises.
 type LinkGroup struct {
-	From *url.URL
-	To   []*url.URL
+	From  *url.URL
+	Links []Link
+	Feeds []*url.URL
 }
 type Link struct {
-	From *url.URL
-	To   *url.URL
+	From     *url.URL
+	To       *url.URL
+	Text     string   // Anchor text, or alt text of the image when the anchor has none
+	Rel      []string // Lowercased values of the rel attribute, like nofollow or sponsored
+	Title    string
+	Position int // Index of the link among all the links of the page
+}
+
+// HasRel reports whether the link has any of the given rel values
+func (l Link) HasRel(values ...string) bool {
+	for _, value := range values {
+		if slices.Contains(l.Rel, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// PageHint is what a site announces about one of its pages, for example in a sitemap.
+type PageHint struct {
+	URL      *url.URL
+	LastMod  time.Time // Zero if unknown
+	Priority float64   // Between 0 and 1 relative to the other pages of the site
+	Fresh    bool      // Newly published, like the entries of a feed
+}
+
+// Failure is the reason why a crawl attempt did not yield any link.
+type Failure string
+
+const (
+	FailureRobotsDisallowed Failure = "robots-disallowed"
+	FailureBadStatus        Failure = "bad-status"
+	FailureBadContentType   Failure = "bad-content-type"
+	FailureXRobotsTag       Failure = "x-robots-tag"
+	FailureNetworkError     Failure = "network-error"
+	FailureParseError       Failure = "parse-error"
+	// The host is overloaded and asked to come back after Visit.RetryAfter
+	FailureRetryLater Failure = "retry-later"
+)
+
+// Visit is the outcome of a crawl attempt on a page, successful or not. Zero values
+// mean the information is not available (for example no status on a network error).
+type Visit struct {
+	URL         *url.URL
+	Status      int
+	ContentType string
+	Size        int64
+	Duration    time.Duration
+	Hash        uint64
+	Failure     Failure
+	// The page did not change since the previous visit (304 Not Modified), its content
+	// and links were not fetched again.
+	NotModified bool
+	Validators  Validators
+	MaxAge      time.Duration // How long the response is fresh according to its headers
+	RetryAfter  time.Duration // How long the host asked to wait, with FailureRetryLater
+}
+
+// Validators are the HTTP headers of a response used to make the next request
+// conditional, see RFC 9110 section 8.8.
+type Validators struct {
+	ETag         string
+	LastModified string
+}
+
+func (v Validators) IsZero() bool {
+	return v.ETag == "" && v.LastModified == ""
 }
 
 func ReverseHostname(hostname string) string {
@@ -0,0 +1,235 @@
+package controller
+
+import (
+	"context"
+	"math/rand"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Same as the default DB_BATCH_SIZE
+const benchBatchSize = 4096
+
+// These benchmarks run against a real database and a graph generated with
+// `vwww generate`. They are skipped unless BENCH_POSTGRES_URI and BENCH_VWWW_PATH are set.
+// The database is migrated and filled with the graph so use a disposable one.
+func setupBenchmark(b *testing.B) (*pgxpool.Pool, []*commons.LinkGroup) {
+	b.Helper()
+	pgURI, ok := os.LookupEnv("BENCH_POSTGRES_URI")
+	if !ok {
+		b.Skip("BENCH_POSTGRES_URI is not set")
+	}
+	vwwwPath, ok := os.LookupEnv("BENCH_VWWW_PATH")
+	if !ok {
+		b.Skip("BENCH_VWWW_PATH is not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b.Cleanup(cancel)
+	migrator, err := NewMigrator(ctx, pgURI)
+	if err != nil {
+		b.Fatalf("failed to connect to the database: %s", err)
+	}
+	err = migrator.Up(ctx)
+	if err != nil {
+		b.Fatalf("failed to migrate the database: %s", err)
+	}
+	_, err = migrator.pg.Exec(ctx, textLayoutSchema)
+	if err != nil {
+		b.Fatalf("failed to create the text layout tables: %s", err)
+	}
+	return migrator.pg, loadVWWW(b, vwwwPath)
+}
+
+// Read the links of a vwww graph as they would be found by crawling it locally
+func loadVWWW(b *testing.B, directoryPath string) []*commons.LinkGroup {
+	b.Helper()
+	entries, err := os.ReadDir(directoryPath)
+	if err != nil {
+		b.Fatalf("failed to read vwww directory: %s", err)
+	}
+
+	groups := make([]*commons.LinkGroup, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Name() == "seeds" {
+			continue
+		}
+		content, err := os.ReadFile(path.Join(directoryPath, entry.Name()))
+		if err != nil {
+			b.Fatalf("failed to read vwww page: %s", err)
+		}
+		group := &commons.LinkGroup{From: &url.URL{Scheme: "http", Host: "localhost", Path: "/" + entry.Name()}}
+		for i, target := range strings.Fields(string(content)) {
+			to := &url.URL{Scheme: "http", Host: "localhost", Path: "/" + target}
+			group.Links = append(group.Links, commons.Link{From: group.From, To: to, Position: i})
+		}
+		groups = append(groups, group)
+	}
+	if len(groups) == 0 {
+		b.Fatal("the vwww graph has no pages")
+	}
+	return groups
+}
+
+// The links layout before the migration 0005_links_page_ids, with both urls as text, so
+// that both layouts are measured by the same run
+const textLayoutSchema = `
+	CREATE UNLOGGED TABLE IF NOT EXISTS bench_text_links_staging (
+		source		text,
+		target		text,
+		anchor_text	text,
+		rel			text[],
+		title		text,
+		position	integer
+	);
+	CREATE TABLE IF NOT EXISTS bench_text_links (
+		source		text,
+		target		text,
+		anchor_text	text,
+		rel			text[],
+		title		text,
+		position	integer,
+
+		PRIMARY KEY (source, target)
+	);
+	CREATE INDEX IF NOT EXISTS bench_text_links_target_source ON bench_text_links (target, source);
+	TRUNCATE bench_text_links;
+`
+
+// Save a batch of pages and the links found on them
+type saveFunc func(ctx context.Context, pg *pgxpool.Pool, pages []*url.URL, groups []*commons.LinkGroup) error
+
+func saveIDLayout(ctx context.Context, pg *pgxpool.Pool, pages []*url.URL, groups []*commons.LinkGroup) error {
+	// Pages first so that links can reference their ids
+	err := insertPages(ctx, pg, pages)
+	if err != nil {
+		return err
+	}
+	return saveLinkGroups(ctx, pg, groups, 0)
+}
+
+func saveTextLayout(ctx context.Context, pg *pgxpool.Pool, pages []*url.URL, groups []*commons.LinkGroup) error {
+	rows := make([][]any, 0, len(pages))
+	for _, group := range groups {
+		for _, link := range group.Links {
+			rows = append(rows, []any{
+				group.From.String(), link.To.String(),
+				nullIfZero(link.Text), link.Rel, nullIfZero(link.Title), link.Position,
+			})
+		}
+	}
+	columns := []string{"source", "target", "anchor_text", "rel", "title", "position"}
+	return copyAndMerge(ctx, pg, "bench_text_links_staging", columns, rows, `
+		INSERT INTO bench_text_links (source, target, anchor_text, rel, title, position)
+		SELECT source, target, anchor_text, rel, title, position
+		FROM bench_text_links_staging
+		ON CONFLICT DO NOTHING;
+	`)
+}
+
+var layouts = []struct {
+	name string
+	save saveFunc
+}{
+	{"text", saveTextLayout},
+	{"ids", saveIDLayout},
+}
+
+// Group whole pages until the batch is full, like the controller does
+func nextBatch(groups []*commons.LinkGroup, next int) ([]*url.URL, []*commons.LinkGroup, int) {
+	batch := make([]*commons.LinkGroup, 0)
+	pages := make([]*url.URL, 0, benchBatchSize)
+	for len(pages) < benchBatchSize {
+		group := groups[next%len(groups)]
+		next++
+		batch = append(batch, group)
+		pages = append(pages, group.From)
+		for _, link := range group.Links {
+			pages = append(pages, link.To)
+		}
+	}
+	return pages, batch, next
+}
+
+func BenchmarkInsertLinksVWWW(b *testing.B) {
+	pg, groups := setupBenchmark(b)
+	ctx := context.Background()
+
+	for _, layout := range layouts {
+		b.Run("layout="+layout.name, func(b *testing.B) {
+			t0 := time.Now()
+			next := 0
+			nbLinks := 0
+			for i := 0; i < b.N; i++ {
+				pages, batch, n := nextBatch(groups, next)
+				next = n
+				err := layout.save(ctx, pg, pages, batch)
+				if err != nil {
+					b.Fatalf("failed to save links: %s", err)
+				}
+				nbLinks += len(pages) - len(batch)
+			}
+			b.ReportMetric(float64(nbLinks)/time.Since(t0).Seconds(), "links/s")
+		})
+	}
+}
+
+func BenchmarkBacklinksVWWW(b *testing.B) {
+	pg, groups := setupBenchmark(b)
+	ctx := context.Background()
+	for _, layout := range layouts {
+		for next := 0; next < len(groups); {
+			pages, batch, n := nextBatch(groups, next)
+			next = n
+			err := layout.save(ctx, pg, pages, batch)
+			if err != nil {
+				b.Fatalf("failed to save links: %s", err)
+			}
+		}
+	}
+	reader := &PostgresGraphReader{pg: pg}
+
+	// Random targets, drawn the same way for both layouts
+	target := func() *url.URL {
+		for {
+			group := groups[rand.Intn(len(groups))]
+			if len(group.Links) > 0 {
+				return group.Links[rand.Intn(len(group.Links))].To
+			}
+		}
+	}
+
+	b.Run("layout=text", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rows, err := pg.Query(ctx, `
+				SELECT source, anchor_text, rel, title, position
+				FROM bench_text_links
+				WHERE target = $1
+				ORDER BY source
+				LIMIT 101;
+			`, target().String())
+			if err != nil {
+				b.Fatalf("failed to query backlinks: %s", err)
+			}
+			rows.Close()
+			if rows.Err() != nil {
+				b.Fatalf("failed to query backlinks: %s", rows.Err())
+			}
+		}
+	})
+	b.Run("layout=ids", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := reader.Backlinks(ctx, LinkQuery{URL: target(), Limit: 100})
+			if err != nil {
+				b.Fatalf("failed to query backlinks: %s", err)
+			}
+		}
+	})
+}
@@ -4,8 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/url"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
@@ -13,28 +14,118 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-const BATCH_SIZE = 64
+const (
+	// Maximum number of pages returned by Next, each one from a different host
+	nextMaxHosts = 16
+	// The frontier is refilled from the database when fewer pages are waiting
+	frontierLowWatermark = 1024
+	// New pages and pages due for a revisit considered each time the frontier is refilled
+	claimCandidates = 4096
+	// Maximum number of pages of a host leased at the same time
+	claimPagesPerHost = 8
+	// Maximum number of feeds returned by NextFeeds
+	nextMaxFeeds = 16
+	// Time NextFeeds waits before looking again for due feeds
+	feedsPollWait = 10 * time.Second
+	// Polls in a row that failed before a feed is only polled at the maximum interval
+	maxFeedFailures = 5
+)
+
+// Fresh pages, like the new entries of a feed, are crawled before any other page of
+// their host.
+var freshPriority = math.Inf(1)
+
+// Controller is the frontier and graph store used by the crawler: it decides which pages
+// to visit next and keeps track of the links and visit outcomes the crawler reports.
+type Controller interface {
+	// Seed adds pages to the frontier, pages already known are ignored.
+	Seed(seeds []*url.URL)
+	// Next blocks until some pages are ready to be crawled.
+	Next() []*url.URL
+	// Add saves the links found on a page and adds their targets to the frontier. The
+	// group must hold all the links of the page: the links previously found on it that
+	// are missing from the group are eventually deleted. The feeds of the group are
+	// polled from then on.
+	Add(group *commons.LinkGroup)
+	// Hint adds pages announced by their site, like the urls of a sitemap, to the
+	// frontier. Their priority is taken into account and visited pages modified since
+	// their latest visit are crawled again.
+	Hint(hints []*commons.PageHint)
+	// Report record the outcome of a crawl attempt, it must be called once for every
+	// page returned by Next, whether the crawl succeeded or not.
+	Report(visit *commons.Visit)
+	// Validators returns the validators of the latest successful visit of a page returned
+	// by Next, to make its next visit conditional. They are zero if the page was never
+	// visited or if its responses had none.
+	Validators(page *url.URL) commons.Validators
+	// NextFeeds blocks until some feeds are due to be polled.
+	NextFeeds() []*url.URL
+	// ReportFeed records the outcome of polling a feed, it must be called once for every
+	// feed returned by NextFeeds.
+	ReportFeed(visit *commons.Visit)
+}
 
-type Controller struct {
-	pg       *pgxpool.Pool
-	ctx      context.Context
-	addChan  chan *commons.LinkGroup
-	nextChan chan []*url.URL
+type PostgresController struct {
+	pg            *pgxpool.Pool
+	ctx           context.Context
+	addChan       chan *commons.LinkGroup
+	reportChan    chan *commons.Visit
+	scheduler     *hostScheduler
+	batchSize     int
+	flushInterval time.Duration
+	leaseDuration time.Duration
+	revisit       RevisitPolicy
+	maxMisses     int
+	feedPoll      RevisitPolicy
+	validators    *sync.Map // leasedValidators of the claimed pages, until they are reported
 }
 
-func NewController(ctx context.Context, pgURI string) (*Controller, error) {
-	pg, err := newPostgres(ctx, pgURI)
+// Validators of a claimed page, they are dropped once its lease expires
+type leasedValidators struct {
+	validators commons.Validators
+	expires    time.Time
+}
+
+// NewPostgresController connects to the database and ensures its schema is up to date,
+// either by applying pending migrations (autoMigrate) or by refusing to start. Links and
+// visits are buffered until batchSize rows are available or flushInterval has elapsed.
+// Pages returned by Next are leased for leaseDuration, if they are not reported before
+// the lease expires they are handed out again. Each host is returned at most once every
+// hostDelay. Visited pages are crawled again according to the revisit policy, links
+// missing from maxMisses crawls in a row of their source are deleted (never if 0). Feeds
+// are polled according to the feedPoll policy.
+func NewPostgresController(
+	ctx context.Context,
+	pgURI string,
+	autoMigrate bool,
+	batchSize int,
+	flushInterval time.Duration,
+	leaseDuration time.Duration,
+	hostDelay time.Duration,
+	revisit RevisitPolicy,
+	maxMisses int,
+	feedPoll RevisitPolicy,
+) (*PostgresController, error) {
+	pg, err := openPool(ctx, pgURI, autoMigrate)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init postgres connection pool: %w", err)
+		return nil, err
 	}
 	addChan := make(chan *commons.LinkGroup)
-	nextChan := make(chan []*url.URL, 2048)
+	reportChan := make(chan *commons.Visit)
 
-	c := &Controller{
-		pg:       pg,
-		ctx:      ctx,
-		addChan:  addChan,
-		nextChan: nextChan,
+	c := &PostgresController{
+		pg:            pg,
+		ctx:           ctx,
+		addChan:       addChan,
+		reportChan:    reportChan,
+		scheduler:     newHostScheduler(hostDelay),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		leaseDuration: leaseDuration,
+		revisit:       revisit,
+		maxMisses:     maxMisses,
+		feedPoll:      feedPoll,
+		validators:    &sync.Map{},
 	}
 
 	go c.addSubscriber()
@@ -43,136 +134,354 @@ func NewController(ctx context.Context, pgURI string) (*Controller, error) {
 	return c, nil
 }
 
-func (c *Controller) Add(group *commons.LinkGroup) {
+func (c *PostgresController) Add(group *commons.LinkGroup) {
 	c.addChan <- group
 }
 
-func (c *Controller) Next() []*url.URL {
-	return <-c.nextChan
+func (c *PostgresController) Report(visit *commons.Visit) {
+	c.validators.Delete(visit.URL.String())
+	select {
+	case <-c.ctx.Done():
+	case c.reportChan <- visit:
+	}
+}
+
+func (c *PostgresController) Next() []*url.URL {
+	return c.scheduler.Pop(c.ctx, nextMaxHosts)
+}
+
+func (c *PostgresController) Seed(seeds []*url.URL) {
+	insertSeeds(c.ctx, c.pg, seeds)
+}
+
+func (c *PostgresController) Hint(hints []*commons.PageHint) {
+	saveHints(c.ctx, c.pg, hints)
+}
+
+func (c *PostgresController) Validators(page *url.URL) commons.Validators {
+	v, ok := c.validators.Load(page.String())
+	if !ok || v.(leasedValidators).expires.Before(time.Now()) {
+		return commons.Validators{}
+	}
+	return v.(leasedValidators).validators
+}
+
+func (c *PostgresController) NextFeeds() []*url.URL {
+	for {
+		feeds, err := c.claimFeeds()
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			slog.Error(fmt.Sprintf("error while claiming feeds: %s", err))
+		}
+		if len(feeds) > 0 {
+			return feeds
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return nil
+		case <-time.After(feedsPollWait):
+		}
+	}
+}
+
+func (c *PostgresController) ReportFeed(visit *commons.Visit) {
+	updateFeed(c.ctx, c.pg, visit, c.feedPoll)
+}
+
+// PostgresSeeder adds seeds and hints to the frontier stored in the database without
+// claiming any page, for example to seed it from another process than the crawler.
+type PostgresSeeder struct {
+	pg  *pgxpool.Pool
+	ctx context.Context
+}
+
+func NewPostgresSeeder(ctx context.Context, pgURI string, autoMigrate bool) (*PostgresSeeder, error) {
+	pg, err := openPool(ctx, pgURI, autoMigrate)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresSeeder{pg: pg, ctx: ctx}, nil
+}
+
+func (s *PostgresSeeder) Seed(seeds []*url.URL) {
+	insertSeeds(s.ctx, s.pg, seeds)
 }
 
-func (c *Controller) Seed(seeds []*url.URL) {
-	insertPages(c.ctx, c.pg, seeds)
+func (s *PostgresSeeder) Hint(hints []*commons.PageHint) {
+	saveHints(s.ctx, s.pg, hints)
 }
 
-func (c *Controller) nextProducer() {
+// Keep the scheduler filled with pages claimed from the database. Claimed pages are
+// leased so the scheduler must not hold more than the crawlers can process before the
+// leases expire.
+func (c *PostgresController) nextProducer() {
 	for {
-		query := `
-		WITH random_host as (
+		wait := 100 * time.Millisecond
+		if c.scheduler.Len() < frontierLowWatermark {
+			pages, err := c.claimPages()
+			if c.ctx.Err() != nil {
+				slog.Warn("context canceled in planner, exiting.")
+				return
+			}
+			if err != nil {
+				slog.Error(fmt.Sprintf("error in planner: %s", err))
+			}
+			for _, page := range pages {
+				c.scheduler.PushUntil(page.url, page.priority, page.expires)
+			}
+			c.dropExpiredValidators()
+			if len(pages) > 0 {
+				wait = 0
+			}
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Forget the validators of the pages whose lease expired without a report, for example
+// because the crawler was stopped while fetching them.
+func (c *PostgresController) dropExpiredValidators() {
+	now := time.Now()
+	c.validators.Range(func(key, v any) bool {
+		if v.(leasedValidators).expires.Before(now) {
+			c.validators.CompareAndDelete(key, v)
+		}
+		return true
+	})
+}
+
+// Lease the fresh pages, the new pages with the highest priority and the pages due for a
+// revisit that are the most overdue. To leave room for other hosts, a host can't have
+// more than claimPagesPerHost pages leased at the same time, and pages locked by another
+// crawler are skipped.
+func (c *PostgresController) claimPages() ([]scheduledPage, error) {
+	query := `
+		WITH busy_hosts AS (
 			SELECT host_reversed
-			FROM pages TABLESAMPLE SYSTEM_ROWS(1)
+			FROM pages
+			WHERE lease_expires > NOW()
+			GROUP BY host_reversed
+			HAVING COUNT(*) >= $3
+		),
+		fresh_pages AS (
+			SELECT id, host_reversed, priority, fresh, COALESCE(latest_visit, discovered_at) AS stale_since
+			FROM pages
+			WHERE fresh AND latest_visit IS NULL
+			AND (lease_expires IS NULL OR lease_expires < NOW())
+			AND host_reversed NOT IN (SELECT host_reversed FROM busy_hosts)
+			ORDER BY discovered_at DESC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		),
+		-- The staleness of new pages is not indexed, they are chosen by their stored score
+		new_pages AS (
+			SELECT id, host_reversed, priority, fresh, COALESCE(latest_visit, discovered_at) AS stale_since
+			FROM pages
+			WHERE latest_visit IS NULL
+			AND (lease_expires IS NULL OR lease_expires < NOW())
+			AND host_reversed NOT IN (SELECT host_reversed FROM busy_hosts)
+			ORDER BY priority DESC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		),
+		due_pages AS (
+			SELECT id, host_reversed, priority, fresh, COALESCE(latest_visit, discovered_at) AS stale_since
+			FROM pages
+			WHERE next_visit <= NOW()
+			AND (lease_expires IS NULL OR lease_expires < NOW())
+			AND host_reversed NOT IN (SELECT host_reversed FROM busy_hosts)
+			ORDER BY next_visit
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		),
+		-- Fresh pages are also new pages, UNION removes the duplicates
+		candidates AS (
+			SELECT * FROM fresh_pages
+			UNION
+			SELECT * FROM new_pages
+			UNION
+			SELECT * FROM due_pages
 		),
 		next_pages AS (
 			SELECT id
-			FROM pages, random_host
-			WHERE latest_visit IS NULL
-			AND pages.host_reversed = random_host.host_reversed
-			LIMIT 128
+			FROM (
+				SELECT id, ROW_NUMBER() OVER (
+					PARTITION BY host_reversed
+					ORDER BY fresh DESC, priority + page_staleness(stale_since, LOCALTIMESTAMP) DESC
+				) AS host_rank
+				FROM candidates
+			) AS ranked
+			WHERE host_rank <= $3
 		)
 		UPDATE pages
-		SET latest_visit = NOW()
+		SET claimed_at = NOW(), lease_expires = NOW() + $1 * INTERVAL '1 second'
 		FROM next_pages
 		WHERE pages.id = next_pages.id
-		RETURNING scheme, host_reversed, path;
+		RETURNING
+			scheme, host_reversed, path,
+			priority + page_staleness(COALESCE(latest_visit, discovered_at), LOCALTIMESTAMP),
+			fresh, etag, last_modified;
 	`
 
-		ctx, cancel := context.WithTimeout(c.ctx, time.Second*30)
-		defer cancel()
+	ctx, cancel := context.WithTimeout(c.ctx, time.Second*30)
+	defer cancel()
 
-		rows, err := c.pg.Query(ctx, query)
+	// Pages leave the scheduler a bit before their lease in the database expires, never after
+	expires := time.Now().Add(c.leaseDuration)
+	rows, err := c.pg.Query(ctx, query, c.leaseDuration.Seconds(), claimCandidates, claimPagesPerHost)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get next pages: %w", err)
+	}
+	pages, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (scheduledPage, error) {
+		var scheme string
+		var hostReversed string
+		var path string
+		var fresh bool
+		var etag, lastModified *string
+		page := scheduledPage{}
+		err := row.Scan(&scheme, &hostReversed, &path, &page.priority, &fresh, &etag, &lastModified)
 		if err != nil {
-			if strings.Contains(err.Error(), "context canceled") {
-				slog.Warn("context canceled in planner, exiting.")
-				return
-			}
-			slog.Error(fmt.Sprintf("error in planner: unable to get next pages: %s", err))
-			continue
+			return page, err
 		}
-		defer rows.Close()
-
-		urls, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*url.URL, error) {
-			var scheme string
-			var hostReversed string
-			var path string
-			err := rows.Scan(&scheme, &hostReversed, &path)
-			if err != nil {
-				return nil, err
-			}
-			host := commons.ReverseHostname(hostReversed)
-			return &url.URL{Scheme: scheme, Host: host, Path: path}, nil
-		})
-		if err != nil {
-			slog.Error(fmt.Sprintf("error in planner: unable to scan row: %s", err))
-			continue
+		if fresh {
+			page.priority = freshPriority
+		}
+		host := commons.ReverseHostname(hostReversed)
+		page.url = &url.URL{Scheme: scheme, Host: host, Path: path}
+		validators := commons.Validators{}
+		if etag != nil {
+			validators.ETag = *etag
+		}
+		if lastModified != nil {
+			validators.LastModified = *lastModified
+		}
+		// The page may have been claimed before, its validators may have changed since
+		page.expires = expires
+		if validators.IsZero() {
+			c.validators.Delete(page.url.String())
+		} else {
+			c.validators.Store(page.url.String(), leasedValidators{validators, expires})
 		}
+		return page, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan row: %w", err)
+	}
+	return pages, nil
+}
 
-		// Yield the url or stop if app is shutting down
-		select {
-		case <-c.ctx.Done():
-			close(c.nextChan)
-			return
-		case c.nextChan <- urls:
+// Lease the feeds that are the most overdue
+func (c *PostgresController) claimFeeds() ([]*url.URL, error) {
+	query := `
+		WITH due_feeds AS (
+			SELECT host_reversed, path
+			FROM feeds
+			WHERE next_poll <= NOW()
+			AND (lease_expires IS NULL OR lease_expires < NOW())
+			ORDER BY next_poll
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE feeds
+		SET lease_expires = NOW() + $1 * INTERVAL '1 second'
+		FROM due_feeds
+		WHERE feeds.host_reversed = due_feeds.host_reversed AND feeds.path = due_feeds.path
+		RETURNING feeds.scheme, feeds.host_reversed, feeds.path;
+	`
+
+	ctx, cancel := context.WithTimeout(c.ctx, time.Second*30)
+	defer cancel()
+
+	rows, err := c.pg.Query(ctx, query, c.leaseDuration.Seconds(), nextMaxFeeds)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get next feeds: %w", err)
+	}
+	feeds, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*url.URL, error) {
+		var scheme string
+		var hostReversed string
+		var path string
+		err := row.Scan(&scheme, &hostReversed, &path)
+		if err != nil {
+			return nil, err
 		}
+		return &url.URL{Scheme: scheme, Host: commons.ReverseHostname(hostReversed), Path: path}, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan row: %w", err)
 	}
+	return feeds, nil
 }
 
-// This function listen to addChan and accumulates the new data until we can insert it in bulk
-// If the context propagate a cancel we do a partial insert we what data we have in the buffer
-func (c *Controller) addSubscriber() {
-	var group *commons.LinkGroup
-	links := [BATCH_SIZE]commons.Link{}
-	newPages := [BATCH_SIZE]*url.URL{}
-	visitedPages := [BATCH_SIZE]*url.URL{}
-	i := 0
-	j := 0
-	timeout := time.After(time.Second)
+// This function listen to addChan and reportChan and accumulates the new data until we
+// can insert it in bulk. If the context propagate a cancel we do a partial insert we what
+// data we have in the buffer
+func (c *PostgresController) addSubscriber() {
+	groups := make([]*commons.LinkGroup, 0)
+	newPages := make([]*url.URL, 0, c.batchSize)
+	newFeeds := make([]*url.URL, 0)
+	visits := make([]*commons.Visit, 0, c.batchSize)
+	timeout := time.After(c.flushInterval)
+
+	flushLinks := func() {
+		// Pages first so that links can reference their ids
+		err := insertPages(c.ctx, c.pg, newPages)
+		if err != nil {
+			slog.Error(err.Error())
+		}
+		err = saveLinkGroups(c.ctx, c.pg, groups, c.maxMisses)
+		if err != nil {
+			slog.Error(err.Error())
+		}
+		insertFeeds(c.ctx, c.pg, newFeeds)
+		groups = groups[:0]
+		newPages = newPages[:0]
+		newFeeds = newFeeds[:0]
+	}
+	flushVisits := func() {
+		updatePages(c.ctx, c.pg, visits, c.revisit)
+		visits = visits[:0]
+	}
 
 	for {
 		select {
-		case group = <-c.addChan:
-			from := group.From
-			visitedPages[j] = from
-			j++
-			if j == BATCH_SIZE {
-				updatePages(c.ctx, c.pg, visitedPages[:j])
-				j = 0
+		case visit := <-c.reportChan:
+			visits = append(visits, visit)
+			if len(visits) == c.batchSize {
+				flushVisits()
 			}
 
-			for _, to := range group.To {
-				links[i] = commons.Link{From: from, To: to}
-				newPages[i] = to
-				i++
-
-				if i == BATCH_SIZE {
-					insertLinks(c.ctx, c.pg, links[:i])
-					insertPages(c.ctx, c.pg, newPages[:i])
-					i = 0
-				}
+			timeout = time.After(c.flushInterval)
+		case group := <-c.addChan:
+			// Groups are never split as they are reconciled with the stored links as a
+			// whole, so a batch can get a bit bigger than batchSize
+			groups = append(groups, group)
+			for _, link := range group.Links {
+				newPages = append(newPages, link.To)
+			}
+			newFeeds = append(newFeeds, group.Feeds...)
+			if len(newPages) >= c.batchSize {
+				flushLinks()
 			}
 
-			timeout = time.After(time.Second)
-		// If not enough data come in one second we do a partial bulk insert (this avoid a
-		// deadlock where Next() is starved because there is no new insert and there is
-		// no new insert because Next is starved
+			timeout = time.After(c.flushInterval)
+		// If not enough data come in before the flush interval we do a partial bulk insert
+		// (this avoid a deadlock where Next() is starved because there is no new insert
+		// and there is no new insert because Next is starved
 		case <-timeout:
-			// Insert our partial batch
-			updatePages(c.ctx, c.pg, visitedPages[:j])
-			insertLinks(c.ctx, c.pg, links[:i])
-			insertPages(c.ctx, c.pg, newPages[:i])
-
-			// Reset the current batch
-			i = 0
-			j = 0
-		case <-ctx.Done():
-			// Insert our partial batch
-			updatePages(c.ctx, c.pg, visitedPages[:j])
-			insertLinks(c.ctx, c.pg, links[:i])
-			insertPages(c.ctx, c.pg, newPages[:i])
-
-			// Reset the current batch
-			i = 0
-			j = 0
-			// Stop the goroutine
+			flushVisits()
+			flushLinks()
+		case <-c.ctx.Done():
+			// Insert our partial batch then stop the goroutine
+			flushVisits()
+			flushLinks()
 			return
 		}
 	}
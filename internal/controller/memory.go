@@ -0,0 +1,431 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+// InMemoryController is a Controller that keeps the whole graph in memory. Nothing is
+// persisted so it is only meant for tests and small crawls.
+type InMemoryController struct {
+	ctx       context.Context
+	mu        sync.Mutex
+	pages     map[string]*memoryPage
+	links     map[string]map[string]*memoryLink
+	ids       map[string]int64 // Ids of the pages found in links, in order of discovery
+	hosts     map[string]*memoryHost
+	scheduler *hostScheduler
+	revisit   RevisitPolicy
+	maxMisses int
+	feeds     map[string]*memoryFeed
+	feedQueue *hostScheduler
+	feedPoll  RevisitPolicy
+}
+
+type memoryPage struct {
+	url        *url.URL
+	visit      *commons.Visit
+	inlinks    int
+	depth      int
+	staleSince time.Time     // Time of the discovery, then of the latest visit
+	interval   time.Duration // Time between the two latest visits
+	sitemap    float64       // Priority announced by a sitemap
+	fresh      bool          // Announced by a feed and never visited
+	validators commons.Validators
+}
+
+type memoryFeed struct {
+	url      *url.URL
+	visit    *commons.Visit
+	interval time.Duration // Time between the two latest polls
+	failures int           // Number of polls in a row that failed
+}
+
+type memoryLink struct {
+	commons.Link
+	missed int // Number of crawls in a row of the source that did not find the link
+}
+
+type memoryHost struct {
+	visits    int
+	successes int
+}
+
+// NewInMemoryController creates an empty controller whose Next returns the pages of a
+// host at most once every hostDelay and visited pages again according to the revisit
+// policy. Links missing from maxMisses crawls in a row of their source are deleted (never
+// if 0). Feeds are polled again according to the feedPoll policy. The priority of a page
+// is computed when it is queued and is not updated afterward.
+func NewInMemoryController(
+	ctx context.Context,
+	hostDelay time.Duration,
+	revisit RevisitPolicy,
+	maxMisses int,
+	feedPoll RevisitPolicy,
+) *InMemoryController {
+	return &InMemoryController{
+		ctx:       ctx,
+		pages:     make(map[string]*memoryPage),
+		links:     make(map[string]map[string]*memoryLink),
+		ids:       make(map[string]int64),
+		hosts:     make(map[string]*memoryHost),
+		scheduler: newHostScheduler(hostDelay),
+		revisit:   revisit,
+		maxMisses: maxMisses,
+		feeds:     make(map[string]*memoryFeed),
+		feedQueue: newHostScheduler(0),
+		feedPoll:  feedPoll,
+	}
+}
+
+func (c *InMemoryController) Seed(seeds []*url.URL) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, seed := range seeds {
+		page, isNew := c.insertPage(seed)
+		page.depth = 0
+		if isNew {
+			c.scheduler.Push(page.url, c.priority(page))
+		}
+	}
+}
+
+func (c *InMemoryController) Next() []*url.URL {
+	return c.scheduler.Pop(c.ctx, nextMaxHosts)
+}
+
+func (c *InMemoryController) Add(group *commons.LinkGroup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	from := group.From.String()
+	targets, ok := c.links[from]
+	if !ok {
+		targets = make(map[string]*memoryLink, len(group.Links))
+		c.links[from] = targets
+	}
+	depth := unknownDepth
+	if page, ok := c.pages[from]; ok && page.depth != unknownDepth {
+		depth = page.depth + 1
+	}
+
+	// The group holds all the links of the page, the stored ones it lacks get a miss
+	found := make(map[string]struct{}, len(group.Links))
+	for _, link := range group.Links {
+		found[link.To.String()] = struct{}{}
+	}
+	for to, link := range targets {
+		if _, ok := found[to]; ok {
+			continue
+		}
+		link.missed++
+		if c.maxMisses > 0 && link.missed >= c.maxMisses {
+			delete(targets, to)
+			c.pages[to].inlinks--
+		}
+	}
+
+	c.id(group.From)
+	for _, link := range group.Links {
+		link.From = group.From
+		c.id(link.To)
+		_, known := targets[link.To.String()]
+		targets[link.To.String()] = &memoryLink{Link: link}
+
+		page, isNew := c.insertPage(link.To)
+		if !known {
+			page.inlinks++
+		}
+		if depth != unknownDepth && (page.depth == unknownDepth || depth < page.depth) {
+			page.depth = depth
+		}
+		if isNew {
+			c.scheduler.Push(page.url, c.priority(page))
+		}
+	}
+
+	for _, u := range group.Feeds {
+		if _, ok := c.feeds[u.String()]; ok {
+			continue
+		}
+		c.feeds[u.String()] = &memoryFeed{url: u}
+		c.feedQueue.Push(u, 0)
+	}
+}
+
+// Hint adds the pages to the frontier with the priority of their sitemap. Visited pages
+// that changed since their latest visit are queued again right away, they may then be
+// returned twice by Next when their revisit is due. Fresh pages that were never visited
+// are queued again ahead of the others.
+func (c *InMemoryController) Hint(hints []*commons.PageHint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, hint := range hints {
+		page, isNew := c.insertPage(hint.URL)
+		page.sitemap = hint.Priority
+		changed := page.visit != nil && hint.LastMod.After(page.staleSince)
+		fresh := hint.Fresh && page.visit == nil && !page.fresh
+		if fresh {
+			page.fresh = true
+		}
+		if isNew || changed || fresh {
+			c.scheduler.Push(page.url, c.priority(page))
+		}
+	}
+}
+
+func (c *InMemoryController) Report(visit *commons.Visit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	page, ok := c.pages[visit.URL.String()]
+	if !ok {
+		page = &memoryPage{
+			url:        visit.URL,
+			depth:      unknownDepth,
+			staleSince: time.Now(),
+			sitemap:    defaultSitemapPriority,
+		}
+		c.pages[visit.URL.String()] = page
+	}
+	var previousHash uint64
+	if page.visit != nil {
+		previousHash = page.visit.Hash
+	}
+	// A page that was not modified keeps the content of the previous visit
+	if visit.NotModified && page.visit != nil {
+		merged := *visit
+		merged.Hash = page.visit.Hash
+		merged.ContentType = page.visit.ContentType
+		merged.Size = page.visit.Size
+		visit = &merged
+	}
+	page.visit = visit
+	page.staleSince = time.Now()
+	page.fresh = false
+	page.validators = mergeValidators(page.validators, visit)
+
+	host := c.host(visit.URL.Hostname())
+	host.visits++
+	if visit.Failure == "" {
+		host.successes++
+	}
+
+	page.interval = c.revisit.Interval(page.interval, previousHash, visit.Hash)
+	delay := c.revisit.Delay(page.interval, visit.MaxAge)
+	// The host was overloaded, the page is visited again when it asked us to
+	if visit.Failure == commons.FailureRetryLater {
+		delay = visit.RetryAfter
+	}
+	if delay > 0 {
+		time.AfterFunc(delay, func() { c.requeue(page) })
+	}
+}
+
+// Failed visits keep the validators of the latest successful one, and a page that was
+// not modified keeps those the server did not send again.
+func mergeValidators(previous commons.Validators, visit *commons.Visit) commons.Validators {
+	switch {
+	case visit.Failure != "":
+		return previous
+	case visit.NotModified:
+		return commons.Validators{
+			ETag:         cmp.Or(visit.Validators.ETag, previous.ETag),
+			LastModified: cmp.Or(visit.Validators.LastModified, previous.LastModified),
+		}
+	default:
+		return visit.Validators
+	}
+}
+
+func (c *InMemoryController) Validators(page *url.URL) commons.Validators {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pages[page.String()]
+	if !ok {
+		return commons.Validators{}
+	}
+	return p.validators
+}
+
+func (c *InMemoryController) NextFeeds() []*url.URL {
+	return c.feedQueue.Pop(c.ctx, nextMaxFeeds)
+}
+
+func (c *InMemoryController) ReportFeed(visit *commons.Visit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	feed, ok := c.feeds[visit.URL.String()]
+	if !ok {
+		feed = &memoryFeed{url: visit.URL}
+		c.feeds[visit.URL.String()] = feed
+	}
+	var previousHash uint64
+	if feed.visit != nil {
+		previousHash = feed.visit.Hash
+	}
+	feed.visit = visit
+
+	if visit.Failure == "" {
+		feed.failures = 0
+	} else {
+		feed.failures++
+	}
+
+	feed.interval = c.feedPoll.Interval(feed.interval, previousHash, visit.Hash)
+	if feed.failures >= maxFeedFailures && feed.interval > 0 {
+		feed.interval = c.feedPoll.Max
+	}
+	if feed.interval > 0 {
+		time.AfterFunc(feed.interval, func() {
+			if c.ctx.Err() == nil {
+				c.feedQueue.Push(feed.url, 0)
+			}
+		})
+	}
+}
+
+// Push a visited page back to the scheduler once it is due
+func (c *InMemoryController) requeue(page *memoryPage) {
+	if c.ctx.Err() != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.scheduler.Push(page.url, c.priority(page))
+}
+
+// Visit returns the latest outcome reported for a page.
+func (c *InMemoryController) Visit(page *url.URL) (*commons.Visit, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pages[page.String()]
+	if !ok || p.visit == nil {
+		return nil, false
+	}
+	return p.visit, true
+}
+
+func (c *InMemoryController) Backlinks(ctx context.Context, q LinkQuery) (*LinkPage, error) {
+	c.mu.Lock()
+	links := make([]commons.Link, 0)
+	for _, targets := range c.links {
+		if link, ok := targets[q.URL.String()]; ok {
+			links = append(links, link.Link)
+		}
+	}
+	keys := c.keys(q, links, true)
+	c.mu.Unlock()
+	return paginate(q, links, true, keys)
+}
+
+func (c *InMemoryController) Outlinks(ctx context.Context, q LinkQuery) (*LinkPage, error) {
+	c.mu.Lock()
+	links := make([]commons.Link, 0, len(c.links[q.URL.String()]))
+	for _, link := range c.links[q.URL.String()] {
+		links = append(links, link.Link)
+	}
+	keys := c.keys(q, links, false)
+	c.mu.Unlock()
+	return paginate(q, links, false, keys)
+}
+
+// Keys of the other ends of the links in the order of the query. Must be called with the
+// lock held.
+func (c *InMemoryController) keys(q LinkQuery, links []commons.Link, backlinks bool) map[*url.URL]linkKey {
+	keys := make(map[*url.URL]linkKey, len(links))
+	for _, link := range links {
+		other := otherEnd(link, backlinks)
+		keys[other] = q.key(c.ids[other.String()], other)
+	}
+	return keys
+}
+
+// Apply the order, filters and cursor of the query to the links
+func paginate(q LinkQuery, links []commons.Link, backlinks bool, keys map[*url.URL]linkKey) (*LinkPage, error) {
+	after, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(links, func(a, b commons.Link) int {
+		otherA, otherB := otherEnd(a, backlinks), otherEnd(b, backlinks)
+		// Within a host, pages are in the same order as for the other sorts
+		return cmp.Or(keys[otherA].compare(keys[otherB]), cmp.Compare(otherA.Path, otherB.Path))
+	})
+	selected := make([]commons.Link, 0, min(len(links), q.Limit+1))
+	selectedKeys := make([]linkKey, 0, min(len(links), q.Limit+1))
+	for _, link := range links {
+		key := keys[otherEnd(link, backlinks)]
+		if key.compare(after) <= 0 || link.HasRel(q.ExcludeRel...) {
+			continue
+		}
+		if q.DistinctHosts && len(selectedKeys) > 0 && selectedKeys[len(selectedKeys)-1] == key {
+			continue
+		}
+		selected = append(selected, link)
+		selectedKeys = append(selectedKeys, key)
+		if len(selected) > q.Limit {
+			break
+		}
+	}
+	return newLinkPage(q, selected, selectedKeys), nil
+}
+
+// Return the page, creating it if it is new. New pages must be pushed to the scheduler
+// once their stats are set. Must be called with the lock held.
+func (c *InMemoryController) insertPage(u *url.URL) (*memoryPage, bool) {
+	key := u.String()
+	if page, ok := c.pages[key]; ok {
+		return page, false
+	}
+	page := &memoryPage{url: u, depth: unknownDepth, staleSince: time.Now(), sitemap: defaultSitemapPriority}
+	c.pages[key] = page
+	return page, true
+}
+
+// Return the id of the page, assigning the next one if it is new. Must be called with the
+// lock held.
+func (c *InMemoryController) id(u *url.URL) int64 {
+	key := u.String()
+	id, ok := c.ids[key]
+	if !ok {
+		id = int64(len(c.ids) + 1)
+		c.ids[key] = id
+	}
+	return id
+}
+
+// Must be called with the lock held
+func (c *InMemoryController) host(hostname string) *memoryHost {
+	host, ok := c.hosts[hostname]
+	if !ok {
+		host = &memoryHost{}
+		c.hosts[hostname] = host
+	}
+	return host
+}
+
+// Must be called with the lock held
+func (c *InMemoryController) priority(page *memoryPage) float64 {
+	if page.fresh {
+		return freshPriority
+	}
+	host := c.host(page.url.Hostname())
+	return priority(pageStats{
+		Inlinks:         page.inlinks,
+		Depth:           page.depth,
+		HostVisits:      host.visits,
+		HostSuccesses:   host.successes,
+		StaleSince:      page.staleSince,
+		SitemapPriority: page.sitemap,
+	}, time.Now())
+}
@@ -0,0 +1,430 @@
+package controller
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("invalid test url %s: %s", rawURL, err)
+	}
+	return u
+}
+
+func TestInMemorySeedAndNext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	a := mustParse(t, "http://test.com/a")
+	b := mustParse(t, "http://test.com/b")
+	c.Seed([]*url.URL{a, b, mustParse(t, "http://test.com/a")})
+
+	urls := c.Next()
+	if len(urls) != 2 {
+		t.Fatalf("bad number of pages: want 2; got %d", len(urls))
+	}
+	if urls[0].String() != a.String() || urls[1].String() != b.String() {
+		t.Fatalf("pages are not returned in seed order: got %s", urls)
+	}
+}
+
+func TestInMemoryAddQueueNewPagesOnly(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	from := mustParse(t, "http://test.com")
+	c.Seed([]*url.URL{from})
+	c.Next()
+
+	c.Add(&commons.LinkGroup{From: from, Links: []commons.Link{
+		{To: from},
+		{To: mustParse(t, "http://other.com/page")},
+	}})
+
+	urls := c.Next()
+	if len(urls) != 1 || urls[0].String() != "http://other.com/page" {
+		t.Fatalf("only the new page should be queued: got %s", urls)
+	}
+
+	outlinks, err := c.Outlinks(ctx, LinkQuery{URL: from, Limit: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got := make([]string, 0, len(outlinks.Links))
+	for _, link := range outlinks.Links {
+		got = append(got, link.To.String())
+	}
+	// In order of discovery, the source was found first
+	if !slices.Equal(got, []string{"http://test.com", "http://other.com/page"}) {
+		t.Fatalf("bad outlinks: got %s", got)
+	}
+}
+
+func TestInMemoryReport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	page := mustParse(t, "http://test.com")
+	if _, ok := c.Visit(page); ok {
+		t.Fatal("unvisited page should not have a visit")
+	}
+
+	c.Report(&commons.Visit{URL: page, Status: 404, Failure: commons.FailureBadStatus})
+	visit, ok := c.Visit(page)
+	if !ok {
+		t.Fatal("reported visit was not saved")
+	}
+	if visit.Status != 404 || visit.Failure != commons.FailureBadStatus {
+		t.Fatalf("bad visit: got status %d and failure %s", visit.Status, visit.Failure)
+	}
+}
+
+func TestInMemoryNextWaitForPages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	result := make(chan []*url.URL)
+	go func() { result <- c.Next() }()
+
+	select {
+	case urls := <-result:
+		t.Fatalf("Next should block on an empty frontier: got %s", urls)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	c.Seed([]*url.URL{mustParse(t, "http://test.com")})
+	select {
+	case urls := <-result:
+		if len(urls) != 1 {
+			t.Fatalf("bad number of pages: want 1; got %d", len(urls))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next was not woken up by Seed")
+	}
+}
+
+func TestInMemoryNextStopOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	result := make(chan []*url.URL)
+	go func() { result <- c.Next() }()
+	cancel()
+
+	select {
+	case urls := <-result:
+		if urls != nil {
+			t.Fatalf("Next should return nil once canceled: got %s", urls)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Next was not stopped by the context")
+	}
+}
+
+func TestInMemoryBacklinksSortAndDistinctHosts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	target := mustParse(t, "http://target.com")
+	for _, from := range []string{"http://b.com/1", "https://a.com/2", "http://a.com/1", "http://b.com/2"} {
+		c.Add(&commons.LinkGroup{From: mustParse(t, from), Links: []commons.Link{{To: target}}})
+	}
+
+	tests := map[string]struct {
+		query  LinkQuery
+		expect []string
+	}{
+		"by id": {
+			query:  LinkQuery{URL: target, Limit: 10},
+			expect: []string{"http://b.com/1", "https://a.com/2", "http://a.com/1", "http://b.com/2"},
+		},
+		"by host": {
+			query:  LinkQuery{URL: target, Limit: 10, Sort: SortByHost},
+			expect: []string{"http://a.com/1", "https://a.com/2", "http://b.com/1", "http://b.com/2"},
+		},
+		"distinct hosts": {
+			query:  LinkQuery{URL: target, Limit: 10, DistinctHosts: true},
+			expect: []string{"http://a.com/1", "http://b.com/1"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Go through the pages one link at a time to also exercise the cursors
+			got := make([]string, 0)
+			q := test.query
+			q.Limit = 1
+			for {
+				page, err := c.Backlinks(ctx, q)
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				for _, link := range page.Links {
+					got = append(got, link.From.String())
+				}
+				if page.Next == "" {
+					break
+				}
+				q.Cursor = page.Next
+			}
+			if !slices.Equal(got, test.expect) {
+				t.Fatalf("bad backlinks: want %s; got %s", test.expect, got)
+			}
+		})
+	}
+}
+
+func TestInMemoryNextByPriority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	seed := mustParse(t, "http://test.com")
+	c.Seed([]*url.URL{seed})
+	c.Next()
+
+	// The page linked from the seed is discovered last but it is closer to a seed
+	other := mustParse(t, "http://test.com/other")
+	popular := mustParse(t, "http://test.com/popular")
+	c.Add(&commons.LinkGroup{From: other, Links: []commons.Link{{To: popular}}})
+	c.Add(&commons.LinkGroup{From: seed, Links: []commons.Link{{To: other}}})
+	c.Add(&commons.LinkGroup{From: mustParse(t, "http://elsewhere.com"), Links: []commons.Link{{To: popular}}})
+
+	c.mu.Lock()
+	popularPage, otherPage := c.pages[popular.String()], c.pages[other.String()]
+	c.mu.Unlock()
+	if popularPage.inlinks != 2 || otherPage.depth != 1 {
+		t.Fatalf("bad stats: got %d inlinks and depth %d", popularPage.inlinks, otherPage.depth)
+	}
+
+	urls := c.Next()
+	if len(urls) == 0 || urls[0].String() != other.String() {
+		t.Fatalf("the page closest to a seed should come first: got %s", urls)
+	}
+}
+
+func TestInMemoryRevisit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond}, 0, RevisitPolicy{})
+
+	page := mustParse(t, "http://test.com")
+	c.Seed([]*url.URL{page})
+	c.Next()
+	c.Report(&commons.Visit{URL: page, Status: 200, Hash: 1})
+
+	result := make(chan []*url.URL)
+	go func() { result <- c.Next() }()
+	select {
+	case urls := <-result:
+		if len(urls) != 1 || urls[0].String() != page.String() {
+			t.Fatalf("the visited page should be queued again: got %s", urls)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the visited page was not queued again")
+	}
+}
+
+func TestInMemoryRetryLater(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Without revisits the page is only visited again because the host asked for it
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	page := mustParse(t, "http://test.com")
+	c.Seed([]*url.URL{page})
+	c.Next()
+	c.Report(&commons.Visit{URL: page, Status: 429, Failure: commons.FailureRetryLater, RetryAfter: 10 * time.Millisecond})
+
+	result := make(chan []*url.URL)
+	go func() { result <- c.Next() }()
+	select {
+	case urls := <-result:
+		if len(urls) != 1 || urls[0].String() != page.String() {
+			t.Fatalf("the page should be queued again: got %s", urls)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the page was not queued again after the Retry-After delay")
+	}
+}
+
+func TestInMemoryExpireMissingLinks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 2, RevisitPolicy{})
+
+	from := mustParse(t, "http://test.com")
+	kept := mustParse(t, "http://test.com/kept")
+	removed := mustParse(t, "http://test.com/removed")
+	c.Add(&commons.LinkGroup{From: from, Links: []commons.Link{{From: from, To: kept}, {From: from, To: removed}}})
+
+	c.Add(&commons.LinkGroup{From: from, Links: []commons.Link{{From: from, To: kept}}})
+	outlinks, err := c.Outlinks(ctx, LinkQuery{URL: from, Limit: 10})
+	if err != nil || len(outlinks.Links) != 2 {
+		t.Fatalf("a link missing once should be kept: got %v, %v", outlinks, err)
+	}
+
+	c.Add(&commons.LinkGroup{From: from, Links: []commons.Link{{From: from, To: kept}}})
+	outlinks, err = c.Outlinks(ctx, LinkQuery{URL: from, Limit: 10})
+	if err != nil || len(outlinks.Links) != 1 || outlinks.Links[0].To.String() != kept.String() {
+		t.Fatalf("a link missing twice should be deleted: got %v, %v", outlinks, err)
+	}
+	c.mu.Lock()
+	inlinks := c.pages[removed.String()].inlinks
+	c.mu.Unlock()
+	if inlinks != 0 {
+		t.Fatalf("bad inlinks of the removed target: want 0; got %d", inlinks)
+	}
+}
+
+func TestInMemoryHint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	low := mustParse(t, "http://test.com/low")
+	high := mustParse(t, "http://test.com/high")
+	c.Hint([]*commons.PageHint{{URL: low, Priority: 0.1}, {URL: high, Priority: 0.9}})
+	urls := c.Next()
+	if len(urls) != 2 || urls[0].String() != high.String() {
+		t.Fatalf("the page with the highest sitemap priority should come first: got %s", urls)
+	}
+
+	c.Report(&commons.Visit{URL: high, Status: 200})
+	c.Hint([]*commons.PageHint{{URL: high, Priority: 0.9, LastMod: time.Now().Add(-time.Hour)}})
+	c.Hint([]*commons.PageHint{{URL: low, Priority: 0.1, LastMod: time.Now().Add(time.Hour)}})
+	if c.scheduler.Len() != 0 {
+		t.Fatal("pages that were not visited or not modified should not be queued again")
+	}
+	c.Report(&commons.Visit{URL: low, Status: 200})
+	c.Hint([]*commons.PageHint{{URL: low, Priority: 0.1, LastMod: time.Now().Add(time.Hour)}})
+	urls = c.Next()
+	if len(urls) != 1 || urls[0].String() != low.String() {
+		t.Fatalf("the modified page should be queued again: got %s", urls)
+	}
+}
+
+func TestInMemoryFeeds(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{Min: 10 * time.Millisecond, Max: 10 * time.Millisecond})
+
+	page := mustParse(t, "http://test.com")
+	feed := mustParse(t, "http://test.com/feed.xml")
+	c.Add(&commons.LinkGroup{From: page, Feeds: []*url.URL{feed}})
+	c.Add(&commons.LinkGroup{From: page, Feeds: []*url.URL{feed}})
+	urls := c.NextFeeds()
+	if len(urls) != 1 || urls[0].String() != feed.String() {
+		t.Fatalf("the feed should be polled once: got %s", urls)
+	}
+
+	c.ReportFeed(&commons.Visit{URL: feed, Status: 200, Hash: 1})
+	result := make(chan []*url.URL)
+	go func() { result <- c.NextFeeds() }()
+	select {
+	case urls := <-result:
+		if len(urls) != 1 || urls[0].String() != feed.String() {
+			t.Fatalf("the polled feed should be queued again: got %s", urls)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the polled feed was not queued again")
+	}
+}
+
+func TestInMemoryFeedFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	poll := RevisitPolicy{Min: time.Hour, Max: 24 * time.Hour}
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, poll)
+
+	feed := mustParse(t, "http://test.com/feed.xml")
+	c.Add(&commons.LinkGroup{From: mustParse(t, "http://test.com"), Feeds: []*url.URL{feed}})
+	for i := 0; i < maxFeedFailures-1; i++ {
+		c.ReportFeed(&commons.Visit{URL: feed, Failure: commons.FailureParseError})
+	}
+	c.mu.Lock()
+	interval := c.feeds[feed.String()].interval
+	c.mu.Unlock()
+	if interval >= poll.Max {
+		t.Fatalf("a few failures should keep the interval: got %s", interval)
+	}
+
+	c.ReportFeed(&commons.Visit{URL: feed, Failure: commons.FailureNetworkError})
+	c.mu.Lock()
+	interval = c.feeds[feed.String()].interval
+	c.mu.Unlock()
+	if interval != poll.Max {
+		t.Fatalf("a feed that keeps failing should be polled at the maximum interval: got %s", interval)
+	}
+
+	c.ReportFeed(&commons.Visit{URL: feed, Status: 200, Hash: 1})
+	c.mu.Lock()
+	failures := c.feeds[feed.String()].failures
+	c.mu.Unlock()
+	if failures != 0 {
+		t.Fatalf("a successful poll should reset the failures: got %d", failures)
+	}
+}
+
+func TestInMemoryFreshFirst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	seed := mustParse(t, "http://test.com")
+	fresh := mustParse(t, "http://test.com/fresh")
+	c.Seed([]*url.URL{seed})
+	c.Add(&commons.LinkGroup{From: mustParse(t, "http://other.com"), Links: []commons.Link{{To: fresh}}})
+	c.Hint([]*commons.PageHint{{URL: fresh, Priority: 0.5, Fresh: true}})
+	urls := c.Next()
+	if len(urls) == 0 || urls[0].String() != fresh.String() {
+		t.Fatalf("the fresh page should come first: got %s", urls)
+	}
+
+	c.Report(&commons.Visit{URL: fresh, Status: 200})
+	c.mu.Lock()
+	isFresh := c.pages[fresh.String()].fresh
+	c.mu.Unlock()
+	if isFresh {
+		t.Fatal("a visited page should not be fresh anymore")
+	}
+}
+
+func TestInMemoryValidators(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewInMemoryController(ctx, 0, RevisitPolicy{}, 0, RevisitPolicy{})
+
+	page := mustParse(t, "http://test.com")
+	validators := commons.Validators{ETag: `"v1"`, LastModified: "Fri, 01 Mar 2024 10:30:00 GMT"}
+	c.Report(&commons.Visit{URL: page, Status: 200, Hash: 1, Validators: validators})
+
+	c.Report(&commons.Visit{URL: page, Failure: commons.FailureNetworkError})
+	if got := c.Validators(page); got != validators {
+		t.Fatalf("a failed visit should keep the validators: got %+v", got)
+	}
+
+	c.Report(&commons.Visit{URL: page, Status: 304, NotModified: true, Validators: commons.Validators{ETag: `"v2"`}})
+	expected := commons.Validators{ETag: `"v2"`, LastModified: validators.LastModified}
+	if got := c.Validators(page); got != expected {
+		t.Fatalf("bad validators after a 304: want %+v; got %+v", expected, got)
+	}
+
+	c.Report(&commons.Visit{URL: page, Status: 200, Hash: 2})
+	if got := c.Validators(page); !got.IsZero() {
+		t.Fatalf("a response without validators should clear them: got %+v", got)
+	}
+}
@@ -0,0 +1,263 @@
+package controller
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Migrations are numbered SQL files named NNNN_name.up.sql and NNNN_name.down.sql. The
+// version of a database is the highest migration recorded in schema_migrations.
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// Arbitrary key used with pg_advisory_xact_lock so that two processes starting at the
+// same time do not apply the same migration twice.
+const migrationLockKey = 0x6261636b6c696e6b
+
+var migrationFilename = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+var (
+	ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+	// Another process migrated the database between our status check and our transaction
+	errConcurrentMigration = errors.New("database version changed concurrently")
+)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus describes the schema version of a database compared to the migrations
+// this binary knows about.
+type MigrationStatus struct {
+	Current int
+	Latest  int
+}
+
+func (s MigrationStatus) Pending() int {
+	return max(s.Latest-s.Current, 0)
+}
+
+type Migrator struct {
+	pg         *pgxpool.Pool
+	migrations []migration
+}
+
+func NewMigrator(ctx context.Context, pgURI string) (*Migrator, error) {
+	pg, err := newPostgres(ctx, pgURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init postgres connection pool: %w", err)
+	}
+	return newMigrator(pg)
+}
+
+func newMigrator(pg *pgxpool.Pool) (*Migrator, error) {
+	migrations, err := loadMigrations(migrationsFS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load migrations: %w", err)
+	}
+	return &Migrator{pg: pg, migrations: migrations}, nil
+}
+
+// Up applies every pending migration, each one in its own transaction.
+func (m *Migrator) Up(ctx context.Context) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, mig := range m.migrations[status.Current:] {
+		err := m.apply(ctx, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, mig.up)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx,
+				"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+				mig.version, mig.name,
+			)
+			return err
+		}, mig.version-1)
+		if errors.Is(err, errConcurrentMigration) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %04d_%s: %w", mig.version, mig.name, err)
+		}
+		slog.Info(fmt.Sprintf("applied migration %04d_%s", mig.version, mig.name))
+	}
+	return nil
+}
+
+// Down reverts the n latest applied migrations.
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for i := status.Current; i > max(status.Current-n, 0); i-- {
+		mig := m.migrations[i-1]
+		err := m.apply(ctx, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, mig.down)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, "DELETE FROM schema_migrations WHERE version = $1", mig.version)
+			return err
+		}, mig.version)
+		if err != nil {
+			return fmt.Errorf("failed to revert migration %04d_%s: %w", mig.version, mig.name, err)
+		}
+		slog.Info(fmt.Sprintf("reverted migration %04d_%s", mig.version, mig.name))
+	}
+	return nil
+}
+
+// Status returns the current version of the database. It fails with ErrSchemaTooNew if
+// the database was migrated by a more recent binary.
+func (m *Migrator) Status(ctx context.Context) (MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	status := MigrationStatus{Latest: len(m.migrations)}
+	err := m.ensureTrackingTable(ctx)
+	if err != nil {
+		return status, err
+	}
+	status.Current, err = currentVersion(ctx, m.pg)
+	if err != nil {
+		return status, err
+	}
+	if status.Current > status.Latest {
+		return status, fmt.Errorf("%w: version %d, latest known is %d", ErrSchemaTooNew, status.Current, status.Latest)
+	}
+	return status, nil
+}
+
+// Check fails if the database is not exactly at the version this binary expects.
+func (m *Migrator) Check(ctx context.Context) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Pending() > 0 {
+		return fmt.Errorf("database schema is at version %d, %d migrations are pending", status.Current, status.Pending())
+	}
+	return nil
+}
+
+// Run fn in a transaction holding the migration lock, after verifying that no other
+// process changed the version in the meantime.
+func (m *Migrator) apply(ctx context.Context, fn func(pgx.Tx) error, expectedVersion int) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*30)
+	defer cancel()
+
+	return pgx.BeginFunc(ctx, m.pg, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockKey)
+		if err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %w", err)
+		}
+		version, err := currentVersion(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if version != expectedVersion {
+			return fmt.Errorf("%w: want %d; got %d", errConcurrentMigration, expectedVersion, version)
+		}
+		return fn(tx)
+	})
+}
+
+func (m *Migrator) ensureTrackingTable(ctx context.Context) error {
+	_, err := m.pg.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version		integer PRIMARY KEY,
+			name		text NOT NULL,
+			applied_at	timestamp NOT NULL DEFAULT NOW()
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+	return nil
+}
+
+// Implemented by both the pool and transactions
+type queryRower interface {
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
+func currentVersion(ctx context.Context, db queryRower) (int, error) {
+	var version int
+	err := db.QueryRow(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// Read all migrations from fsys and ensure they are numbered from 1 without gaps and
+// that each one can be reverted.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*migration)
+	for _, entry := range entries {
+		match := migrationFilename.FindStringSubmatch(path.Base(entry))
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration filename: %s", entry)
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, entry)
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{version: version, name: match[2]}
+			byVersion[version] = mig
+		}
+		if mig.name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.name, match[2])
+		}
+		if match[3] == "up" {
+			mig.up = string(content)
+		} else {
+			mig.down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		migrations = append(migrations, *mig)
+	}
+	slices.SortFunc(migrations, func(a, b migration) int { return a.version - b.version })
+
+	for i, mig := range migrations {
+		if mig.version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+		if mig.up == "" || mig.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s must have both an up and a down file", mig.version, mig.name)
+		}
+	}
+	return migrations, nil
+}
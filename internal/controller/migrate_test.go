@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationsFS)
+	if err != nil {
+		t.Fatalf("embedded migrations are invalid: %s", err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migration embedded")
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0002_second.up.sql":   {Data: []byte("up 2")},
+		"migrations/0002_second.down.sql": {Data: []byte("down 2")},
+		"migrations/0001_first.up.sql":    {Data: []byte("up 1")},
+		"migrations/0001_first.down.sql":  {Data: []byte("down 1")},
+	}
+
+	migrations, err := loadMigrations(fsys)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(migrations) != 2 {
+		t.Fatalf("bad number of migrations: want 2; got %d", len(migrations))
+	}
+	first, second := migrations[0], migrations[1]
+	if first.version != 1 || first.name != "first" || first.up != "up 1" || first.down != "down 1" {
+		t.Fatalf("bad first migration: %+v", first)
+	}
+	if second.version != 2 || second.name != "second" || second.up != "up 2" || second.down != "down 2" {
+		t.Fatalf("bad second migration: %+v", second)
+	}
+}
+
+func TestLoadMigrationsInvalid(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"bad filename": {
+			"migrations/first.up.sql": {Data: []byte("up")},
+		},
+		"missing down": {
+			"migrations/0001_first.up.sql": {Data: []byte("up")},
+		},
+		"gap in versions": {
+			"migrations/0001_first.up.sql":   {Data: []byte("up 1")},
+			"migrations/0001_first.down.sql": {Data: []byte("down 1")},
+			"migrations/0003_third.up.sql":   {Data: []byte("up 3")},
+			"migrations/0003_third.down.sql": {Data: []byte("down 3")},
+		},
+		"conflicting names": {
+			"migrations/0001_first.up.sql":   {Data: []byte("up 1")},
+			"migrations/0001_other.down.sql": {Data: []byte("down 1")},
+		},
+	}
+
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := loadMigrations(fsys)
+			if err == nil {
+				t.Fatal("invalid migrations should be rejected")
+			}
+		})
+	}
+}
+
+func TestMigrationStatusPending(t *testing.T) {
+	if got := (MigrationStatus{Current: 1, Latest: 3}).Pending(); got != 2 {
+		t.Fatalf("bad number of pending migrations: want 2; got %d", got)
+	}
+	if got := (MigrationStatus{Current: 4, Latest: 3}).Pending(); got != 0 {
+		t.Fatalf("bad number of pending migrations: want 0; got %d", got)
+	}
+}
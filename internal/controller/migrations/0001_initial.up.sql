@@ -0,0 +1,25 @@
+-- Written with IF NOT EXISTS so that databases created before migrations existed are
+-- adopted as is.
+CREATE TABLE IF NOT EXISTS host (
+	host_reversed	text PRIMARY KEY,
+	robot			text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS pages (
+	id 				uuid DEFAULT gen_random_uuid(),
+	scheme			text NOT NULL,
+	host_reversed	text NOT NULL,
+	path 			text NOT NULL,
+	latest_visit 	timestamp,
+
+	PRIMARY KEY(host_reversed, path)
+);
+
+CREATE TABLE IF NOT EXISTS links (
+	source	text,
+	target	text,
+
+	PRIMARY KEY (source, target)
+);
+
+CREATE EXTENSION IF NOT EXISTS tsm_system_rows;
@@ -0,0 +1,6 @@
+ALTER TABLE pages DROP COLUMN IF EXISTS status_code;
+ALTER TABLE pages DROP COLUMN IF EXISTS content_type;
+ALTER TABLE pages DROP COLUMN IF EXISTS content_length;
+ALTER TABLE pages DROP COLUMN IF EXISTS fetch_duration_ms;
+ALTER TABLE pages DROP COLUMN IF EXISTS content_hash;
+ALTER TABLE pages DROP COLUMN IF EXISTS failure;
@@ -0,0 +1,6 @@
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS status_code smallint;
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS content_type text;
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS content_length bigint;
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS fetch_duration_ms integer;
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS content_hash bigint;
+ALTER TABLE pages ADD COLUMN IF NOT EXISTS failure text;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS links_target_source;
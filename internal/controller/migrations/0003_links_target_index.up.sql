@@ -0,0 +1,2 @@
+-- Backlinks are looked up by target, the primary key only helps for outlinks
+CREATE INDEX IF NOT EXISTS links_target_source ON links (target, source);
@@ -0,0 +1,4 @@
+ALTER TABLE links DROP COLUMN anchor_text;
+ALTER TABLE links DROP COLUMN rel;
+ALTER TABLE links DROP COLUMN title;
+ALTER TABLE links DROP COLUMN position;
@@ -0,0 +1,4 @@
+ALTER TABLE links ADD COLUMN anchor_text text;
+ALTER TABLE links ADD COLUMN rel text[];
+ALTER TABLE links ADD COLUMN title text;
+ALTER TABLE links ADD COLUMN position integer;
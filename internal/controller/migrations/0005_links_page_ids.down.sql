@@ -0,0 +1,33 @@
+CREATE TABLE links_by_url (
+	source		text,
+	target		text,
+	anchor_text	text,
+	rel			text[],
+	title		text,
+	position	integer,
+
+	PRIMARY KEY (source, target)
+);
+
+INSERT INTO links_by_url (source, target, anchor_text, rel, title, position)
+SELECT
+	source_page.scheme || '://' || reverse_hostname(source_page.host_reversed) || source_page.path,
+	target_page.scheme || '://' || reverse_hostname(target_page.host_reversed) || target_page.path,
+	links.anchor_text,
+	links.rel,
+	links.title,
+	links.position
+FROM links
+JOIN pages AS source_page ON source_page.id = links.source_id
+JOIN pages AS target_page ON target_page.id = links.target_id
+ON CONFLICT DO NOTHING;
+
+DROP TABLE links;
+ALTER TABLE links_by_url RENAME TO links;
+ALTER INDEX links_by_url_pkey RENAME TO links_pkey;
+CREATE INDEX links_target_source ON links (target, source);
+
+ALTER TABLE pages DROP COLUMN id;
+ALTER TABLE pages ADD COLUMN id uuid DEFAULT gen_random_uuid();
+
+DROP FUNCTION reverse_hostname(text);
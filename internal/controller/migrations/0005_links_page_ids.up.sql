@@ -0,0 +1,60 @@
+-- Links reference pages by integer ids instead of storing both urls as text. The ids
+-- are not declared as foreign keys to keep bulk inserts cheap.
+
+CREATE OR REPLACE FUNCTION reverse_hostname(hostname text) RETURNS text AS $$
+	SELECT string_agg(label, '.' ORDER BY n DESC)
+	FROM unnest(string_to_array(hostname, '.')) WITH ORDINALITY AS labels(label, n)
+$$ LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE;
+
+ALTER TABLE pages DROP COLUMN id;
+ALTER TABLE pages ADD COLUMN id bigint GENERATED BY DEFAULT AS IDENTITY;
+ALTER TABLE pages ADD CONSTRAINT pages_id_key UNIQUE (id);
+
+-- Split every url referenced by a link the same way the crawler does
+CREATE TEMPORARY TABLE link_urls ON COMMIT DROP AS
+SELECT
+	url,
+	split_part(url, '://', 1) AS scheme,
+	reverse_hostname(split_part(split_part(url, '://', 2), '/', 1)) AS host_reversed,
+	substring(
+		split_part(url, '://', 2)
+		FROM length(split_part(split_part(url, '://', 2), '/', 1)) + 1
+	) AS path
+FROM (
+	SELECT source AS url FROM links
+	UNION
+	SELECT target AS url FROM links
+) AS urls;
+
+INSERT INTO pages (scheme, host_reversed, path)
+SELECT scheme, host_reversed, path FROM link_urls
+ON CONFLICT DO NOTHING;
+
+CREATE TABLE links_by_id (
+	source_id	bigint NOT NULL,
+	target_id	bigint NOT NULL,
+	anchor_text	text,
+	rel			text[],
+	title		text,
+	position	integer,
+
+	PRIMARY KEY (target_id, source_id)
+);
+
+INSERT INTO links_by_id (source_id, target_id, anchor_text, rel, title, position)
+SELECT source_page.id, target_page.id, links.anchor_text, links.rel, links.title, links.position
+FROM links
+JOIN link_urls AS source_url ON source_url.url = links.source
+JOIN pages AS source_page
+	ON source_page.host_reversed = source_url.host_reversed AND source_page.path = source_url.path
+JOIN link_urls AS target_url ON target_url.url = links.target
+JOIN pages AS target_page
+	ON target_page.host_reversed = target_url.host_reversed AND target_page.path = target_url.path
+ON CONFLICT DO NOTHING;
+
+DROP TABLE links;
+ALTER TABLE links_by_id RENAME TO links;
+ALTER INDEX links_by_id_pkey RENAME TO links_pkey;
+
+-- Backlinks use the primary key, outlinks this index
+CREATE INDEX links_source_target ON links (source_id, target_id);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS visits_staging;
+DROP TABLE IF EXISTS links_staging;
+DROP TABLE IF EXISTS pages_staging;
@@ -0,0 +1,30 @@
+-- Bulk inserts are copied into these tables then merged into pages and links within the
+-- same transaction, so they are always empty once committed and don't need the WAL.
+
+CREATE UNLOGGED TABLE IF NOT EXISTS pages_staging (
+	scheme			text NOT NULL,
+	host_reversed	text NOT NULL,
+	path			text NOT NULL
+);
+
+CREATE UNLOGGED TABLE IF NOT EXISTS links_staging (
+	source_host		text NOT NULL,
+	source_path		text NOT NULL,
+	target_host		text NOT NULL,
+	target_path		text NOT NULL,
+	anchor_text		text,
+	rel				text[],
+	title			text,
+	position		integer
+);
+
+CREATE UNLOGGED TABLE IF NOT EXISTS visits_staging (
+	host_reversed		text NOT NULL,
+	path				text NOT NULL,
+	status_code			smallint,
+	content_type		text,
+	content_length		bigint,
+	fetch_duration_ms	integer,
+	content_hash		bigint,
+	failure				text
+);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS pages_frontier;
+
+-- Claimed pages are considered visited, as they were before leases existed
+UPDATE pages SET latest_visit = claimed_at
+WHERE latest_visit IS NULL AND claimed_at IS NOT NULL;
+
+ALTER TABLE pages DROP COLUMN lease_expires;
+ALTER TABLE pages DROP COLUMN claimed_at;
@@ -0,0 +1,14 @@
+-- Pages handed out to a crawler are leased instead of being marked as visited, so that
+-- they are crawled again by someone else if the lease expires without a report.
+ALTER TABLE pages ADD COLUMN claimed_at timestamp;
+ALTER TABLE pages ADD COLUMN lease_expires timestamp;
+
+-- Before leases, latest_visit was set when a page was handed out. Pages that were never
+-- reported (no status nor failure) were lost by a crawler and go back to the frontier.
+-- Only the pages handed out since 0002_fetch_outcomes can be told apart: before it no
+-- outcome was saved at all, resetting those would recrawl every visited page.
+UPDATE pages SET latest_visit = NULL
+WHERE latest_visit IS NOT NULL AND status_code IS NULL AND failure IS NULL
+AND latest_visit > (SELECT applied_at FROM schema_migrations WHERE version = 2);
+
+CREATE INDEX pages_frontier ON pages (host_reversed, lease_expires) WHERE latest_visit IS NULL;
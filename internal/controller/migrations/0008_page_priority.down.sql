@@ -0,0 +1,16 @@
+DROP INDEX IF EXISTS pages_leased;
+DROP INDEX IF EXISTS pages_frontier_priority;
+CREATE INDEX pages_frontier ON pages (host_reversed, lease_expires) WHERE latest_visit IS NULL;
+
+ALTER TABLE pages DROP COLUMN priority;
+ALTER TABLE pages DROP COLUMN inlinks;
+ALTER TABLE pages DROP COLUMN depth;
+ALTER TABLE pages DROP COLUMN discovered_at;
+
+ALTER TABLE host DROP COLUMN successes;
+ALTER TABLE host DROP COLUMN visits;
+UPDATE host SET robot = '' WHERE robot IS NULL;
+ALTER TABLE host ALTER COLUMN robot SET NOT NULL;
+
+DROP FUNCTION IF EXISTS page_priority(integer, integer, double precision, timestamp);
+DROP FUNCTION IF EXISTS host_quality(integer, integer);
@@ -0,0 +1,43 @@
+-- Pages are claimed by decreasing priority. The score is computed by page_priority which
+-- must be kept in sync with priority in priority.go.
+
+CREATE OR REPLACE FUNCTION host_quality(visits integer, successes integer) RETURNS double precision AS $$
+	SELECT (COALESCE(successes, 0) + 1.0) / (COALESCE(visits, 0) + 2.0)
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+-- Staleness grows linearly with time so the score at any time only differs by a constant
+-- from the score at the reference date: it can be stored and indexed.
+CREATE OR REPLACE FUNCTION page_priority(
+	inlinks integer,
+	depth integer,
+	host_quality double precision,
+	stale_since timestamp
+) RETURNS double precision AS $$
+	SELECT 1.0 * ln(1 + inlinks)
+		+ 2.0 * COALESCE(1.0 / (1 + depth), 0)
+		+ 1.0 * host_quality
+		- 0.1 * extract(epoch FROM stale_since - timestamp '2024-01-01') / 86400
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+ALTER TABLE host ALTER COLUMN robot DROP NOT NULL;
+ALTER TABLE host ADD COLUMN visits integer NOT NULL DEFAULT 0;
+ALTER TABLE host ADD COLUMN successes integer NOT NULL DEFAULT 0;
+
+ALTER TABLE pages ADD COLUMN discovered_at timestamp NOT NULL DEFAULT LOCALTIMESTAMP;
+ALTER TABLE pages ADD COLUMN depth integer; -- Distance to the nearest seed, NULL if unknown
+ALTER TABLE pages ADD COLUMN inlinks integer NOT NULL DEFAULT 0;
+ALTER TABLE pages ADD COLUMN priority double precision NOT NULL
+	DEFAULT page_priority(0, NULL, host_quality(0, 0), LOCALTIMESTAMP);
+
+UPDATE pages SET inlinks = counts.inlinks
+FROM (SELECT target_id, COUNT(*) AS inlinks FROM links GROUP BY target_id) AS counts
+WHERE pages.id = counts.target_id;
+
+UPDATE pages SET priority = page_priority(
+	inlinks, depth, host_quality(0, 0), COALESCE(latest_visit, discovered_at)
+);
+
+-- The frontier is now read by priority and leased pages are counted per host
+DROP INDEX IF EXISTS pages_frontier;
+CREATE INDEX pages_frontier_priority ON pages (priority DESC) WHERE latest_visit IS NULL;
+CREATE INDEX pages_leased ON pages (host_reversed) WHERE lease_expires IS NOT NULL;
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS pages_revisit;
+DROP FUNCTION IF EXISTS next_revisit_seconds(integer, bigint, bigint, integer, integer);
+ALTER TABLE pages DROP COLUMN next_visit;
+ALTER TABLE pages DROP COLUMN revisit_seconds;
@@ -0,0 +1,27 @@
+-- Visited pages are crawled again at next_visit. The interval between two visits adapts
+-- to how often the content of the page changes, see RevisitPolicy in revisit.go.
+ALTER TABLE pages ADD COLUMN revisit_seconds integer;
+ALTER TABLE pages ADD COLUMN next_visit timestamp;
+
+CREATE OR REPLACE FUNCTION next_revisit_seconds(
+	previous integer,
+	old_hash bigint,
+	new_hash bigint,
+	min_seconds integer,
+	max_seconds integer
+) RETURNS integer AS $$
+	SELECT CASE
+		WHEN max_seconds <= 0 THEN NULL
+		ELSE round(GREATEST(min_seconds, LEAST(max_seconds, CASE
+			WHEN previous IS NULL THEN sqrt(min_seconds::double precision * max_seconds)
+			WHEN old_hash IS NULL OR new_hash IS NULL THEN previous
+			WHEN old_hash <> new_hash THEN previous / 2.0
+			ELSE previous * 1.5
+		END)))::integer
+	END
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+-- Pages visited before are revisited within the default maximum interval
+UPDATE pages SET next_visit = latest_visit + INTERVAL '30 days' WHERE latest_visit IS NOT NULL;
+
+CREATE INDEX pages_revisit ON pages (next_visit) WHERE next_visit IS NOT NULL;
@@ -0,0 +1,3 @@
+ALTER TABLE links DROP COLUMN missed;
+ALTER TABLE links DROP COLUMN last_seen;
+ALTER TABLE links DROP COLUMN first_seen;
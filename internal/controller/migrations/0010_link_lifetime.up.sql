@@ -0,0 +1,5 @@
+-- Each crawl of a page refreshes the links it still contains and counts a miss for the
+-- ones it doesn't, links missed too many times in a row are deleted.
+ALTER TABLE links ADD COLUMN first_seen timestamp NOT NULL DEFAULT LOCALTIMESTAMP;
+ALTER TABLE links ADD COLUMN last_seen timestamp NOT NULL DEFAULT LOCALTIMESTAMP;
+ALTER TABLE links ADD COLUMN missed smallint NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE host DROP COLUMN robot_fetched_at;
+ALTER TABLE host DROP COLUMN robot_status;
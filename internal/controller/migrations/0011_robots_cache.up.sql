@@ -0,0 +1,4 @@
+-- robots.txt files are stored with their host so that they survive restarts and are
+-- shared by all the crawler processes. robot is NULL until the file is fetched.
+ALTER TABLE host ADD COLUMN robot_status smallint;
+ALTER TABLE host ADD COLUMN robot_fetched_at timestamp;
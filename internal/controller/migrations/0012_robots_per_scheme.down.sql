@@ -0,0 +1,13 @@
+ALTER TABLE host ADD COLUMN robot_status smallint;
+ALTER TABLE host ADD COLUMN robot_fetched_at timestamp;
+
+INSERT INTO host (host_reversed, robot, robot_status, robot_fetched_at)
+SELECT host_reversed, body, status, fetched_at
+FROM robots
+WHERE scheme = 'http'
+ON CONFLICT (host_reversed) DO UPDATE
+SET robot = EXCLUDED.robot,
+	robot_status = EXCLUDED.robot_status,
+	robot_fetched_at = EXCLUDED.robot_fetched_at;
+
+DROP TABLE robots;
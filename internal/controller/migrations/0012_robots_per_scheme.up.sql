@@ -0,0 +1,19 @@
+-- A robots.txt only applies to the scheme it was fetched from (RFC 9309), so they move
+-- from the host table to their own table. Until now only http was fetched.
+CREATE TABLE robots (
+	host_reversed	text NOT NULL,
+	scheme			text NOT NULL,
+	body			text NOT NULL,
+	status			smallint NOT NULL,
+	fetched_at		timestamp NOT NULL,
+	PRIMARY KEY(host_reversed, scheme)
+);
+
+INSERT INTO robots (host_reversed, scheme, body, status, fetched_at)
+SELECT host_reversed, 'http', robot, robot_status, robot_fetched_at
+FROM host
+WHERE robot_fetched_at IS NOT NULL;
+
+UPDATE host SET robot = NULL WHERE robot_fetched_at IS NOT NULL;
+ALTER TABLE host DROP COLUMN robot_fetched_at;
+ALTER TABLE host DROP COLUMN robot_status;
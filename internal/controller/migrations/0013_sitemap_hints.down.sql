@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS hints_staging;
+ALTER TABLE pages DROP COLUMN sitemap_priority;
+DROP FUNCTION IF EXISTS page_priority(integer, integer, double precision, timestamp, real);
@@ -0,0 +1,23 @@
+-- Sitemaps give a priority to the pages of their site, it is kept so that the score of
+-- a page can be computed again. page_priority gets an overload that takes it into
+-- account, it must be kept in sync with priority in priority.go.
+CREATE OR REPLACE FUNCTION page_priority(
+	inlinks integer,
+	depth integer,
+	host_quality double precision,
+	stale_since timestamp,
+	sitemap_priority real
+) RETURNS double precision AS $$
+	SELECT page_priority(inlinks, depth, host_quality, stale_since)
+		+ 1.0 * (COALESCE(sitemap_priority, 0.5) - 0.5)
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+ALTER TABLE pages ADD COLUMN sitemap_priority real NOT NULL DEFAULT 0.5;
+
+CREATE UNLOGGED TABLE IF NOT EXISTS hints_staging (
+	scheme				text NOT NULL,
+	host_reversed		text NOT NULL,
+	path				text NOT NULL,
+	lastmod				timestamp,
+	sitemap_priority	real NOT NULL
+);
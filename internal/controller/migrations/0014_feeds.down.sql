@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS pages_fresh;
+ALTER TABLE hints_staging DROP COLUMN fresh;
+ALTER TABLE pages DROP COLUMN fresh;
+
+DROP TABLE IF EXISTS feeds_staging;
+DROP TABLE IF EXISTS feeds;
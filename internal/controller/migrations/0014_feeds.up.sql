@@ -0,0 +1,30 @@
+-- Feeds advertised by the crawled pages are polled on a schedule that adapts to how often
+-- they change, like the revisits of pages. Their new entries are fresh pages that are
+-- claimed before the rest of the frontier.
+CREATE TABLE feeds (
+	scheme			text NOT NULL,
+	host_reversed	text NOT NULL,
+	path			text NOT NULL,
+	discovered_at	timestamp NOT NULL DEFAULT LOCALTIMESTAMP,
+	latest_poll		timestamp,
+	next_poll		timestamp NOT NULL DEFAULT LOCALTIMESTAMP,
+	poll_seconds	integer,
+	lease_expires	timestamp,
+	status_code		smallint,
+	content_hash	bigint,
+	failure			text,
+	PRIMARY KEY(host_reversed, path)
+);
+
+CREATE INDEX feeds_due ON feeds (next_poll);
+
+CREATE UNLOGGED TABLE IF NOT EXISTS feeds_staging (
+	scheme			text NOT NULL,
+	host_reversed	text NOT NULL,
+	path			text NOT NULL
+);
+
+ALTER TABLE pages ADD COLUMN fresh boolean NOT NULL DEFAULT false;
+ALTER TABLE hints_staging ADD COLUMN fresh boolean NOT NULL DEFAULT false;
+
+CREATE INDEX pages_fresh ON pages (discovered_at DESC) WHERE fresh AND latest_visit IS NULL;
@@ -0,0 +1,9 @@
+DROP FUNCTION IF EXISTS revisit_delay_seconds(integer, integer, integer);
+
+ALTER TABLE visits_staging DROP COLUMN max_age_seconds;
+ALTER TABLE visits_staging DROP COLUMN last_modified;
+ALTER TABLE visits_staging DROP COLUMN etag;
+ALTER TABLE visits_staging DROP COLUMN not_modified;
+
+ALTER TABLE pages DROP COLUMN last_modified;
+ALTER TABLE pages DROP COLUMN etag;
@@ -0,0 +1,20 @@
+-- The validators of the latest successful visit make the next one conditional, and the
+-- freshness of the response delays it, see RevisitPolicy.Delay in revisit.go.
+ALTER TABLE pages ADD COLUMN etag text;
+ALTER TABLE pages ADD COLUMN last_modified text;
+
+ALTER TABLE visits_staging ADD COLUMN not_modified boolean NOT NULL DEFAULT false;
+ALTER TABLE visits_staging ADD COLUMN etag text;
+ALTER TABLE visits_staging ADD COLUMN last_modified text;
+ALTER TABLE visits_staging ADD COLUMN max_age_seconds integer;
+
+CREATE OR REPLACE FUNCTION revisit_delay_seconds(
+	revisit_seconds integer,
+	max_age_seconds integer,
+	max_seconds integer
+) RETURNS integer AS $$
+	SELECT CASE
+		WHEN revisit_seconds IS NULL OR revisit_seconds <= 0 THEN NULL
+		ELSE LEAST(max_seconds, GREATEST(revisit_seconds, COALESCE(max_age_seconds, 0)))
+	END
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
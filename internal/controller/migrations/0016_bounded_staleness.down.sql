@@ -0,0 +1,22 @@
+CREATE OR REPLACE FUNCTION page_priority(
+	inlinks integer,
+	depth integer,
+	host_quality double precision,
+	stale_since timestamp
+) RETURNS double precision AS $$
+	SELECT 1.0 * ln(1 + inlinks)
+		+ 2.0 * COALESCE(1.0 / (1 + depth), 0)
+		+ 1.0 * host_quality
+		- 0.1 * extract(epoch FROM stale_since - timestamp '2024-01-01') / 86400
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+UPDATE pages SET priority = page_priority(
+	inlinks,
+	depth,
+	COALESCE(
+		(SELECT host_quality(host.visits, host.successes) FROM host WHERE host.host_reversed = pages.host_reversed),
+		host_quality(0, 0)
+	),
+	COALESCE(latest_visit, discovered_at),
+	sitemap_priority
+);
@@ -0,0 +1,26 @@
+-- Staleness grew linearly with time: a page found a few months earlier outweighed any
+-- amount of inlinks. It now grows like the logarithm of the days since the reference
+-- date, it keeps the order of the pages by staleness so the score can still be stored
+-- and indexed. It must be kept in sync with priority in priority.go.
+CREATE OR REPLACE FUNCTION page_priority(
+	inlinks integer,
+	depth integer,
+	host_quality double precision,
+	stale_since timestamp
+) RETURNS double precision AS $$
+	SELECT 1.0 * ln(1 + inlinks)
+		+ 2.0 * COALESCE(1.0 / (1 + depth), 0)
+		+ 1.0 * host_quality
+		- 1.0 * ln(1 + GREATEST(extract(epoch FROM stale_since - timestamp '2024-01-01') / 86400, 0))
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+UPDATE pages SET priority = page_priority(
+	inlinks,
+	depth,
+	COALESCE(
+		(SELECT host_quality(host.visits, host.successes) FROM host WHERE host.host_reversed = pages.host_reversed),
+		host_quality(0, 0)
+	),
+	COALESCE(latest_visit, discovered_at),
+	sitemap_priority
+);
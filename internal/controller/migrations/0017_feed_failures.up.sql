@@ -0,0 +1,3 @@
+-- Feeds that fail to be fetched or parsed many polls in a row are only polled at the
+-- maximum interval, until a poll succeeds again.
+ALTER TABLE feeds ADD COLUMN failures smallint NOT NULL DEFAULT 0;
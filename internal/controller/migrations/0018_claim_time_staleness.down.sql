@@ -0,0 +1,40 @@
+ALTER TABLE pages ALTER COLUMN priority DROP DEFAULT;
+DROP FUNCTION page_staleness(timestamp, timestamp);
+DROP FUNCTION page_priority(integer, integer, double precision, real);
+
+CREATE FUNCTION page_priority(
+	inlinks integer,
+	depth integer,
+	host_quality double precision,
+	stale_since timestamp
+) RETURNS double precision AS $$
+	SELECT 1.0 * ln(1 + inlinks)
+		+ 2.0 * COALESCE(1.0 / (1 + depth), 0)
+		+ 1.0 * host_quality
+		- 1.0 * ln(1 + GREATEST(extract(epoch FROM stale_since - timestamp '2024-01-01') / 86400, 0))
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+CREATE FUNCTION page_priority(
+	inlinks integer,
+	depth integer,
+	host_quality double precision,
+	stale_since timestamp,
+	sitemap_priority real
+) RETURNS double precision AS $$
+	SELECT page_priority(inlinks, depth, host_quality, stale_since)
+		+ 1.0 * (COALESCE(sitemap_priority, 0.5) - 0.5)
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+ALTER TABLE pages ALTER COLUMN priority
+	SET DEFAULT page_priority(0, NULL, host_quality(0, 0), LOCALTIMESTAMP);
+
+UPDATE pages SET priority = page_priority(
+	inlinks,
+	depth,
+	COALESCE(
+		(SELECT host_quality(host.visits, host.successes) FROM host WHERE host.host_reversed = pages.host_reversed),
+		host_quality(0, 0)
+	),
+	COALESCE(latest_visit, discovered_at),
+	sitemap_priority
+);
@@ -0,0 +1,36 @@
+-- The staleness of a page is no longer part of its stored score: it is added when pages
+-- are claimed, from the days since their latest visit capped to a month, so that it
+-- separates pages visited a few days apart without outweighing the other signals. The
+-- stored score only holds the signals that don't depend on time so it never gets stale.
+-- page_priority and page_staleness must be kept in sync with priority.go.
+ALTER TABLE pages ALTER COLUMN priority DROP DEFAULT;
+DROP FUNCTION page_priority(integer, integer, double precision, timestamp, real);
+DROP FUNCTION page_priority(integer, integer, double precision, timestamp);
+
+CREATE FUNCTION page_priority(
+	inlinks integer,
+	depth integer,
+	host_quality double precision,
+	sitemap_priority real
+) RETURNS double precision AS $$
+	SELECT 1.0 * ln(1 + inlinks)
+		+ 2.0 * COALESCE(1.0 / (1 + depth), 0)
+		+ 1.0 * host_quality
+		+ 1.0 * (COALESCE(sitemap_priority, 0.5) - 0.5)
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+CREATE FUNCTION page_staleness(stale_since timestamp, now timestamp) RETURNS double precision AS $$
+	SELECT 0.1 * LEAST(GREATEST(extract(epoch FROM now - stale_since) / 86400, 0), 30)
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+ALTER TABLE pages ALTER COLUMN priority SET DEFAULT page_priority(0, NULL, host_quality(0, 0), 0.5);
+
+UPDATE pages SET priority = page_priority(
+	inlinks,
+	depth,
+	COALESCE(
+		(SELECT host_quality(host.visits, host.successes) FROM host WHERE host.host_reversed = pages.host_reversed),
+		host_quality(0, 0)
+	),
+	sitemap_priority
+);
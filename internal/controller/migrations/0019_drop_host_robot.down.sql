@@ -0,0 +1 @@
+ALTER TABLE host ADD COLUMN robot text;
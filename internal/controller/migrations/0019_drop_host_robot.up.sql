@@ -0,0 +1,3 @@
+-- The robots table replaced the robot column of the host table, which is emptied since
+-- 0012.
+ALTER TABLE host DROP COLUMN robot;
@@ -0,0 +1 @@
+ALTER TABLE visits_staging DROP COLUMN retry_after_seconds;
@@ -0,0 +1,3 @@
+-- Pages whose host was overloaded are visited again when its Retry-After asked for,
+-- instead of after their revisit interval.
+ALTER TABLE visits_staging ADD COLUMN retry_after_seconds integer;
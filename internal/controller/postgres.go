@@ -8,11 +8,11 @@ import (
 	"fmt"
 	"log/slog"
 	"net/url"
-	"strings"
 	"sync"
 	"time"
 
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -59,101 +59,473 @@ func initDatabase() {
 		return
 	}
 	slog.Debug("pool pinged successfully")
+}
 
-	// Ensure Schema is initialized
-	_, err = pool.Exec(ctx, `
-			CREATE TABLE IF NOT EXISTS host (
-				host_reversed	text PRIMARY KEY,
-				robot 				text NOT NULL
-			);
+// Connect to the database and ensure its schema is up to date, either by applying the
+// pending migrations (autoMigrate) or by refusing to start.
+func openPool(ctx context.Context, pgURI string, autoMigrate bool) (*pgxpool.Pool, error) {
+	pg, err := newPostgres(ctx, pgURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init postgres connection pool: %w", err)
+	}
+	migrator, err := newMigrator(pg)
+	if err != nil {
+		return nil, err
+	}
+	if autoMigrate {
+		err = migrator.Up(ctx)
+	} else {
+		err = migrator.Check(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to ensure database schema: %w", err)
+	}
+	return pg, nil
+}
 
-			CREATE TABLE IF NOT EXISTS pages (
-			 	id 				uuid DEFAULT gen_random_uuid(),
-				scheme			text NOT NULL,
-				host_reversed	text NOT NULL,
-				path 			text NOT NULL,
-				latest_visit 	timestamp,
+func insertPages(ctx context.Context, db *pgxpool.Pool, pages []*url.URL) error {
+	if len(pages) == 0 {
+		return nil
+	}
 
-				PRIMARY KEY(host_reversed, path)
-			);
+	rows := make([][]any, 0, len(pages))
+	for _, page := range pages {
+		rows = append(rows, []any{page.Scheme, commons.ReverseHostname(page.Hostname()), page.Path})
+	}
 
-			CREATE TABLE IF NOT EXISTS links (
-				source	text,
-				target	text,
+	err := copyAndMerge(ctx, db, "pages_staging", []string{"scheme", "host_reversed", "path"}, rows, `
+		INSERT INTO pages (scheme, host_reversed, path)
+		SELECT scheme, host_reversed, path
+		FROM pages_staging
+		ORDER BY host_reversed, path
+		ON CONFLICT DO NOTHING;
+	`)
+	if err != nil {
+		return fmt.Errorf("unable to insert pages: %w", err)
+	}
+	return nil
+}
 
-				PRIMARY KEY (source, target)
+// Insert pages as seeds: they are at depth 0, even if they were already known.
+func insertSeeds(ctx context.Context, db *pgxpool.Pool, seeds []*url.URL) {
+	if len(seeds) == 0 {
+		return
+	}
+
+	rows := make([][]any, 0, len(seeds))
+	for _, seed := range seeds {
+		rows = append(rows, []any{seed.Scheme, commons.ReverseHostname(seed.Hostname()), seed.Path})
+	}
+
+	err := copyAndMerge(ctx, db, "pages_staging", []string{"scheme", "host_reversed", "path"}, rows, `
+		INSERT INTO pages (scheme, host_reversed, path, depth, priority)
+		SELECT DISTINCT ON (host_reversed, path)
+			scheme, host_reversed, path, 0,
+			page_priority(0, 0, `+hostQualitySQL("pages_staging")+`, 0.5::real)
+		FROM pages_staging
+		ORDER BY host_reversed, path
+		ON CONFLICT (host_reversed, path) DO UPDATE SET
+			depth = 0,
+			priority = page_priority(
+				pages.inlinks, 0, `+hostQualitySQL("pages")+`, pages.sitemap_priority
 			);
+	`)
+	if err != nil {
+		slog.Error(fmt.Sprintf("unable to insert seeds: %s", err))
+	}
+}
 
-			CREATE EXTENSION IF NOT EXISTS tsm_system_rows;
-		`)
+// Save the links found by crawling pages. Both ends must already exist, their ids are
+// resolved with the (host_reversed, path) primary key of pages.
+//
+// Each group holds all the links of a page so its stored links are reconciled with it:
+// links found again are refreshed and those that are missing get a miss. Links missed
+// maxMisses times in a row are deleted, or never if maxMisses is 0. The inlinks, depth
+// and priority of the targets of new and deleted links are updated accordingly.
+func saveLinkGroups(ctx context.Context, db *pgxpool.Pool, groups []*commons.LinkGroup, maxMisses int) error {
+	if len(groups) == 0 {
+		return nil
+	}
+
+	rows := make([][]any, 0)
+	sourceHosts := make([]string, 0, len(groups))
+	sourcePaths := make([]string, 0, len(groups))
+	for _, group := range groups {
+		sourceHosts = append(sourceHosts, commons.ReverseHostname(group.From.Hostname()))
+		sourcePaths = append(sourcePaths, group.From.Path)
+		for _, link := range group.Links {
+			rows = append(rows, []any{
+				commons.ReverseHostname(group.From.Hostname()),
+				group.From.Path,
+				commons.ReverseHostname(link.To.Hostname()),
+				link.To.Path,
+				nullIfZero(link.Text),
+				link.Rel,
+				nullIfZero(link.Title),
+				link.Position,
+			})
+		}
+	}
+	columns := []string{
+		"source_host", "source_path", "target_host", "target_path",
+		"anchor_text", "rel", "title", "position",
+	}
+
+	err := copyAndMerge(ctx, db, "links_staging", columns, rows, `
+		WITH crawled AS (
+			SELECT pages.id
+			FROM unnest($1::text[], $2::text[]) AS c(host_reversed, path)
+			JOIN pages ON pages.host_reversed = c.host_reversed AND pages.path = c.path
+		),
+		staged AS (
+			SELECT DISTINCT ON (source_page.id, target_page.id)
+				source_page.id AS source_id,
+				target_page.id AS target_id,
+				s.anchor_text,
+				s.rel,
+				s.title,
+				s.position
+			FROM links_staging AS s
+			JOIN pages AS source_page
+				ON source_page.host_reversed = s.source_host AND source_page.path = s.source_path
+			JOIN pages AS target_page
+				ON target_page.host_reversed = s.target_host AND target_page.path = s.target_path
+			ORDER BY source_page.id, target_page.id
+		),
+		upserted AS (
+			INSERT INTO links (source_id, target_id, anchor_text, rel, title, position)
+			SELECT source_id, target_id, anchor_text, rel, title, position
+			FROM staged
+			ORDER BY target_id, source_id
+			ON CONFLICT (target_id, source_id) DO UPDATE SET
+				anchor_text = EXCLUDED.anchor_text,
+				rel = EXCLUDED.rel,
+				title = EXCLUDED.title,
+				position = EXCLUDED.position,
+				last_seen = LOCALTIMESTAMP,
+				missed = 0
+			-- xmax is only set on the rows that already existed
+			RETURNING source_id, target_id, xmax = 0 AS inserted
+		),
+		missing AS (
+			SELECT links.source_id, links.target_id, links.missed + 1 AS missed
+			FROM links
+			JOIN crawled ON crawled.id = links.source_id
+			WHERE NOT EXISTS (
+				SELECT 1 FROM staged
+				WHERE staged.source_id = links.source_id AND staged.target_id = links.target_id
+			)
+		),
+		missed AS (
+			UPDATE links SET missed = missing.missed
+			FROM missing
+			WHERE links.source_id = missing.source_id AND links.target_id = missing.target_id
+			AND ($3 <= 0 OR missing.missed < $3)
+		),
+		deleted AS (
+			DELETE FROM links
+			USING missing
+			WHERE links.source_id = missing.source_id AND links.target_id = missing.target_id
+			AND $3 > 0 AND missing.missed >= $3
+			RETURNING links.source_id, links.target_id
+		),
+		changes AS (
+			SELECT source_id, target_id, 1 AS inlinks FROM upserted WHERE inserted
+			UNION ALL
+			SELECT source_id, target_id, -1 AS inlinks FROM deleted
+		),
+		targets AS (
+			SELECT
+				changes.target_id,
+				SUM(changes.inlinks)::integer AS inlinks,
+				MIN(source_page.depth) FILTER (WHERE changes.inlinks > 0) + 1 AS depth
+			FROM changes
+			JOIN pages AS source_page ON source_page.id = changes.source_id
+			GROUP BY changes.target_id
+		),
+		-- Lock the targets in a consistent order to avoid deadlocks with other writers
+		locked AS (
+			SELECT pages.id
+			FROM pages
+			JOIN targets ON targets.target_id = pages.id
+			ORDER BY pages.id
+			FOR UPDATE OF pages
+		)
+		UPDATE pages SET
+			inlinks = pages.inlinks + targets.inlinks,
+			depth = LEAST(pages.depth, targets.depth),
+			priority = page_priority(
+				pages.inlinks + targets.inlinks,
+				LEAST(pages.depth, targets.depth),
+				`+hostQualitySQL("pages")+`,
+				pages.sitemap_priority
+			)
+		FROM targets
+		JOIN locked ON locked.id = targets.target_id
+		WHERE pages.id = targets.target_id;
+	`, sourceHosts, sourcePaths, maxMisses)
 	if err != nil {
-		initError = fmt.Errorf("failed to initialize postgres tables: %w", err)
-		return
+		return fmt.Errorf("unable to save links: %w", err)
 	}
+	return nil
 }
 
-func insertPages(ctx context.Context, db *pgxpool.Pool, pages []*url.URL) {
-	if len(pages) == 0 {
+// Insert the hinted pages with their sitemap priority. Known pages get the new priority
+// and, if they were modified since their latest visit, are due for a revisit right away.
+// Fresh pages that were never visited are claimed before the others.
+func saveHints(ctx context.Context, db *pgxpool.Pool, hints []*commons.PageHint) {
+	if len(hints) == 0 {
 		return
 	}
 
-	var (
-		stmtBuilder strings.Builder
-		args        []any
-	)
-
-	stmtBuilder.WriteString("INSERT INTO pages (scheme, host_reversed, path) VALUES ")
-	for i, page := range pages {
-		if i > 0 {
-			stmtBuilder.WriteString(", ")
+	rows := make([][]any, 0, len(hints))
+	for _, hint := range hints {
+		var lastmod *time.Time
+		if !hint.LastMod.IsZero() {
+			utc := hint.LastMod.UTC()
+			lastmod = &utc
 		}
-		paramIndex := i * 3
-		stmtBuilder.WriteString(fmt.Sprintf("($%d, $%d, $%d)", paramIndex+1, paramIndex+2, paramIndex+3))
-		args = append(args, page.Scheme, commons.ReverseHostname(page.Hostname()), page.Path)
+		rows = append(rows, []any{
+			hint.URL.Scheme,
+			commons.ReverseHostname(hint.URL.Hostname()),
+			hint.URL.Path,
+			lastmod,
+			float32(hint.Priority),
+			hint.Fresh,
+		})
 	}
-	stmtBuilder.WriteString(" ON CONFLICT DO NOTHING;")
-	stmt := stmtBuilder.String()
+	columns := []string{"scheme", "host_reversed", "path", "lastmod", "sitemap_priority", "fresh"}
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
-	defer cancel()
+	// The update does not see the rows inserted by the CTE so it only touches the pages
+	// that were already known
+	err := copyAndMerge(ctx, db, "hints_staging", columns, rows, `
+		WITH hints AS (
+			SELECT DISTINCT ON (host_reversed, path) *
+			FROM hints_staging
+			ORDER BY host_reversed, path
+		),
+		inserted AS (
+			INSERT INTO pages (scheme, host_reversed, path, sitemap_priority, fresh, priority)
+			SELECT
+				scheme, host_reversed, path, sitemap_priority, fresh,
+				page_priority(0, NULL, `+hostQualitySQL("hints")+`, sitemap_priority)
+			FROM hints
+			ORDER BY host_reversed, path
+			ON CONFLICT DO NOTHING
+		)
+		UPDATE pages SET
+			sitemap_priority = hints.sitemap_priority,
+			fresh = pages.fresh OR (hints.fresh AND pages.latest_visit IS NULL),
+			next_visit = CASE
+				WHEN hints.lastmod > pages.latest_visit THEN LEAST(pages.next_visit, NOW())
+				ELSE pages.next_visit
+			END,
+			priority = page_priority(
+				pages.inlinks, pages.depth, `+hostQualitySQL("pages")+`, hints.sitemap_priority
+			)
+		FROM hints
+		WHERE pages.host_reversed = hints.host_reversed AND pages.path = hints.path;
+	`)
+	if err != nil {
+		slog.Error(fmt.Sprintf("unable to save hints: %s", err))
+	}
+}
 
-	_, err := db.Exec(ctx, stmt, args...)
+// Save the outcome of each visit on the corresponding page, release its lease, schedule
+// its next visit, when the host asked for it if it was overloaded, and update the
+// statistics of its host. Missing information (like the
+// status of a request that failed at the network level) is stored as NULL.
+func updatePages(ctx context.Context, db *pgxpool.Pool, visits []*commons.Visit, revisit RevisitPolicy) {
+	if len(visits) == 0 {
+		return
+	}
+
+	rows := make([][]any, 0, len(visits))
+	for _, visit := range visits {
+		rows = append(rows, []any{
+			commons.ReverseHostname(visit.URL.Hostname()),
+			visit.URL.Path,
+			nullIfZero(visit.Status),
+			nullIfZero(visit.ContentType),
+			nullIfZero(visit.Size),
+			nullIfZero(visit.Duration.Milliseconds()),
+			nullIfZero(int64(visit.Hash)),
+			nullIfZero(string(visit.Failure)),
+			visit.NotModified,
+			nullIfZero(visit.Validators.ETag),
+			nullIfZero(visit.Validators.LastModified),
+			nullIfZero(int(visit.MaxAge.Seconds())),
+			nullIfZero(int(visit.RetryAfter.Seconds())),
+		})
+	}
+	columns := []string{
+		"host_reversed", "path", "status_code", "content_type",
+		"content_length", "fetch_duration_ms", "content_hash", "failure",
+		"not_modified", "etag", "last_modified", "max_age_seconds", "retry_after_seconds",
+	}
+
+	// A page that was not modified keeps the content and validators of the previous visit,
+	// and failed visits keep the validators of the latest successful one.
+	newHash := "CASE WHEN s.not_modified THEN pages.content_hash ELSE s.content_hash END"
+	validator := func(column string) string {
+		return fmt.Sprintf(`CASE
+			WHEN s.failure IS NOT NULL THEN pages.%[1]s
+			WHEN s.not_modified THEN COALESCE(s.%[1]s, pages.%[1]s)
+			ELSE s.%[1]s
+		END`, column)
+	}
+
+	err := copyAndMerge(ctx, db, "visits_staging", columns, rows, `
+		WITH visited AS (
+			UPDATE pages SET
+				status_code = s.status_code,
+				content_type = CASE WHEN s.not_modified THEN pages.content_type ELSE s.content_type END,
+				content_length = CASE WHEN s.not_modified THEN pages.content_length ELSE s.content_length END,
+				fetch_duration_ms = s.fetch_duration_ms,
+				content_hash = `+newHash+`,
+				failure = s.failure,
+				etag = `+validator("etag")+`,
+				last_modified = `+validator("last_modified")+`,
+				latest_visit = NOW(),
+				fresh = false,
+				claimed_at = NULL,
+				lease_expires = NULL,
+				revisit_seconds = next_revisit_seconds(
+					pages.revisit_seconds, pages.content_hash, `+newHash+`, $1, $2
+				),
+				next_visit = NOW() + COALESCE(s.retry_after_seconds, revisit_delay_seconds(
+					next_revisit_seconds(pages.revisit_seconds, pages.content_hash, `+newHash+`, $1, $2),
+					s.max_age_seconds,
+					$2
+				)) * INTERVAL '1 second',
+				priority = page_priority(
+					pages.inlinks, pages.depth, `+hostQualitySQL("pages")+`, pages.sitemap_priority
+				)
+			FROM visits_staging AS s
+			WHERE pages.host_reversed = s.host_reversed AND pages.path = s.path
+			RETURNING pages.host_reversed, s.failure
+		)
+		INSERT INTO host (host_reversed, visits, successes)
+		SELECT host_reversed, COUNT(*), COUNT(*) FILTER (WHERE failure IS NULL)
+		FROM visited
+		GROUP BY host_reversed
+		ORDER BY host_reversed
+		ON CONFLICT (host_reversed) DO UPDATE SET
+			visits = host.visits + EXCLUDED.visits,
+			successes = host.successes + EXCLUDED.successes;
+	`, int(revisit.Min.Seconds()), int(revisit.Max.Seconds()))
 	if err != nil {
-		slog.Error(fmt.Sprintf("unable to insert pages: %s", err))
+		slog.Error(fmt.Sprintf("unable to update pages: %s", err))
 	}
 }
 
-func insertLinks(ctx context.Context, db *pgxpool.Pool, links []commons.Link) {
-	if len(links) == 0 {
+// Insert the feeds advertised by the crawled pages, they are due right away.
+func insertFeeds(ctx context.Context, db *pgxpool.Pool, feeds []*url.URL) {
+	if len(feeds) == 0 {
 		return
 	}
 
-	var (
-		stmtBuilder strings.Builder
-		args        []any
-	)
+	rows := make([][]any, 0, len(feeds))
+	for _, feed := range feeds {
+		rows = append(rows, []any{feed.Scheme, commons.ReverseHostname(feed.Hostname()), feed.Path})
+	}
 
-	stmtBuilder.WriteString("INSERT INTO links (source, target) VALUES ")
-	for i, link := range links {
-		if i > 0 {
-			stmtBuilder.WriteString(", ")
-		}
-		paramIndex := i * 2
-		stmtBuilder.WriteString(fmt.Sprintf("($%d, $%d)", paramIndex+1, paramIndex+2))
-		args = append(args, link.From, link.To)
+	err := copyAndMerge(ctx, db, "feeds_staging", []string{"scheme", "host_reversed", "path"}, rows, `
+		INSERT INTO feeds (scheme, host_reversed, path)
+		SELECT DISTINCT ON (host_reversed, path) scheme, host_reversed, path
+		FROM feeds_staging
+		ORDER BY host_reversed, path
+		ON CONFLICT DO NOTHING;
+	`)
+	if err != nil {
+		slog.Error(fmt.Sprintf("unable to insert feeds: %s", err))
+	}
+}
+
+// Save the outcome of polling a feed, release its lease and schedule its next poll. The
+// poll interval adapts to how often the feed changes, failed polls keep the interval
+// unless maxFeedFailures of them in a row make it the maximum.
+func updateFeed(ctx context.Context, db *pgxpool.Pool, visit *commons.Visit, poll RevisitPolicy) {
+	query := `
+		UPDATE feeds SET
+			latest_poll = NOW(),
+			lease_expires = NULL,
+			status_code = $3,
+			failure = $4,
+			failures = CASE WHEN $4::text IS NULL THEN 0 ELSE failures + 1 END,
+			content_hash = COALESCE($5, content_hash),
+			poll_seconds = CASE
+				WHEN $4::text IS NOT NULL AND failures + 1 >= $8 THEN $7
+				ELSE next_revisit_seconds(poll_seconds, content_hash, $5, $6, $7)
+			END,
+			next_poll = NOW() + CASE
+				WHEN $4::text IS NOT NULL AND failures + 1 >= $8 THEN $7
+				ELSE COALESCE(next_revisit_seconds(poll_seconds, content_hash, $5, $6, $7), $7)
+			END * INTERVAL '1 second'
+		WHERE host_reversed = $1 AND path = $2;
+	`
+	_, err := db.Exec(
+		ctx,
+		query,
+		commons.ReverseHostname(visit.URL.Hostname()),
+		visit.URL.Path,
+		nullIfZero(visit.Status),
+		nullIfZero(string(visit.Failure)),
+		nullIfZero(int64(visit.Hash)),
+		int(poll.Min.Seconds()),
+		int(poll.Max.Seconds()),
+		maxFeedFailures,
+	)
+	if err != nil {
+		slog.Error(fmt.Sprintf("unable to update feed %s: %s", visit.URL, err))
 	}
-	stmtBuilder.WriteString(" ON CONFLICT DO NOTHING;")
-	stmt := stmtBuilder.String()
+}
 
+// Copy rows into an unlogged staging table with the COPY protocol then apply them with
+// the merge statement and its args. Everything happens in one transaction that empties
+// the staging table before committing: concurrent writers never see each other's rows.
+func copyAndMerge(
+	ctx context.Context,
+	db *pgxpool.Pool,
+	staging string,
+	columns []string,
+	rows [][]any,
+	merge string,
+	args ...any,
+) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
 
-	_, err := db.Exec(ctx, stmt, args...)
-	if err != nil {
-		slog.Error(fmt.Sprintf("unable to insert links: %s", err))
-	}
+	return pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+		_, err := tx.CopyFrom(ctx, pgx.Identifier{staging}, columns, pgx.CopyFromRows(rows))
+		if err != nil {
+			return fmt.Errorf("failed to copy rows into %s: %w", staging, err)
+		}
+		_, err = tx.Exec(ctx, merge, args...)
+		if err != nil {
+			return fmt.Errorf("failed to merge %s: %w", staging, err)
+		}
+		_, err = tx.Exec(ctx, "DELETE FROM "+pgx.Identifier{staging}.Sanitize())
+		if err != nil {
+			return fmt.Errorf("failed to empty %s: %w", staging, err)
+		}
+		return nil
+	})
+}
+
+// SQL expression of the quality of the host of the rows of table, hosts without any
+// visit get the same quality as in hostQuality.
+func hostQualitySQL(table string) string {
+	return fmt.Sprintf(`COALESCE(
+		(SELECT host_quality(host.visits, host.successes) FROM host WHERE host.host_reversed = %s.host_reversed),
+		host_quality(0, 0)
+	)`, table)
 }
 
-func updatePages(ctx context.Context, db *pgxpool.Pool, pages []*url.URL) {
-	// TODO: what do we want to save? status, hash, cache?
+func nullIfZero[T comparable](v T) any {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return v
 }
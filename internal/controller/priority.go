@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"math"
+	"time"
+)
+
+// Weights of the priority score, they must be kept in sync with the page_priority and
+// page_staleness SQL functions of the migrations.
+const (
+	inlinksWeight   = 1.0
+	depthWeight     = 2.0
+	hostWeight      = 1.0
+	stalenessWeight = 0.1 // per day
+	sitemapWeight   = 1.0
+)
+
+// Staleness stops growing after that, so that it never outweighs the other signals
+const maxStaleness = 30 * 24 * time.Hour
+
+// Priority of the pages that are in no sitemap, like the default of the sitemap protocol
+const defaultSitemapPriority = 0.5
+
+// Depth of pages that are not linked from a seed by a known path
+const unknownDepth = -1
+
+// pageStats are the signals used to decide which page to crawl first.
+type pageStats struct {
+	Inlinks       int
+	Depth         int // Distance to the nearest seed or unknownDepth
+	HostVisits    int
+	HostSuccesses int
+	StaleSince    time.Time // Time of the latest visit, or of the discovery if never visited
+	// Priority announced by the sitemap of the site, defaultSitemapPriority if none
+	SitemapPriority float64
+}
+
+// hostQuality is the smoothed ratio of successful visits of a host: unknown hosts start
+// at 0.5 and move toward their actual success rate as they are crawled.
+func hostQuality(visits int, successes int) float64 {
+	return (float64(successes) + 1) / (float64(visits) + 2)
+}
+
+// priority scores a page at the given time, pages with a higher score are crawled first.
+// Pages with many inlinks, close to a seed and on reliable hosts come first. Sitemaps can
+// move a page up or down a bit.
+//
+// Pages that have been stale for longer get a higher score, up to maxStaleness. The
+// staleness depends on the time so it is not part of the score stored in the database,
+// see staticPriority, it is added when pages are claimed.
+func priority(stats pageStats, now time.Time) float64 {
+	return staticPriority(stats) + staleness(stats.StaleSince, now)
+}
+
+// staticPriority is the part of the score that does not depend on the time.
+func staticPriority(stats pageStats) float64 {
+	score := inlinksWeight*math.Log(1+float64(stats.Inlinks)) +
+		hostWeight*hostQuality(stats.HostVisits, stats.HostSuccesses) +
+		sitemapWeight*(stats.SitemapPriority-defaultSitemapPriority)
+	if stats.Depth != unknownDepth {
+		score += depthWeight / (1 + float64(stats.Depth))
+	}
+	return score
+}
+
+func staleness(staleSince time.Time, now time.Time) float64 {
+	stale := min(max(now.Sub(staleSince), 0), maxStaleness)
+	return stalenessWeight * stale.Hours() / 24
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPriorityOrder(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	base := pageStats{Inlinks: 1, Depth: 2, HostVisits: 10, HostSuccesses: 5, StaleSince: now}
+
+	tests := map[string]struct {
+		better pageStats
+		worse  pageStats
+	}{
+		"more inlinks": {
+			better: pageStats{Inlinks: 10, Depth: 2, HostVisits: 10, HostSuccesses: 5, StaleSince: now},
+			worse:  base,
+		},
+		"closer to a seed": {
+			better: pageStats{Inlinks: 1, Depth: 0, HostVisits: 10, HostSuccesses: 5, StaleSince: now},
+			worse:  base,
+		},
+		"known depth": {
+			better: base,
+			worse:  pageStats{Inlinks: 1, Depth: unknownDepth, HostVisits: 10, HostSuccesses: 5, StaleSince: now},
+		},
+		"better host": {
+			better: pageStats{Inlinks: 1, Depth: 2, HostVisits: 10, HostSuccesses: 10, StaleSince: now},
+			worse:  base,
+		},
+		"staler": {
+			better: pageStats{Inlinks: 1, Depth: 2, HostVisits: 10, HostSuccesses: 5, StaleSince: now.Add(-48 * time.Hour)},
+			worse:  base,
+		},
+		"much more inlinks than staler": {
+			better: pageStats{Inlinks: 100, Depth: 2, HostVisits: 10, HostSuccesses: 5, StaleSince: now},
+			worse:  pageStats{Inlinks: 1, Depth: 2, HostVisits: 10, HostSuccesses: 5, StaleSince: now.AddDate(-2, 0, 0)},
+		},
+		"higher in sitemap": {
+			better: pageStats{Inlinks: 1, Depth: 2, HostVisits: 10, HostSuccesses: 5, StaleSince: now, SitemapPriority: 1},
+			worse:  base,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if priority(tt.better, now) <= priority(tt.worse, now) {
+				t.Fatalf("bad order: want %f > %f", priority(tt.better, now), priority(tt.worse, now))
+			}
+		})
+	}
+}
+
+func TestStalenessCapped(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	if staleness(now.Add(-maxStaleness), now) != staleness(now.AddDate(-1, 0, 0), now) {
+		t.Fatal("the staleness should stop growing after maxStaleness")
+	}
+	if staleness(now.Add(time.Hour), now) != 0 {
+		t.Fatal("pages can't be stale before now")
+	}
+}
+
+// The score stored and claimed in Postgres must be the one of the in-memory controller. It
+// runs against a real database and is skipped unless TEST_POSTGRES_URI is set.
+func TestPrioritySQL(t *testing.T) {
+	pgURI, ok := os.LookupEnv("TEST_POSTGRES_URI")
+	if !ok {
+		t.Skip("TEST_POSTGRES_URI is not set")
+	}
+	ctx := context.Background()
+	migrator, err := NewMigrator(ctx, pgURI)
+	if err != nil {
+		t.Fatalf("failed to connect to the database: %s", err)
+	}
+	err = migrator.Up(ctx)
+	if err != nil {
+		t.Fatalf("failed to migrate the database: %s", err)
+	}
+
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]pageStats{
+		"new page":       {Depth: unknownDepth, StaleSince: now, SitemapPriority: defaultSitemapPriority},
+		"seed":           {Depth: 0, HostVisits: 3, HostSuccesses: 1, StaleSince: now.Add(-time.Hour), SitemapPriority: 0.9},
+		"linked":         {Inlinks: 42, Depth: 3, HostVisits: 10, HostSuccesses: 9, StaleSince: now.AddDate(0, 0, -3), SitemapPriority: 0.2},
+		"stale for ever": {Inlinks: 1, Depth: 1, StaleSince: now.AddDate(-3, 0, 0), SitemapPriority: defaultSitemapPriority},
+	}
+
+	for name, stats := range tests {
+		t.Run(name, func(t *testing.T) {
+			var depth *int
+			if stats.Depth != unknownDepth {
+				depth = &stats.Depth
+			}
+			var got float64
+			err := migrator.pg.QueryRow(ctx, `
+				SELECT page_priority($1, $2, host_quality($3, $4), $5::real)
+					+ page_staleness($6::timestamp, $7::timestamp)
+			`, stats.Inlinks, depth, stats.HostVisits, stats.HostSuccesses, stats.SitemapPriority,
+				stats.StaleSince, now).Scan(&got)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if want := priority(stats, now); math.Abs(got-want) > 1e-6 {
+				t.Fatalf("the SQL score differs: want %f; got %f", want, got)
+			}
+		})
+	}
+}
+
+func TestHostQuality(t *testing.T) {
+	t.Parallel()
+	if q := hostQuality(0, 0); q != 0.5 {
+		t.Fatalf("unknown hosts should have an average quality: got %f", q)
+	}
+	if hostQuality(100, 100) <= hostQuality(1, 1) {
+		t.Fatal("more successful visits should increase the quality")
+	}
+	if hostQuality(100, 0) >= hostQuality(1, 0) {
+		t.Fatal("more failed visits should decrease the quality")
+	}
+}
@@ -0,0 +1,235 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// GraphReader gives read access to the links saved by a Controller.
+type GraphReader interface {
+	// Backlinks returns the links pointing to q.URL, ordered by source.
+	Backlinks(ctx context.Context, q LinkQuery) (*LinkPage, error)
+	// Outlinks returns the links found on q.URL, ordered by target.
+	Outlinks(ctx context.Context, q LinkQuery) (*LinkPage, error)
+}
+
+type LinkSort string
+
+const (
+	SortByID   LinkSort = "id"
+	SortByHost LinkSort = "host"
+)
+
+type LinkQuery struct {
+	URL    *url.URL // Must be normalized with commons.NormalizeUrl
+	Limit  int
+	Cursor string // Returned by a previous query, empty for the first page
+	// Sort the other end of the links by page id (the default, in order of discovery) or
+	// by host then path. Only the default order follows an index: deep pages stay cheap.
+	// The host order sorts all the links of the url on every query, its cost grows with
+	// the number of links rather than with the page size.
+	Sort LinkSort
+	// Only keep one link per host on the other end, for example to list referring domains.
+	// Like the host order, it reads all the links of the url on every query.
+	DistinctHosts bool
+	// Skip the links having any of these rel values, for example nofollow or sponsored
+	ExcludeRel []string
+}
+
+// Position of the other end of a link in the order of a query, it is also what the
+// cursors point to. Hosts are reversed so that subdomains are grouped with their parent
+// domain.
+type linkKey struct {
+	ID           int64  `json:"i,omitempty"`
+	HostReversed string `json:"h,omitempty"`
+	Path         string `json:"p,omitempty"`
+}
+
+// Key of the other end of a link, reduced to the columns of the order of the query
+func (q LinkQuery) key(id int64, other *url.URL) linkKey {
+	switch {
+	case q.DistinctHosts:
+		return linkKey{HostReversed: commons.ReverseHostname(other.Hostname())}
+	case q.Sort == SortByHost:
+		return linkKey{ID: id, HostReversed: commons.ReverseHostname(other.Hostname()), Path: other.Path}
+	}
+	return linkKey{ID: id}
+}
+
+// Order of the keys, the fields that are not part of the order of the query are zero
+func (k linkKey) compare(other linkKey) int {
+	return cmp.Or(
+		cmp.Compare(k.HostReversed, other.HostReversed),
+		cmp.Compare(k.Path, other.Path),
+		cmp.Compare(k.ID, other.ID),
+	)
+}
+
+type LinkPage struct {
+	Links []commons.Link
+	Next  string // Cursor of the next page, empty if this is the last page
+}
+
+// Cursors are opaque to the caller so that the pagination key can change with the schema
+func encodeCursor(key linkKey) string {
+	raw, _ := json.Marshal(key)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(cursor string) (linkKey, error) {
+	key := linkKey{}
+	if cursor == "" {
+		return key, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return key, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	err = json.Unmarshal(raw, &key)
+	if err != nil {
+		return key, fmt.Errorf("%w: %s", ErrInvalidCursor, err)
+	}
+	return key, nil
+}
+
+// PostgresGraphReader is a read-only access to the graph: unlike the PostgresController
+// it never claims pages so it can run alongside crawlers.
+type PostgresGraphReader struct {
+	pg *pgxpool.Pool
+}
+
+func NewPostgresGraphReader(ctx context.Context, pgURI string) (*PostgresGraphReader, error) {
+	pg, err := openPool(ctx, pgURI, false)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresGraphReader{pg: pg}, nil
+}
+
+func (r *PostgresGraphReader) Backlinks(ctx context.Context, q LinkQuery) (*LinkPage, error) {
+	return r.queryLinks(ctx, q, "target_id", "source_id")
+}
+
+func (r *PostgresGraphReader) Outlinks(ctx context.Context, q LinkQuery) (*LinkPage, error) {
+	return r.queryLinks(ctx, q, "source_id", "target_id")
+}
+
+// Query the links where the column match is the id of q.URL and paginate on the pages
+// referenced by the column other. The default order is the one of the index on (match,
+// other) so each page only reads the rows it returns. The host order and the distinct
+// hosts are on columns of pages: all the links of q.URL are joined and sorted before the
+// keyset applies, the keyset only saves the rows skipped by an offset.
+func (r *PostgresGraphReader) queryLinks(ctx context.Context, q LinkQuery, match string, other string) (*LinkPage, error) {
+	after, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	excludeRel := q.ExcludeRel
+	if excludeRel == nil {
+		excludeRel = []string{}
+	}
+
+	var distinct, keyset, order string
+	args := []any{commons.ReverseHostname(q.URL.Hostname()), q.URL.Path, excludeRel}
+	switch {
+	case q.DistinctHosts:
+		distinct = "DISTINCT ON (page.host_reversed)"
+		keyset = "page.host_reversed > $4"
+		order = "page.host_reversed, page.path, page.id"
+		args = append(args, after.HostReversed)
+	case q.Sort == SortByHost:
+		keyset = "(page.host_reversed, page.path, page.id) > ($4, $5, $6)"
+		order = "page.host_reversed, page.path, page.id"
+		args = append(args, after.HostReversed, after.Path, after.ID)
+	default:
+		keyset = fmt.Sprintf("links.%s > $4", other)
+		order = "links." + other
+		args = append(args, after.ID)
+	}
+	// We fetch one more row than asked to know if there is a next page
+	args = append(args, q.Limit+1)
+
+	stmt := fmt.Sprintf(`
+		SELECT %[3]s
+			page.id,
+			page.scheme,
+			page.host_reversed,
+			page.path,
+			COALESCE(links.anchor_text, '') AS anchor_text,
+			COALESCE(links.rel, '{}') AS rel,
+			COALESCE(links.title, '') AS title,
+			COALESCE(links.position, 0) AS position
+		FROM links
+		JOIN pages AS page ON page.id = links.%[2]s
+		WHERE links.%[1]s = (SELECT id FROM pages WHERE host_reversed = $1 AND path = $2)
+		AND NOT COALESCE(links.rel, '{}') && $3
+		AND %[4]s
+		ORDER BY %[5]s
+		LIMIT $%[6]d;
+	`, match, other, distinct, keyset, order, len(args))
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	rows, err := r.pg.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query links: %w", err)
+	}
+	backlinks := match == "target_id"
+	keys := make([]linkKey, 0, q.Limit+1)
+	links, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (commons.Link, error) {
+		var id int64
+		var scheme, hostReversed, path string
+		link := commons.Link{}
+		err := row.Scan(&id, &scheme, &hostReversed, &path, &link.Text, &link.Rel, &link.Title, &link.Position)
+		if err != nil {
+			return link, err
+		}
+		otherURL, err := url.Parse(scheme + "://" + commons.ReverseHostname(hostReversed) + path)
+		if err != nil {
+			return link, err
+		}
+		if backlinks {
+			link.From, link.To = otherURL, q.URL
+		} else {
+			link.From, link.To = q.URL, otherURL
+		}
+		keys = append(keys, q.key(id, otherURL))
+		return link, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to scan links: %w", err)
+	}
+	return newLinkPage(q, links, keys), nil
+}
+
+// Build the page from links in the order of the query and their keys, there must be up
+// to q.Limit+1 of them to know if there is a next page.
+func newLinkPage(q LinkQuery, links []commons.Link, keys []linkKey) *LinkPage {
+	page := &LinkPage{Links: links}
+	if len(links) > q.Limit {
+		page.Links = links[:q.Limit]
+		page.Next = encodeCursor(keys[q.Limit-1])
+	}
+	return page
+}
+
+// The end of the link that is not the queried url
+func otherEnd(link commons.Link, backlinks bool) *url.URL {
+	if backlinks {
+		return link.From
+	}
+	return link.To
+}
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"math"
+	"time"
+)
+
+// RevisitPolicy decides when a visited page is crawled again. The interval between two
+// visits adapts to how often the page changes: it is halved when the content changed
+// since the previous visit and grows by half when it did not, always staying between Min
+// and Max. The zero value never revisits pages.
+//
+// It must be kept in sync with the next_revisit_seconds SQL function of the migrations.
+type RevisitPolicy struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+// Interval returns the time to wait before the next visit of a page given the previous
+// interval (0 after the first visit) and the content hashes of the two latest visits (0
+// if unknown). It returns 0 if the page must not be revisited.
+func (p RevisitPolicy) Interval(previous time.Duration, oldHash uint64, newHash uint64) time.Duration {
+	if p.Max <= 0 {
+		return 0
+	}
+
+	var seconds float64
+	switch {
+	case previous == 0:
+		// Intervals change by a factor so we start in the middle on a log scale
+		seconds = math.Sqrt(p.Min.Seconds() * p.Max.Seconds())
+	case oldHash == 0 || newHash == 0:
+		seconds = previous.Seconds()
+	case oldHash != newHash:
+		seconds = previous.Seconds() / 2
+	default:
+		seconds = previous.Seconds() * 1.5
+	}
+	seconds = max(p.Min.Seconds(), min(p.Max.Seconds(), seconds))
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Delay returns the time to wait before the next visit given the interval returned by
+// Interval and how long the latest response is fresh according to its headers. Visiting
+// a page before it expires is pointless but the maximum interval still applies.
+//
+// It must be kept in sync with the revisit_delay_seconds SQL function of the migrations.
+func (p RevisitPolicy) Delay(interval time.Duration, maxAge time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	return min(p.Max, max(interval, maxAge))
+}
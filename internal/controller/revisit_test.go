@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRevisitPolicyInterval(t *testing.T) {
+	t.Parallel()
+	policy := RevisitPolicy{Min: time.Hour, Max: 16 * time.Hour}
+
+	tests := map[string]struct {
+		previous time.Duration
+		oldHash  uint64
+		newHash  uint64
+		expect   time.Duration
+	}{
+		"first visit":        {previous: 0, oldHash: 0, newHash: 1, expect: 4 * time.Hour},
+		"changed":            {previous: 4 * time.Hour, oldHash: 1, newHash: 2, expect: 2 * time.Hour},
+		"unchanged":          {previous: 4 * time.Hour, oldHash: 1, newHash: 1, expect: 6 * time.Hour},
+		"unknown hash":       {previous: 4 * time.Hour, oldHash: 1, newHash: 0, expect: 4 * time.Hour},
+		"clamped to the min": {previous: time.Hour, oldHash: 1, newHash: 2, expect: time.Hour},
+		"clamped to the max": {previous: 15 * time.Hour, oldHash: 1, newHash: 1, expect: 16 * time.Hour},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := policy.Interval(tt.previous, tt.oldHash, tt.newHash)
+			if got != tt.expect {
+				t.Fatalf("bad interval: want %s; got %s", tt.expect, got)
+			}
+		})
+	}
+}
+
+func TestRevisitPolicyDisabled(t *testing.T) {
+	t.Parallel()
+	if got := (RevisitPolicy{}).Interval(time.Hour, 1, 2); got != 0 {
+		t.Fatalf("the zero policy should never revisit: got %s", got)
+	}
+}
+
+func TestRevisitPolicyDelay(t *testing.T) {
+	t.Parallel()
+	policy := RevisitPolicy{Min: time.Hour, Max: 16 * time.Hour}
+
+	tests := map[string]struct {
+		interval time.Duration
+		maxAge   time.Duration
+		expect   time.Duration
+	}{
+		"unknown freshness":     {interval: 4 * time.Hour, maxAge: 0, expect: 4 * time.Hour},
+		"expires earlier":       {interval: 4 * time.Hour, maxAge: time.Hour, expect: 4 * time.Hour},
+		"expires later":         {interval: 4 * time.Hour, maxAge: 8 * time.Hour, expect: 8 * time.Hour},
+		"clamped to the max":    {interval: 4 * time.Hour, maxAge: 48 * time.Hour, expect: 16 * time.Hour},
+		"revisits are disabled": {interval: 0, maxAge: time.Hour, expect: 0},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			got := policy.Delay(tt.interval, tt.maxAge)
+			if got != tt.expect {
+				t.Fatalf("bad delay: want %s; got %s", tt.expect, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/robot"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresRobotStore implements robot.RobotStore with the robots table.
+type PostgresRobotStore struct {
+	pg *pgxpool.Pool
+}
+
+func NewPostgresRobotStore(ctx context.Context, pgURI string) (*PostgresRobotStore, error) {
+	pg, err := openPool(ctx, pgURI, false)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresRobotStore{pg: pg}, nil
+}
+
+func (s *PostgresRobotStore) Load(ctx context.Context, scheme string, hostname string) (*robot.Robots, error) {
+	query := `
+		SELECT body, status, fetched_at
+		FROM robots
+		WHERE host_reversed = $1 AND scheme = $2;
+	`
+	var body string
+	var status int16
+	var fetchedAt time.Time
+	err := s.pg.QueryRow(ctx, query, commons.ReverseHostname(hostname), scheme).Scan(&body, &status, &fetchedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to select robot.txt: %w", err)
+	}
+	return &robot.Robots{Body: body, Status: int(status), FetchedAt: fetchedAt}, nil
+}
+
+// Save keeps the most recent robots.txt when several processes fetch it at the same time.
+func (s *PostgresRobotStore) Save(ctx context.Context, scheme string, hostname string, robots robot.Robots) error {
+	query := `
+		INSERT INTO robots (host_reversed, scheme, body, status, fetched_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (host_reversed, scheme) DO UPDATE
+		SET body = EXCLUDED.body, status = EXCLUDED.status, fetched_at = EXCLUDED.fetched_at
+		WHERE robots.fetched_at < EXCLUDED.fetched_at;
+	`
+	_, err := s.pg.Exec(
+		ctx, query, commons.ReverseHostname(hostname), scheme, robots.Body, robots.Status, robots.FetchedAt.UTC(),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to save robot.txt: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"container/heap"
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// hostScheduler hands out urls so that a host is never crawled more than once per delay,
+// like the back queues of Mercator: every host has its own queue, ordered by priority,
+// and a heap orders the hosts by the time they can be crawled again. Pop only takes urls
+// from hosts that are due so the crawler goroutines are spread over many hosts instead of
+// waiting on the rate limiter of a single one.
+//
+// An url is queued at most once: pushing it again only raises its priority and extends
+// its expiry. Expired urls are dropped instead of being returned, their lease is over so
+// they may already have been handed out to another crawler.
+type hostScheduler struct {
+	mu     sync.Mutex
+	delay  time.Duration
+	hosts  map[string]*hostQueue
+	ready  hostHeap
+	queued map[string]*scheduledPage
+	seq    int
+	wakeup chan struct{}
+}
+
+type hostQueue struct {
+	host  string
+	pages pageHeap
+	next  time.Time // Time at which the host can be crawled again
+}
+
+type scheduledPage struct {
+	url      *url.URL
+	priority float64
+	seq      int       // Pages of equal priority are returned in the order they were pushed
+	expires  time.Time // Zero if the page never expires
+	index    int       // Position in the heap of its host
+}
+
+func newHostScheduler(delay time.Duration) *hostScheduler {
+	return &hostScheduler{
+		delay:  delay,
+		hosts:  make(map[string]*hostQueue),
+		ready:  make(hostHeap, 0),
+		queued: make(map[string]*scheduledPage),
+		wakeup: make(chan struct{}, 1),
+	}
+}
+
+// Push adds an url to the queue of its host, the pages with the highest priority of a
+// host are returned first.
+func (s *hostScheduler) Push(u *url.URL, priority float64) {
+	s.PushUntil(u, priority, time.Time{})
+}
+
+// PushUntil adds an url that is dropped if it is not returned before expires, like a
+// leased page.
+func (s *hostScheduler) PushUntil(u *url.URL, priority float64, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q, ok := s.hosts[u.Hostname()]
+	if !ok {
+		q = &hostQueue{host: u.Hostname(), next: time.Now()}
+		s.hosts[q.host] = q
+		heap.Push(&s.ready, q)
+	}
+	if page, ok := s.queued[u.String()]; ok {
+		page.priority = max(page.priority, priority)
+		if expires.IsZero() || (!page.expires.IsZero() && expires.After(page.expires)) {
+			page.expires = expires
+		}
+		heap.Fix(&q.pages, page.index)
+		return
+	}
+	page := &scheduledPage{url: u, priority: priority, seq: s.seq, expires: expires}
+	heap.Push(&q.pages, page)
+	s.queued[u.String()] = page
+	s.seq++
+	s.notify()
+}
+
+// Pop blocks until at least one host is due and returns the next url of up to max due
+// hosts. It returns nil once the context is canceled.
+func (s *hostScheduler) Pop(ctx context.Context, max int) []*url.URL {
+	for {
+		urls, wait := s.popDue(max)
+		if len(urls) > 0 {
+			return urls
+		}
+
+		// Without any host we can only be woken up by Push
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.wakeup:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// Take the urls of the due hosts, if there are none it returns how long to wait for the
+// next host to be due or -1 if there are no hosts at all.
+func (s *hostScheduler) popDue(max int) ([]*url.URL, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	urls := make([]*url.URL, 0, max)
+	for len(urls) < max && s.ready.Len() > 0 && !s.ready[0].next.After(now) {
+		q := s.ready[0]
+		if q.pages.Len() == 0 {
+			// The host stayed idle for a whole delay so there is no need to remember it
+			heap.Pop(&s.ready)
+			delete(s.hosts, q.host)
+			continue
+		}
+		page := heap.Pop(&q.pages).(*scheduledPage)
+		delete(s.queued, page.url.String())
+		if !page.expires.IsZero() && page.expires.Before(now) {
+			continue
+		}
+		urls = append(urls, page.url)
+		q.next = now.Add(s.delay)
+		heap.Fix(&s.ready, 0)
+	}
+
+	if len(urls) > 0 {
+		if len(s.queued) > 0 {
+			s.notify() // Let another waiting goroutine check the remaining hosts
+		}
+		return urls, 0
+	}
+	if s.ready.Len() == 0 {
+		return nil, -1
+	}
+	return nil, s.ready[0].next.Sub(now)
+}
+
+// Len returns the number of urls waiting in the scheduler.
+func (s *hostScheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queued)
+}
+
+// Wake up a goroutine waiting in Pop without ever blocking. Must be called with the lock
+// held.
+func (s *hostScheduler) notify() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// hostHeap implements heap.Interface, the host that can be crawled the soonest is first.
+type hostHeap []*hostQueue
+
+func (h hostHeap) Len() int { return len(h) }
+
+func (h hostHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+
+func (h hostHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *hostHeap) Push(x any) { *h = append(*h, x.(*hostQueue)) }
+
+func (h *hostHeap) Pop() any {
+	old := *h
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return q
+}
+
+// pageHeap implements heap.Interface, the page with the highest priority is first.
+type pageHeap []*scheduledPage
+
+func (h pageHeap) Len() int { return len(h) }
+
+func (h pageHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h pageHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *pageHeap) Push(x any) {
+	page := x.(*scheduledPage)
+	page.index = len(*h)
+	*h = append(*h, page)
+}
+
+func (h *pageHeap) Pop() any {
+	old := *h
+	page := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return page
+}
@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+func urlStrings(urls []*url.URL) []string {
+	strs := make([]string, 0, len(urls))
+	for _, u := range urls {
+		strs = append(strs, u.String())
+	}
+	return strs
+}
+
+func TestHostSchedulerOneURLPerDueHost(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newHostScheduler(time.Hour)
+
+	s.Push(mustParse(t, "http://a.com/1"), 0)
+	s.Push(mustParse(t, "http://a.com/2"), 0)
+	s.Push(mustParse(t, "http://b.com/1"), 0)
+	s.Push(mustParse(t, "http://c.com/1"), 0)
+
+	urls := s.Pop(ctx, 10)
+	if len(urls) != 3 {
+		t.Fatalf("bad number of pages: want one per host; got %s", urlStrings(urls))
+	}
+	seen := make(map[string]bool)
+	for _, u := range urls {
+		if seen[u.Hostname()] {
+			t.Fatalf("host %s was returned twice: got %s", u.Hostname(), urlStrings(urls))
+		}
+		seen[u.Hostname()] = true
+		if u.Hostname() == "a.com" && u.Path != "/1" {
+			t.Fatalf("pages of a host are not returned in order: got %s", u)
+		}
+	}
+	if s.Len() != 1 {
+		t.Fatalf("bad number of waiting pages: want 1; got %d", s.Len())
+	}
+}
+
+func TestHostSchedulerWaitForHostDelay(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	delay := 50 * time.Millisecond
+	s := newHostScheduler(delay)
+
+	s.Push(mustParse(t, "http://a.com/1"), 0)
+	s.Push(mustParse(t, "http://a.com/2"), 0)
+	t0 := time.Now()
+	first := s.Pop(ctx, 10)
+	second := s.Pop(ctx, 10)
+	elapsed := time.Since(t0)
+
+	if len(first) != 1 || len(second) != 1 || second[0].Path != "/2" {
+		t.Fatalf("bad pages: got %s then %s", urlStrings(first), urlStrings(second))
+	}
+	if elapsed < delay {
+		t.Fatalf("the host was returned again before its delay: after %s", elapsed)
+	}
+}
+
+func TestHostSchedulerHighestPriorityFirst(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newHostScheduler(0)
+
+	s.Push(mustParse(t, "http://a.com/low"), 1)
+	s.Push(mustParse(t, "http://a.com/high"), 3)
+	s.Push(mustParse(t, "http://a.com/medium"), 2)
+
+	urls := s.Pop(ctx, 1)
+	urls = append(urls, s.Pop(ctx, 1)...)
+	urls = append(urls, s.Pop(ctx, 1)...)
+	got := urlStrings(urls)
+	expect := []string{"http://a.com/high", "http://a.com/medium", "http://a.com/low"}
+	if !slices.Equal(got, expect) {
+		t.Fatalf("bad order: want %s; got %s", expect, got)
+	}
+}
+
+func TestHostSchedulerOtherHostsAreNotDelayed(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newHostScheduler(time.Hour)
+
+	s.Push(mustParse(t, "http://a.com/1"), 0)
+	s.Push(mustParse(t, "http://a.com/2"), 0)
+	s.Pop(ctx, 10)
+
+	result := make(chan []*url.URL)
+	go func() { result <- s.Pop(ctx, 10) }()
+	s.Push(mustParse(t, "http://b.com/1"), 0)
+
+	select {
+	case urls := <-result:
+		if len(urls) != 1 || urls[0].Hostname() != "b.com" {
+			t.Fatalf("only the new host should be due: got %s", urlStrings(urls))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop was not woken up by a new host")
+	}
+}
+
+func TestHostSchedulerStopOnCancel(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newHostScheduler(time.Hour)
+
+	s.Push(mustParse(t, "http://a.com/1"), 0)
+	s.Push(mustParse(t, "http://a.com/2"), 0)
+	s.Pop(ctx, 10)
+
+	result := make(chan []*url.URL)
+	go func() { result <- s.Pop(ctx, 10) }()
+	cancel()
+
+	select {
+	case urls := <-result:
+		if urls != nil {
+			t.Fatalf("Pop should return nil once canceled: got %s", urlStrings(urls))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pop was not stopped by the context")
+	}
+}
+
+func TestHostSchedulerDeduplicate(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newHostScheduler(0)
+
+	s.Push(mustParse(t, "http://a.com/1"), 0)
+	s.Push(mustParse(t, "http://a.com/2"), 1)
+	// A page claimed again after its lease expired is only queued once, at its best priority
+	s.Push(mustParse(t, "http://a.com/1"), 2)
+	if s.Len() != 2 {
+		t.Fatalf("bad number of waiting pages: want 2; got %d", s.Len())
+	}
+
+	// Without delay the pages of a host are all due at once
+	got := s.Pop(ctx, 10)
+	if !slices.Equal(urlStrings(got), []string{"http://a.com/1", "http://a.com/2"}) {
+		t.Fatalf("bad pages: got %s", urlStrings(got))
+	}
+	if s.Len() != 0 {
+		t.Fatalf("the scheduler should be empty: got %d pages", s.Len())
+	}
+}
+
+func TestHostSchedulerDropExpired(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newHostScheduler(0)
+
+	s.PushUntil(mustParse(t, "http://a.com/expired"), 1, time.Now().Add(-time.Second))
+	s.PushUntil(mustParse(t, "http://a.com/leased"), 0, time.Now().Add(time.Hour))
+
+	urls := s.Pop(ctx, 10)
+	if !slices.Equal(urlStrings(urls), []string{"http://a.com/leased"}) {
+		t.Fatalf("expired pages should be dropped: got %s", urlStrings(urls))
+	}
+}
@@ -1,43 +1,60 @@
 package crawler
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log/slog"
-	"maps"
 	"net/http"
 	"net/url"
 	"slices"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/PuerkitoBio/goquery"
 	clientpkg "github.com/TheBigRoomXXL/backlinks-engine/internal/client"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
 	controllerpkg "github.com/TheBigRoomXXL/backlinks-engine/internal/controller"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/feed"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/politeness"
 	robotpkg "github.com/TheBigRoomXXL/backlinks-engine/internal/robot"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/sitemap"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/telemetry"
-	"golang.org/x/time/rate"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/websub"
 )
 
+// Number of goroutines polling the feeds, besides the ones crawling the pages
+const feedPollers = 4
+
+// Larger bodies of HTML pages are truncated, sitemaps can be up to sitemap.MaxSize
+const maxPageSize = 5 * 1024 * 1024
+
 type Crawler struct {
 	ctx             context.Context
-	controller      *controllerpkg.Controller
+	controller      controllerpkg.Controller
 	fetcher         clientpkg.Fetcher
 	robot           robotpkg.RobotPolicy
 	concurencyLimit int
-	rateLimiters    *sync.Map
-	rateLimit       rate.Limit
+	limiters        *politeness.Limiters
+	origins         *sync.Map // Scheme and host of the pages already crawled
+	sitemapUrls     *sync.Map // Urls discovered as sitemaps, whatever their content type
+	sitemaps        *sitemap.Processor
+	subscriber      *websub.Subscriber // Nil if WebSub is disabled
 }
 
 func NewCrawler(
 	ctx context.Context,
-	controller *controllerpkg.Controller,
+	controller controllerpkg.Controller,
 	fetcher clientpkg.Fetcher,
 	robot robotpkg.RobotPolicy,
 	max_concurency int,
-	rateLimit rate.Limit,
+	limiters *politeness.Limiters,
+	subscriber *websub.Subscriber,
 ) *Crawler {
 
 	return &Crawler{
@@ -46,8 +63,11 @@ func NewCrawler(
 		fetcher:         fetcher,
 		robot:           robot,
 		concurencyLimit: max_concurency,
-		rateLimiters:    &sync.Map{},
-		rateLimit:       rateLimit,
+		limiters:        limiters,
+		origins:         &sync.Map{},
+		sitemapUrls:     &sync.Map{},
+		sitemaps:        sitemap.NewProcessor(ctx, fetcher, controller),
+		subscriber:      subscriber,
 	}
 }
 
@@ -59,6 +79,9 @@ func (c *Crawler) Run() error {
 	for i := 0; i < c.concurencyLimit; i++ {
 		go c.crawlPages()
 	}
+	for i := 0; i < feedPollers; i++ {
+		go c.pollFeeds()
+	}
 
 	<-c.ctx.Done()
 	return nil
@@ -67,6 +90,9 @@ func (c *Crawler) Run() error {
 func (c *Crawler) crawlPages() error {
 	for {
 		urls := c.controller.Next()
+		if c.ctx.Err() != nil {
+			return nil
+		}
 		for _, url := range urls {
 			select {
 			case <-c.ctx.Done():
@@ -83,104 +109,323 @@ func (c *Crawler) crawlPage(pageUrl *url.URL) {
 	defer func() { telemetry.PageProcessDuration.Observe(time.Since(t0).Seconds()) }()
 	defer telemetry.ProcessedURL.Add(1)
 
+	// Whatever happens, the outcome of this attempt is reported to the controller
+	visit := &commons.Visit{URL: pageUrl}
+	defer func() {
+		if visit == nil {
+			return
+		}
+		// A page that is gone or can no longer be crawled has no links anymore
+		if isDefinitiveFailure(visit) {
+			c.controller.Add(&commons.LinkGroup{From: pageUrl})
+		}
+		c.controller.Report(visit)
+	}()
+
 	isAllowed := c.robot.IsAllowed(pageUrl)
 
+	// The robots.txt could not be fetched because the crawler is shutting down
+	if c.ctx.Err() != nil {
+		visit = nil
+		return
+	}
 	if !isAllowed {
+		visit.Failure = commons.FailureRobotsDisallowed
 		return
 	}
+	c.discoverOrigin(pageUrl)
+	_, knownSitemap := c.sitemapUrls.Load(pageUrl.String())
 
-	err := c.WaitForRateLimit("HEAD", pageUrl.Host)
+	// A page with validators was crawled successfully before, so instead of checking it
+	// with a HEAD request we ask for its content only if it changed.
+	pageUrlStr := pageUrl.String()
+	validators := c.controller.Validators(pageUrl)
+	if validators.IsZero() {
+		result, err := c.fetcher.Fetch(c.ctx, clientpkg.FetchRequest{Method: "HEAD", URL: pageUrlStr})
+		if err != nil {
+			visit = c.fetchFailed(visit, result)
+			return
+		}
+		visit.Status = result.Status
+		visit.ContentType = result.Header.Get("content-type")
+
+		if failure, err := isResponsesCrawlable(result, knownSitemap); err != nil {
+			slog.Warn(fmt.Sprintf("uncrawlable response from HEAD %s: %s", pageUrlStr, err))
+			visit.Failure = failure
+			visit.RetryAfter, _ = clientpkg.RetryAfter(result.Status, result.Header)
+			return
+		}
+	}
+
+	// Sitemaps are recognized by the way they were discovered or by the content type of
+	// the HEAD response, the ones that could not be are fetched again once known.
+	maxBodySize := int64(maxPageSize)
+	if knownSitemap || isSitemap(pageUrl, visit.ContentType) {
+		maxBodySize = sitemap.MaxSize
+	}
+	request := clientpkg.FetchRequest{URL: pageUrlStr, Validators: validators, MaxBodySize: maxBodySize}
+	result, err := c.fetcher.Fetch(c.ctx, request)
+	if err == nil && result.Truncated && maxBodySize < sitemap.MaxSize && isSitemap(result.URL, result.Header.Get("content-type")) {
+		request.MaxBodySize = sitemap.MaxSize
+		result, err = c.fetcher.Fetch(c.ctx, request)
+	}
 	if err != nil {
-		slog.Error(fmt.Sprintf("error while waiting for rate limit: %s", err))
+		visit = c.fetchFailed(visit, result)
+		return
+	}
+	visit.Status = result.Status
+	visit.ContentType = result.Header.Get("content-type")
+	visit.Validators = clientpkg.ValidatorsOf(result.Header)
+	visit.MaxAge = clientpkg.MaxAge(result.Header)
+	visit.Duration = result.Timings.Total
+
+	// The links saved by the previous visit are still valid
+	if result.Status == http.StatusNotModified && !validators.IsZero() {
+		visit.NotModified = true
 		return
 	}
 
-	pageUrlStr := pageUrl.String()
-	resp, err := c.fetcher.Head(pageUrlStr)
-	if err != nil {
-		slog.Error(err.Error())
+	// We double check in case the HEAD response was not representative
+	if failure, err := isResponsesCrawlable(result, knownSitemap); err != nil {
+		slog.Warn(fmt.Sprintf("uncrawlable response from GET %s: %s", pageUrlStr, err))
+		visit.Failure = failure
+		visit.RetryAfter, _ = clientpkg.RetryAfter(result.Status, result.Header)
 		return
 	}
-	resp.Body.Close()
 
-	if resp.StatusCode == 429 {
-		c.IncreaseRateLimit(pageUrl.Host)
+	body := result.Body
+	visit.Size = int64(len(body))
+	if result.Truncated {
+		slog.Warn(fmt.Sprintf("body of %s was truncated to %d bytes", pageUrlStr, request.MaxBodySize))
 	}
+	hash := fnv.New64a()
+	hash.Write(body)
+	visit.Hash = hash.Sum64()
 
-	if err := isResponsesCrawlable(resp); err != nil {
-		slog.Warn(fmt.Sprintf("uncrawlable response from HEAD %s: %s", pageUrlStr, err))
+	if knownSitemap || isSitemap(result.URL, visit.ContentType) {
+		c.crawlSitemap(visit, body)
 		return
 	}
 
-	resp, err = c.fetcher.Get(pageUrlStr)
+	links, feeds, err := extractLinks(result.URL, bytes.NewReader(body))
 	if err != nil {
 		slog.Error(err.Error())
+		visit.Failure = commons.FailureParseError
 		return
 	}
-	defer resp.Body.Close()
 
-	// We double check in case the HEAD response was not representative
-	if err := isResponsesCrawlable(resp); err != nil {
-		slog.Warn(fmt.Sprintf("uncrawlable response from GET %s: %s", pageUrlStr, err))
+	// Only the first link to each target is kept
+	linkSet := make(map[string]struct{})
+	group := &commons.LinkGroup{From: pageUrl, Links: make([]commons.Link, 0, len(links)), Feeds: feeds}
+	for _, link := range links {
+		if _, ok := linkSet[link.To.String()]; ok {
+			continue
+		}
+		linkSet[link.To.String()] = struct{}{}
+		link.From = pageUrl
+		group.Links = append(group.Links, link)
+	}
+
+	c.controller.Add(group)
+}
+
+func (c *Crawler) pollFeeds() error {
+	for {
+		urls := c.controller.NextFeeds()
+		if c.ctx.Err() != nil {
+			return nil
+		}
+		for _, url := range urls {
+			select {
+			case <-c.ctx.Done():
+				return nil
+			default:
+				c.pollFeed(url)
+			}
+		}
+	}
+}
+
+// Fetch a feed and hint its entries to the controller as fresh pages. If the feed is
+// published to a WebSub hub, we subscribe to it to get the new entries without delay.
+func (c *Crawler) pollFeed(feedUrl *url.URL) {
+	// Whatever happens, the outcome of this attempt is reported to the controller
+	visit := &commons.Visit{URL: feedUrl}
+	defer func() {
+		if visit != nil {
+			c.controller.ReportFeed(visit)
+		}
+	}()
+
+	isAllowed := c.robot.IsAllowed(feedUrl)
+	if c.ctx.Err() != nil {
+		visit = nil // The crawler is shutting down
+		return
+	}
+	if !isAllowed {
+		visit.Failure = commons.FailureRobotsDisallowed
 		return
 	}
+	c.discoverOrigin(feedUrl)
 
-	links, err := extractLinks(resp)
+	result, err := c.fetcher.Fetch(c.ctx, clientpkg.FetchRequest{URL: feedUrl.String(), MaxBodySize: feed.MaxSize})
 	if err != nil {
-		slog.Error(err.Error())
+		visit = c.fetchFailed(visit, result)
 		return
 	}
+	visit.Status = result.Status
+	visit.ContentType = result.Header.Get("content-type")
 
-	linkSet := make(map[string]*url.URL)
-	for _, link := range links {
-		linkSet[link.String()] = link
+	if result.Status < 200 || result.Status > 299 || result.Status == 204 {
+		slog.Warn(fmt.Sprintf("feed %s has bad status %d", feedUrl, result.Status))
+		visit.Failure = commons.FailureBadStatus
+		return
 	}
 
-	c.controller.Add(&commons.LinkGroup{
-		From: pageUrl,
-		To:   slices.Collect(maps.Values(linkSet)),
-	})
+	body := result.Body
+	visit.Duration = result.Timings.Total
+	visit.Size = int64(len(body))
+	hash := fnv.New64a()
+	hash.Write(body)
+	visit.Hash = hash.Sum64()
+
+	parsed, err := feed.Parse(result.URL, bytes.NewReader(body))
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to parse feed %s: %s", feedUrl, err))
+		visit.Failure = commons.FailureParseError
+		return
+	}
+	if len(parsed.Entries) > 0 {
+		c.controller.Hint(parsed.Entries)
+	}
+
+	if c.subscriber == nil {
+		return
+	}
+	hubs, topic := websub.Discover(result.Header, result.URL, parsed)
+	if len(hubs) > 0 {
+		err = c.subscriber.Subscribe(hubs[0], topic)
+		if err != nil {
+			slog.Warn(err.Error())
+		}
+	}
 }
 
-func (c *Crawler) WaitForRateLimit(method string, host string) error {
-	v, _ := c.rateLimiters.LoadOrStore(method+"-"+host, rate.NewLimiter(c.rateLimit, 1))
-	rateLimiter := v.(*rate.Limiter)
+// The first time a scheme and host is crawled, its rate limiters are created with the
+// Crawl-delay of its robots.txt when it is slower than our own rate limit, and the
+// sitemaps it lists are added to the frontier.
+func (c *Crawler) discoverOrigin(pageUrl *url.URL) {
+	_, seen := c.origins.LoadOrStore(pageUrl.Scheme+"://"+pageUrl.Host, struct{}{})
+	if seen {
+		return
+	}
 
-	return rateLimiter.Wait(c.ctx)
+	c.limiters.SetCrawlDelay(pageUrl.Host, c.robot.CrawlDelay(pageUrl))
+
+	sitemaps := c.robot.Sitemaps(pageUrl)
+	if len(sitemaps) > 0 {
+		c.seedSitemaps(sitemaps)
+	}
 }
 
-func (c *Crawler) IncreaseRateLimit(host string) {
-	v, _ := c.rateLimiters.LoadOrStore("HEAD-"+host, rate.NewLimiter(c.rateLimit, 1))
-	rateLimiter := v.(*rate.Limiter)
-	rateLimiter.SetLimit(rateLimiter.Limit() / 2) // Limit is a frequency so we divide
+// Hint the pages of a sitemap to the controller. The sitemaps listed by an index are
+// added to the frontier so that they are crawled like any other page.
+func (c *Crawler) crawlSitemap(visit *commons.Visit, body []byte) {
+	sitemaps, err := c.sitemaps.Process(visit.URL, bytes.NewReader(body))
+	if errors.Is(err, sitemap.ErrTooLarge) {
+		slog.Warn(fmt.Sprintf("sitemap %s was truncated: %s", visit.URL, err))
+	} else if err != nil {
+		slog.Error(fmt.Sprintf("failed to process sitemap %s: %s", visit.URL, err))
+		visit.Failure = commons.FailureParseError
+		return
+	}
+	if len(sitemaps) > 0 {
+		c.seedSitemaps(sitemaps)
+	}
+}
+
+// Add sitemaps to the frontier, they are remembered so that text sitemaps, which are
+// served as text/plain, are processed as sitemaps too.
+func (c *Crawler) seedSitemaps(sitemaps []*url.URL) {
+	for _, sitemap := range sitemaps {
+		c.sitemapUrls.Store(sitemap.String(), struct{}{})
+	}
+	c.controller.Seed(sitemaps)
+}
 
-	v, _ = c.rateLimiters.LoadOrStore("GET-"+host, rate.NewLimiter(c.rateLimit, 1))
-	rateLimiter = v.(*rate.Limiter)
-	rateLimiter.SetLimit(rateLimiter.Limit() / 2) // Limit is a frequency so we divide
+// Report a request that failed as a network error. It returns nil, so that nothing is
+// reported, if the request was canceled because the crawler is shutting down.
+func (c *Crawler) fetchFailed(visit *commons.Visit, result *clientpkg.FetchResult) *commons.Visit {
+	if result.Err.Kind == clientpkg.ErrorCanceled {
+		return nil
+	}
+	slog.Error(result.Err.Error())
+	visit.Failure = commons.FailureNetworkError
+	return visit
 }
 
-func isResponsesCrawlable(resp *http.Response) error {
-	if resp.StatusCode < 200 || resp.StatusCode > 299 || resp.StatusCode == 204 {
-		return fmt.Errorf("resp %s has bad status %d", resp.Request.URL, resp.StatusCode)
+// Return the reason why the response can't be crawled alongside the error. Responses
+// of known sitemaps can be text or gzip.
+func isResponsesCrawlable(result *clientpkg.FetchResult, knownSitemap bool) (commons.Failure, error) {
+	// The host asked to come back later than the client was willing to wait, the page
+	// itself may be fine
+	if after, ok := clientpkg.RetryAfter(result.Status, result.Header); ok && after > 0 {
+		return commons.FailureRetryLater, fmt.Errorf("resp %s has status %d and asks to retry after %s", result.URL, result.Status, after)
+	}
+	if result.Status < 200 || result.Status > 299 || result.Status == 204 {
+		return commons.FailureBadStatus, fmt.Errorf("resp %s has bad status %d", result.URL, result.Status)
 	}
 
-	contentType := resp.Header.Get("content-type")
-	if !strings.Contains(contentType, "html") {
-		return fmt.Errorf("resp %s has bad content-type %s", resp.Request.URL, resp.Header.Get("content-type"))
+	contentType := result.Header.Get("content-type")
+	isText := strings.Contains(strings.ToLower(contentType), "text/plain")
+	isGzip := strings.Contains(strings.ToLower(contentType), "gzip")
+	if !strings.Contains(contentType, "html") && !isSitemap(result.URL, contentType) && !(knownSitemap && (isText || isGzip)) {
+		return commons.FailureBadContentType, fmt.Errorf("resp %s has bad content-type %s", result.URL, result.Header.Get("content-type"))
 	}
 
-	robotsTags := resp.Header.Get("x-robots-tag")
+	robotsTags := result.Header.Get("x-robots-tag")
 	if strings.Contains(robotsTags, "nofollow") || strings.Contains(robotsTags, "noindex") {
-		return fmt.Errorf("resp %s has robotag %s", resp.Request.URL, robotsTags)
+		return commons.FailureXRobotsTag, fmt.Errorf("resp %s has robotag %s", result.URL, robotsTags)
 	}
-	return nil
+	return "", nil
+}
+
+// Return true if the page will not be crawlable the next time either, unlike network
+// errors or server errors that are often temporary.
+func isDefinitiveFailure(visit *commons.Visit) bool {
+	switch visit.Failure {
+	case commons.FailureBadContentType, commons.FailureXRobotsTag:
+		return true
+	case commons.FailureBadStatus:
+		return visit.Status == http.StatusNotFound || visit.Status == http.StatusGone
+	}
+	return false
 }
 
-func extractLinks(resp *http.Response) ([]*url.URL, error) {
-	links := make([]*url.URL, 0)
-	doc, err := goquery.NewDocumentFromReader(resp.Body)
+// XML documents are processed as sitemaps. Compressed sitemaps are served as gzip, like
+// any other archive, so only the ones named like a sitemap are, known sitemaps are
+// recognized by the caller.
+func isSitemap(u *url.URL, contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if strings.Contains(contentType, "html") {
+		return false
+	}
+	if strings.Contains(contentType, "gzip") {
+		path := strings.ToLower(u.Path)
+		return strings.HasSuffix(path, ".xml.gz") || strings.HasSuffix(path, ".txt.gz")
+	}
+	return strings.Contains(contentType, "xml")
+}
+
+// Maximum length in bytes of the anchor text and title we keep for each link
+const maxLinkTextLength = 256
+
+// Return the links of the page and the feeds it advertises
+func extractLinks(base *url.URL, body io.Reader) ([]commons.Link, []*url.URL, error) {
+	links := make([]commons.Link, 0)
+	doc, err := goquery.NewDocumentFromReader(body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse the HTML document: %s", err)
+		return nil, nil, fmt.Errorf("failed to parse the HTML document: %s", err)
 	}
 
 	doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
@@ -189,7 +434,7 @@ func extractLinks(resp *http.Response) ([]*url.URL, error) {
 			return
 		}
 
-		link, err := resp.Request.URL.Parse(linkRelative)
+		link, err := base.Parse(linkRelative)
 		if err != nil {
 			slog.Warn(fmt.Sprintf("failed to parse url: %s", err))
 			return
@@ -200,8 +445,52 @@ func extractLinks(resp *http.Response) ([]*url.URL, error) {
 			return
 		}
 
-		links = append(links, linkNormalized)
+		text := cleanText(s.Text())
+		if text == "" {
+			text = cleanText(s.Find("img[alt]").First().AttrOr("alt", ""))
+		}
+
+		links = append(links, commons.Link{
+			To:       linkNormalized,
+			Text:     text,
+			Rel:      strings.Fields(strings.ToLower(s.AttrOr("rel", ""))),
+			Title:    cleanText(s.AttrOr("title", "")),
+			Position: i,
+		})
+	})
+
+	feeds := make([]*url.URL, 0)
+	doc.Find("link[rel][href]").Each(func(i int, s *goquery.Selection) {
+		rel := strings.Fields(strings.ToLower(s.AttrOr("rel", "")))
+		mediaType := strings.ToLower(strings.TrimSpace(s.AttrOr("type", "")))
+		if !slices.Contains(rel, "alternate") || !slices.Contains(feed.ContentTypes, mediaType) {
+			return
+		}
+
+		feedUrl, err := base.Parse(s.AttrOr("href", ""))
+		if err != nil {
+			slog.Warn(fmt.Sprintf("failed to parse feed url: %s", err))
+			return
+		}
+		feedNormalized, err := commons.NormalizeUrl(feedUrl)
+		if err != nil {
+			return
+		}
+		feeds = append(feeds, feedNormalized)
 	})
 
-	return links, nil
+	return links, feeds, nil
+}
+
+// Collapse whitespaces and truncate the text without breaking UTF-8 characters
+func cleanText(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if len(text) <= maxLinkTextLength {
+		return text
+	}
+	text = text[:maxLinkTextLength]
+	for !utf8.ValidString(text) {
+		text = text[:len(text)-1]
+	}
+	return text
 }
@@ -0,0 +1,407 @@
+package crawler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	clientpkg "github.com/TheBigRoomXXL/backlinks-engine/internal/client"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	controllerpkg "github.com/TheBigRoomXXL/backlinks-engine/internal/controller"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/politeness"
+	robotpkg "github.com/TheBigRoomXXL/backlinks-engine/internal/robot"
+	"golang.org/x/time/rate"
+)
+
+type page struct {
+	contentType string
+	body        string
+	etag        string
+	status      int    // 200 if unset
+	retryAfter  string // Retry-After header
+}
+
+// Serve a fixed set of pages, everything else is a 404
+type sitesTransport map[string]page
+
+func (s sitesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	p, ok := s[req.URL.String()]
+	if !ok {
+		recorder.WriteHeader(404)
+	} else if p.etag != "" && req.Header.Get("If-None-Match") == p.etag {
+		recorder.Header().Set("ETag", p.etag)
+		recorder.WriteHeader(304)
+	} else {
+		recorder.Header().Set("Content-Type", p.contentType)
+		if p.etag != "" {
+			recorder.Header().Set("ETag", p.etag)
+		}
+		if p.retryAfter != "" {
+			recorder.Header().Set("Retry-After", p.retryAfter)
+		}
+		if p.status == 0 {
+			p.status = 200
+		}
+		recorder.WriteHeader(p.status)
+		if req.Method != "HEAD" {
+			recorder.WriteString(p.body)
+		}
+	}
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+func newTestCrawler(ctx context.Context, sites sitesTransport) (*Crawler, *controllerpkg.InMemoryController) {
+	controller := controllerpkg.NewInMemoryController(ctx, 0, controllerpkg.RevisitPolicy{}, 0, controllerpkg.RevisitPolicy{})
+	fetcher := clientpkg.NewFetcher(&http.Client{Transport: sites})
+	robot := robotpkg.NewInMemoryRobotPolicy(ctx, fetcher, 24*time.Hour)
+	return NewCrawler(ctx, controller, fetcher, robot, 1, politeness.NewLimiters(rate.Inf, rate.Inf, rate.Inf, rate.Inf, nil), nil), controller
+}
+
+func TestCrawlPageSuccess(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crawler, controller := newTestCrawler(ctx, sitesTransport{
+		"http://test.com": {
+			contentType: "text/html",
+			body:        `<html><body><a href="/truc">truc</a><a href="http://other.com/">other</a></body></html>`,
+		},
+	})
+
+	pageUrl := &url.URL{Scheme: "http", Host: "test.com"}
+	crawler.crawlPage(pageUrl)
+
+	visit, ok := controller.Visit(pageUrl)
+	if !ok {
+		t.Fatal("visit was not reported")
+	}
+	if visit.Status != 200 || visit.Failure != "" || visit.Hash == 0 || visit.Size == 0 {
+		t.Fatalf("bad visit: %+v", visit)
+	}
+	outlinks, err := controller.Outlinks(ctx, controllerpkg.LinkQuery{URL: pageUrl, Limit: 10})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(outlinks.Links) != 2 {
+		t.Fatalf("bad number of links: want 2; got %d", len(outlinks.Links))
+	}
+}
+
+func TestCrawlPageNotModified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crawler, controller := newTestCrawler(ctx, sitesTransport{
+		"http://test.com": {
+			contentType: "text/html",
+			body:        `<html><body><a href="/truc">truc</a></body></html>`,
+			etag:        `"v1"`,
+		},
+	})
+
+	pageUrl := &url.URL{Scheme: "http", Host: "test.com"}
+	crawler.crawlPage(pageUrl)
+	first, _ := controller.Visit(pageUrl)
+	if controller.Validators(pageUrl).ETag != `"v1"` {
+		t.Fatalf("the etag was not saved: got %+v", controller.Validators(pageUrl))
+	}
+
+	crawler.crawlPage(pageUrl)
+	visit, ok := controller.Visit(pageUrl)
+	if !ok || !visit.NotModified || visit.Status != 304 || visit.Hash != first.Hash {
+		t.Fatalf("the page should be unchanged: got %+v", visit)
+	}
+	outlinks, err := controller.Outlinks(ctx, controllerpkg.LinkQuery{URL: pageUrl, Limit: 10})
+	if err != nil || len(outlinks.Links) != 1 {
+		t.Fatalf("the links of the page should be kept: got %v, %v", outlinks, err)
+	}
+}
+
+func TestCrawlPageCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	crawler, controller := newTestCrawler(ctx, sitesTransport{
+		"http://test.com": {contentType: "text/html", body: `<html></html>`},
+	})
+	cancel()
+
+	pageUrl := &url.URL{Scheme: "http", Host: "test.com"}
+	crawler.crawlPage(pageUrl)
+	if visit, ok := controller.Visit(pageUrl); ok {
+		t.Fatalf("a page interrupted by the shutdown should not be reported: got %+v", visit)
+	}
+}
+
+func TestCrawlPageFailures(t *testing.T) {
+	tests := map[string]struct {
+		sites   sitesTransport
+		failure commons.Failure
+	}{
+		"bad status": {
+			sites:   sitesTransport{},
+			failure: commons.FailureBadStatus,
+		},
+		"bad content-type": {
+			sites:   sitesTransport{"http://test.com": {contentType: "application/pdf"}},
+			failure: commons.FailureBadContentType,
+		},
+		"gzip not named like a sitemap": {
+			sites:   sitesTransport{"http://test.com": {contentType: "application/gzip"}},
+			failure: commons.FailureBadContentType,
+		},
+		"overloaded without retry-after": {
+			sites:   sitesTransport{"http://test.com": {contentType: "text/html", status: 503}},
+			failure: commons.FailureBadStatus,
+		},
+		"overloaded with retry-after": {
+			sites:   sitesTransport{"http://test.com": {contentType: "text/html", status: 429, retryAfter: "3600"}},
+			failure: commons.FailureRetryLater,
+		},
+		"robots disallowed": {
+			sites: sitesTransport{
+				"http://test.com":            {contentType: "text/html"},
+				"http://test.com/robots.txt": {contentType: "text/plain", body: "User-agent: *\nDisallow: /"},
+			},
+			failure: commons.FailureRobotsDisallowed,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			crawler, controller := newTestCrawler(ctx, test.sites)
+
+			pageUrl := &url.URL{Scheme: "http", Host: "test.com"}
+			crawler.crawlPage(pageUrl)
+
+			visit, ok := controller.Visit(pageUrl)
+			if !ok {
+				t.Fatal("visit was not reported")
+			}
+			if visit.Failure != test.failure {
+				t.Fatalf("bad failure reason: want %s; got %s", test.failure, visit.Failure)
+			}
+		})
+	}
+}
+
+func TestCrawlPageDefinitiveFailure(t *testing.T) {
+	tests := map[string]struct {
+		page    page
+		deleted bool
+	}{
+		"gone":             {page{}, true},
+		"bad content-type": {page{contentType: "application/pdf"}, true},
+		"server error":     {page{contentType: "text/html", status: 503}, false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			sites := sitesTransport{
+				"http://test.com": {contentType: "text/html", body: `<html><body><a href="/truc">truc</a></body></html>`},
+			}
+			controller := controllerpkg.NewInMemoryController(ctx, 0, controllerpkg.RevisitPolicy{}, 1, controllerpkg.RevisitPolicy{})
+			fetcher := clientpkg.NewFetcher(&http.Client{Transport: sites})
+			robot := robotpkg.NewInMemoryRobotPolicy(ctx, fetcher, 24*time.Hour)
+			crawler := NewCrawler(ctx, controller, fetcher, robot, 1, politeness.NewLimiters(rate.Inf, rate.Inf, rate.Inf, rate.Inf, nil), nil)
+
+			pageUrl := &url.URL{Scheme: "http", Host: "test.com"}
+			crawler.crawlPage(pageUrl)
+			if test.page == (page{}) {
+				delete(sites, "http://test.com")
+			} else {
+				sites["http://test.com"] = test.page
+			}
+			crawler.crawlPage(pageUrl)
+
+			outlinks, err := controller.Outlinks(ctx, controllerpkg.LinkQuery{URL: pageUrl, Limit: 10})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if deleted := len(outlinks.Links) == 0; deleted != test.deleted {
+				t.Fatalf("bad links: want deleted %t; got %d links", test.deleted, len(outlinks.Links))
+			}
+		})
+	}
+}
+
+func TestCrawlPageRobotsDirectives(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crawler, controller := newTestCrawler(ctx, sitesTransport{
+		"http://test.com": {contentType: "text/html"},
+		"http://test.com/robots.txt": {
+			contentType: "text/plain",
+			body:        "User-agent: *\nCrawl-delay: 2\nSitemap: http://test.com/sitemap.xml",
+		},
+	})
+
+	pageUrl := &url.URL{Scheme: "http", Host: "test.com"}
+	crawler.crawlPage(pageUrl)
+
+	if crawler.limiters.Limit("GET", "test.com") != rate.Every(2*time.Second) {
+		t.Fatal("the crawl delay was not applied to the rate limiter")
+	}
+	urls := controller.Next()
+	if len(urls) != 1 || urls[0].String() != "http://test.com/sitemap.xml" {
+		t.Fatalf("the sitemap was not added to the frontier: got %s", urls)
+	}
+}
+
+func TestCrawlPageSitemap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crawler, controller := newTestCrawler(ctx, sitesTransport{
+		"http://test.com/sitemap.xml": {
+			contentType: "application/xml",
+			body:        `<urlset><url><loc>http://test.com/page</loc><priority>0.9</priority></url><url><loc>http://other.com/page</loc></url></urlset>`,
+		},
+	})
+
+	sitemapUrl := &url.URL{Scheme: "http", Host: "test.com", Path: "/sitemap.xml"}
+	crawler.crawlPage(sitemapUrl)
+
+	visit, ok := controller.Visit(sitemapUrl)
+	if !ok || visit.Failure != "" {
+		t.Fatalf("bad visit: %+v", visit)
+	}
+	urls := controller.Next()
+	if len(urls) != 1 || urls[0].String() != "http://test.com/page" {
+		t.Fatalf("the pages of the sitemap were not added to the frontier: got %s", urls)
+	}
+}
+
+func TestCrawlPageTextSitemap(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crawler, controller := newTestCrawler(ctx, sitesTransport{
+		"http://test.com":             {contentType: "text/html"},
+		"http://test.com/robots.txt":  {contentType: "text/plain", body: "Sitemap: http://test.com/sitemap.txt"},
+		"http://test.com/sitemap.txt": {contentType: "text/plain; charset=utf-8", body: "http://test.com/page\n"},
+		"http://test.com/notes.txt":   {contentType: "text/plain", body: "http://test.com/other\n"},
+	})
+
+	crawler.crawlPage(&url.URL{Scheme: "http", Host: "test.com"})
+	urls := controller.Next()
+	if len(urls) != 1 || urls[0].String() != "http://test.com/sitemap.txt" {
+		t.Fatalf("the sitemap was not added to the frontier: got %s", urls)
+	}
+	crawler.crawlPage(urls[0])
+
+	visit, ok := controller.Visit(urls[0])
+	if !ok || visit.Failure != "" {
+		t.Fatalf("bad visit: %+v", visit)
+	}
+	urls = controller.Next()
+	if len(urls) != 1 || urls[0].String() != "http://test.com/page" {
+		t.Fatalf("the pages of the sitemap were not added to the frontier: got %s", urls)
+	}
+
+	// Other text files are not sitemaps
+	notesUrl := &url.URL{Scheme: "http", Host: "test.com", Path: "/notes.txt"}
+	crawler.crawlPage(notesUrl)
+	if visit, _ := controller.Visit(notesUrl); visit.Failure != commons.FailureBadContentType {
+		t.Fatalf("bad failure reason: want %s; got %s", commons.FailureBadContentType, visit.Failure)
+	}
+}
+
+func TestPollFeed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	crawler, controller := newTestCrawler(ctx, sitesTransport{
+		"http://test.com/feed.xml": {
+			contentType: "application/rss+xml",
+			body:        `<rss><channel><item><link>/post</link></item></channel></rss>`,
+		},
+	})
+
+	feedUrl := &url.URL{Scheme: "http", Host: "test.com", Path: "/feed.xml"}
+	crawler.pollFeed(feedUrl)
+
+	urls := controller.Next()
+	if len(urls) != 1 || urls[0].String() != "http://test.com/post" {
+		t.Fatalf("the entries of the feed were not added to the frontier: got %s", urls)
+	}
+}
+
+func TestExtractFeeds(t *testing.T) {
+	base := &url.URL{Scheme: "http", Host: "test.com", Path: "/blog/"}
+	body := `<html><head>
+		<link rel="alternate" type="application/rss+xml" href="feed.xml">
+		<link rel="Alternate" type="application/atom+xml" href="http://test.com/atom.xml">
+		<link rel="alternate" type="text/html" hreflang="fr" href="/fr/">
+		<link rel="stylesheet" type="text/css" href="/style.css">
+	</head></html>`
+
+	_, feeds, err := extractLinks(base, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got := make([]string, 0, len(feeds))
+	for _, feed := range feeds {
+		got = append(got, feed.String())
+	}
+	expected := []string{"http://test.com/blog/feed.xml", "http://test.com/atom.xml"}
+	if !slices.Equal(got, expected) {
+		t.Fatalf("bad feeds: want %s; got %s", expected, got)
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	base := &url.URL{Scheme: "http", Host: "test.com", Path: "/dir/page"}
+	body := `<html><body>
+		<a href="/home">  Home
+			page </a>
+		<a href="http://other.com/x" rel="NoFollow ugc" title=" Other site ">other</a>
+		<a href="sub"><img src="logo.png" alt="Logo"></a>
+		<a href="mailto:someone@test.com">mail</a>
+	</body></html>`
+
+	links, _, err := extractLinks(base, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(links) != 3 {
+		t.Fatalf("bad number of links: want 3; got %d", len(links))
+	}
+
+	tests := []commons.Link{
+		{To: &url.URL{Scheme: "http", Host: "test.com", Path: "/home"}, Text: "Home page", Position: 0},
+		{
+			To:       &url.URL{Scheme: "http", Host: "other.com", Path: "/x"},
+			Text:     "other",
+			Rel:      []string{"nofollow", "ugc"},
+			Title:    "Other site",
+			Position: 1,
+		},
+		{To: &url.URL{Scheme: "http", Host: "test.com", Path: "/dir/sub"}, Text: "Logo", Position: 2},
+	}
+	for i, expected := range tests {
+		got := links[i]
+		if got.To.String() != expected.To.String() ||
+			got.Text != expected.Text ||
+			!slices.Equal(got.Rel, expected.Rel) ||
+			got.Title != expected.Title ||
+			got.Position != expected.Position {
+			t.Fatalf("bad link %d: want %+v; got %+v", i, expected, got)
+		}
+	}
+}
+
+func TestCleanTextTruncate(t *testing.T) {
+	text := cleanText(strings.Repeat("é", maxLinkTextLength))
+	if len(text) > maxLinkTextLength || !utf8.ValidString(text) {
+		t.Fatalf("text was not properly truncated: length %d", len(text))
+	}
+}
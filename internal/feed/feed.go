@@ -0,0 +1,288 @@
+package feed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+// Feeds are much smaller than sitemaps, larger ones are rejected and only the first
+// entries are kept.
+const (
+	MaxSize    = 10 * 1024 * 1024
+	maxEntries = 1000
+)
+
+var ErrUnknownFormat = errors.New("not an RSS, Atom or JSON feed")
+
+// ContentTypes are the media types of the feeds advertised with
+// <link rel="alternate" type="...">.
+var ContentTypes = []string{
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/feed+json",
+}
+
+// Feed is what we keep of a parsed feed
+type Feed struct {
+	Entries []*commons.PageHint // The url of the entries as fresh hints
+	Hubs    []*url.URL          // WebSub hubs the feed is published to
+	Self    *url.URL            // Canonical url of the feed, nil if it is not advertised
+}
+
+// Parse reads an RSS (0.9x, 1.0 and 2.0), Atom or JSON feed. Relative urls are resolved
+// against base, the feed url.
+func Parse(base *url.URL, body io.Reader) (*Feed, error) {
+	reader := bufio.NewReader(io.LimitReader(body, MaxSize))
+	head, _ := reader.Peek(512)
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if len(head) == 0 {
+		return nil, ErrUnknownFormat
+	}
+
+	var raw *rawFeed
+	var err error
+	if head[0] == '{' {
+		raw, err = parseJSON(reader)
+	} else {
+		raw, err = parseXML(reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &Feed{
+		Entries: make([]*commons.PageHint, 0, len(raw.entries)),
+		Hubs:    make([]*url.URL, 0, len(raw.hubs)),
+	}
+	for _, e := range raw.entries {
+		if len(feed.Entries) == maxEntries {
+			break
+		}
+		link := resolve(base, e.link)
+		if link == nil {
+			continue
+		}
+		feed.Entries = append(feed.Entries, &commons.PageHint{
+			URL:      link,
+			LastMod:  parseDate(e.date),
+			Priority: 0.5,
+			Fresh:    true,
+		})
+	}
+	// The hubs and the topic are used as they are, the normalization could break them
+	for _, hub := range raw.hubs {
+		hubUrl, err := base.Parse(strings.TrimSpace(hub))
+		if err != nil || hub == "" || (hubUrl.Scheme != "http" && hubUrl.Scheme != "https") {
+			continue
+		}
+		feed.Hubs = append(feed.Hubs, hubUrl)
+	}
+	if self, err := base.Parse(strings.TrimSpace(raw.self)); err == nil && raw.self != "" {
+		feed.Self = self
+	}
+	return feed, nil
+}
+
+// Return the normalized absolute url, nil if it is empty or invalid
+func resolve(base *url.URL, raw string) *url.URL {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	link, err := base.Parse(raw)
+	if err != nil {
+		return nil
+	}
+	link, err = commons.NormalizeUrl(link)
+	if err != nil {
+		return nil
+	}
+	return link
+}
+
+type rawFeed struct {
+	entries []entry
+	hubs    []string
+	self    string
+}
+
+type entry struct {
+	link string
+	date string
+}
+
+// The elements of the three XML formats we care about, the namespaces are ignored
+type xmlItem struct {
+	Links []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"link"`
+	GUID struct {
+		IsPermaLink string `xml:"isPermaLink,attr"`
+		Text        string `xml:",chardata"`
+	} `xml:"guid"`
+	PubDate   string `xml:"pubDate"`
+	Date      string `xml:"date"` // Dublin Core, used by RSS 1.0
+	Updated   string `xml:"updated"`
+	Published string `xml:"published"`
+}
+
+// RSS has <item> elements while Atom has <entry> elements. The hub and self links are
+// children of the Atom <feed> or of the RSS <channel> with the Atom namespace.
+func parseXML(reader io.Reader) (*rawFeed, error) {
+	decoder := xml.NewDecoder(reader)
+	decoder.Strict = false
+	root := ""
+	raw := &rawFeed{entries: make([]entry, 0)}
+	for len(raw.entries) < maxEntries {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse feed: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if root == "" {
+			root = start.Name.Local
+			if root != "rss" && root != "RDF" && root != "feed" {
+				return nil, ErrUnknownFormat
+			}
+			continue
+		}
+		if start.Name.Local == "link" {
+			// Links of the entries are decoded with them, this one belongs to the feed
+			rel, href := attr(start, "rel"), attr(start, "href")
+			switch strings.ToLower(rel) {
+			case "hub":
+				raw.hubs = append(raw.hubs, href)
+			case "self":
+				raw.self = href
+			}
+			continue
+		}
+		if start.Name.Local != "item" && start.Name.Local != "entry" {
+			continue
+		}
+
+		item := xmlItem{}
+		err = decoder.DecodeElement(&item, &start)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse feed: %w", err)
+		}
+		raw.entries = append(raw.entries, entry{link: itemLink(item), date: firstNonEmpty(item.Updated, item.Published, item.PubDate, item.Date)})
+	}
+	if root == "" {
+		return nil, ErrUnknownFormat
+	}
+	return raw, nil
+}
+
+func attr(element xml.StartElement, name string) string {
+	for _, a := range element.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Atom links are in the href of the alternate link, RSS links are the text of <link>
+// or of a permalink <guid>.
+func itemLink(item xmlItem) string {
+	for _, link := range item.Links {
+		if link.Href != "" && (link.Rel == "" || link.Rel == "alternate") {
+			return link.Href
+		}
+		if link.Href == "" && strings.TrimSpace(link.Text) != "" {
+			return link.Text
+		}
+	}
+	if item.GUID.IsPermaLink != "false" && strings.HasPrefix(strings.TrimSpace(item.GUID.Text), "http") {
+		return item.GUID.Text
+	}
+	return ""
+}
+
+type jsonFeed struct {
+	Version string `json:"version"`
+	FeedURL string `json:"feed_url"`
+	Hubs    []struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	} `json:"hubs"`
+	Items []struct {
+		URL           string `json:"url"`
+		DatePublished string `json:"date_published"`
+		DateModified  string `json:"date_modified"`
+	} `json:"items"`
+}
+
+func parseJSON(reader io.Reader) (*rawFeed, error) {
+	feed := jsonFeed{}
+	err := json.NewDecoder(reader).Decode(&feed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse feed: %w", err)
+	}
+	if !strings.HasPrefix(feed.Version, "https://jsonfeed.org/version/") {
+		return nil, ErrUnknownFormat
+	}
+	raw := &rawFeed{entries: make([]entry, 0, len(feed.Items)), self: feed.FeedURL}
+	for _, item := range feed.Items {
+		raw.entries = append(raw.entries, entry{link: item.URL, date: firstNonEmpty(item.DateModified, item.DatePublished)})
+	}
+	for _, hub := range feed.Hubs {
+		if strings.EqualFold(hub.Type, "websub") {
+			raw.hubs = append(raw.hubs, hub.URL)
+		}
+	}
+	return raw, nil
+}
+
+// RSS uses RFC 822 dates, often with variations, Atom and JSON Feed use RFC 3339
+var dateLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	time.RFC822Z,
+	time.RFC822,
+}
+
+// Return the zero time if the date is missing or invalid
+func parseDate(raw string) time.Time {
+	raw = strings.TrimSpace(raw)
+	for _, layout := range dateLayouts {
+		date, err := time.Parse(layout, raw)
+		if err == nil {
+			return date
+		}
+	}
+	return time.Time{}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,159 @@
+package feed
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rss = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+	<channel>
+		<title>Test</title>
+		<link>http://test.com/</link>
+		<item>
+			<link>http://test.com/first</link>
+			<pubDate>Fri, 01 Mar 2024 10:30:00 +0100</pubDate>
+		</item>
+		<item>
+			<guid>http://test.com/second</guid>
+		</item>
+		<item>
+			<guid isPermaLink="false">http://test.com/not-a-link</guid>
+		</item>
+	</channel>
+</rss>`
+
+const atom = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<link href="http://test.com/" rel="alternate"/>
+	<entry>
+		<link href="http://test.com/comments" rel="replies"/>
+		<link href="/first"/>
+		<updated>2024-03-01T10:30:00+01:00</updated>
+	</entry>
+</feed>`
+
+const jsonFeedBody = `{
+	"version": "https://jsonfeed.org/version/1.1",
+	"items": [
+		{"id": "1", "url": "http://test.com/first", "date_published": "2024-03-01T10:30:00+01:00"},
+		{"id": "2"}
+	]
+}`
+
+func TestParse(t *testing.T) {
+	lastMod := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	tests := map[string]struct {
+		body    string
+		urls    []string
+		lastMod []time.Time
+	}{
+		"rss":  {rss, []string{"http://test.com/first", "http://test.com/second"}, []time.Time{lastMod, {}}},
+		"atom": {atom, []string{"http://test.com/first"}, []time.Time{lastMod}},
+		"json": {jsonFeedBody, []string{"http://test.com/first"}, []time.Time{lastMod}},
+	}
+
+	base := &url.URL{Scheme: "http", Host: "test.com", Path: "/feed"}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			feed, err := Parse(base, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			hints := feed.Entries
+			if len(hints) != len(test.urls) {
+				t.Fatalf("bad number of hints: want %d; got %d", len(test.urls), len(hints))
+			}
+			for i, hint := range hints {
+				if hint.URL.String() != test.urls[i] || !hint.LastMod.Equal(test.lastMod[i]) || !hint.Fresh {
+					t.Fatalf("bad hint %d: want %s at %s; got %+v", i, test.urls[i], test.lastMod[i], hint)
+				}
+			}
+		})
+	}
+}
+
+func TestParseWebSub(t *testing.T) {
+	tests := map[string]string{
+		"atom": `<feed xmlns="http://www.w3.org/2005/Atom">
+			<link rel="hub" href="https://hub.test.com/"/>
+			<link rel="self" href="/feed"/>
+			<entry><link href="/first"/></entry>
+		</feed>`,
+		"rss": `<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+			<link>http://test.com/</link>
+			<atom:link rel="hub" href="https://hub.test.com/"/>
+			<atom:link rel="self" href="http://test.com/feed"/>
+			<item><link>http://test.com/first</link></item>
+		</channel></rss>`,
+		"json": `{
+			"version": "https://jsonfeed.org/version/1.1",
+			"feed_url": "http://test.com/feed",
+			"hubs": [{"type": "WebSub", "url": "https://hub.test.com/"}, {"type": "rssCloud", "url": "http://cloud.test.com"}],
+			"items": [{"url": "http://test.com/first"}]
+		}`,
+	}
+
+	base := &url.URL{Scheme: "http", Host: "test.com", Path: "/feed"}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			feed, err := Parse(base, strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(feed.Hubs) != 1 || feed.Hubs[0].String() != "https://hub.test.com/" {
+				t.Fatalf("bad hubs: got %s", feed.Hubs)
+			}
+			if feed.Self == nil || feed.Self.String() != "http://test.com/feed" {
+				t.Fatalf("bad self: got %s", feed.Self)
+			}
+			if len(feed.Entries) != 1 || feed.Entries[0].URL.String() != "http://test.com/first" {
+				t.Fatalf("bad entries: got %+v", feed.Entries)
+			}
+		})
+	}
+}
+
+func TestParseUnknownFormat(t *testing.T) {
+	tests := map[string]string{
+		"empty":   "",
+		"html":    "<html><body></body></html>",
+		"sitemap": `<urlset><url><loc>http://test.com/</loc></url></urlset>`,
+		"json":    `{"version": "1.0", "items": []}`,
+	}
+
+	base := &url.URL{Scheme: "http", Host: "test.com"}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			_, err := Parse(base, strings.NewReader(body))
+			if !errors.Is(err, ErrUnknownFormat) {
+				t.Fatalf("bad error: want %s; got %v", ErrUnknownFormat, err)
+			}
+		})
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	expected := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	tests := []string{
+		"2024-03-01T10:30:00+01:00",
+		"Fri, 01 Mar 2024 10:30:00 +0100",
+		"Fri, 1 Mar 2024 10:30:00 +0100",
+		"1 Mar 2024 10:30:00 +0100",
+		" 2024-03-01T09:30:00Z ",
+	}
+	for _, raw := range tests {
+		if got := parseDate(raw); !got.Equal(expected) {
+			t.Fatalf("bad date for %q: want %s; got %s", raw, expected, got)
+		}
+	}
+	if got := parseDate("yesterday"); !got.IsZero() {
+		t.Fatalf("invalid dates must give the zero time; got %s", got)
+	}
+}
@@ -0,0 +1,448 @@
+package politeness
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/telemetry"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/time/rate"
+)
+
+// Outcome of a request, as reported to the limiters of its host.
+type Outcome int
+
+const (
+	Success    Outcome = iota // The host answered, with the reported latency
+	Overloaded                // The host answered 429 Too Many Requests or 503 Service Unavailable
+	TimedOut                  // The host did not answer in time
+)
+
+const (
+	// The rate is multiplied by it when the host shows signs of overload
+	decreaseFactor = 0.5
+	// The rate is increased by ceiling/increaseSteps after increaseAfter successes in a row
+	increaseSteps = 10
+	increaseAfter = 10
+	// A response is slow when its latency is latencyFactor times the average one, once
+	// the average is known from latencySamples responses. Latencies below minSlowLatency
+	// are never slow, small variations of fast hosts are noise.
+	latencyFactor  = 3
+	latencySamples = 5
+	minSlowLatency = 250 * time.Millisecond
+	// Weight of a new latency in the moving average
+	latencyWeight = 0.1
+	// Failures of the requests already in flight are the same signal, the rate is not
+	// decreased twice in less than the interval between two requests or than that.
+	minDecreaseInterval = time.Second
+	// Time before the address of a host is resolved again, and before giving up a lookup
+	addressTTL    = 10 * time.Minute
+	lookupTimeout = 10 * time.Second
+	// The limiters of a host that sent no request for that long are forgotten, unless
+	// they follow a Crawl-delay, so that the memory does not grow with every host ever
+	// crawled. Idle limiters are looked for at most once every sweepInterval.
+	idleTTL       = 30 * time.Minute
+	sweepInterval = time.Minute
+)
+
+// Resolver resolves the addresses of hosts, like net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Limiters paces the requests sent to each host. HEAD and GET requests have different
+// limiters otherwise all GET requests would be stopped by HEAD requests (which are queued
+// first) instead of working in tandem.
+//
+// The rate of each host adapts to how it answers (AIMD): it is halved when the host is
+// overloaded, times out or slows down, and increases slowly back while it answers
+// normally. It stays between the min and max rates, and below the Crawl-delay of the
+// robots.txt of the host.
+//
+// Hosts also share a limiter with the other hosts of their registrable domain (computed
+// with the Public Suffix List) and one with the other hosts served by the same IP
+// address, so that the thousands of subdomains of a shared host or the sites behind a
+// CDN are not contacted thousands of times faster than intended. A request only goes out
+// once the limiters of all the levels allow it. The IP level only applies once the host
+// is resolved, in the background.
+type Limiters struct {
+	min         rate.Limit
+	max         rate.Limit
+	domainLimit rate.Limit
+	ipLimit     rate.Limit
+	resolver    Resolver
+	hosts       *sync.Map    // *hostLimiters keyed by host
+	domains     *sync.Map    // *rate.Limiter keyed by registrable domain
+	ips         *sync.Map    // *rate.Limiter keyed by IP address
+	addresses   *sync.Map    // *address keyed by host
+	lookups     *sync.Map    // Hosts being resolved
+	lastSweep   atomic.Int64 // Unix nanoseconds of the latest eviction of idle limiters
+}
+
+type hostLimiters struct {
+	mu           sync.Mutex
+	name         string
+	removed      bool // Forgotten by the sweep, a new entry replaces it
+	head         *rate.Limiter
+	get          *rate.Limiter
+	ceiling      rate.Limit    // Max rate of the host, lower than max if it has a Crawl-delay
+	pause        time.Time     // Time until which the host must not be contacted
+	latency      time.Duration // Moving average of the latency of the host
+	samples      int
+	successes    int // Successes in a row since the last change of rate
+	lastDecrease time.Time
+	lastWait     time.Time
+}
+
+type address struct {
+	ip      string // Empty if the host could not be resolved
+	expires time.Time
+}
+
+// NewLimiters creates limiters that let between min and max requests per second go to
+// each host for each method, domainLimit to each registrable domain and ipLimit to each
+// IP address. Hosts start at the max rate. The addresses of the hosts are resolved with
+// the resolver, or net.DefaultResolver if it is nil.
+func NewLimiters(
+	min rate.Limit,
+	max rate.Limit,
+	domainLimit rate.Limit,
+	ipLimit rate.Limit,
+	resolver Resolver,
+) *Limiters {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return &Limiters{
+		min:         min,
+		max:         max,
+		domainLimit: domainLimit,
+		ipLimit:     ipLimit,
+		resolver:    resolver,
+		hosts:       &sync.Map{},
+		domains:     &sync.Map{},
+		ips:         &sync.Map{},
+		addresses:   &sync.Map{},
+		lookups:     &sync.Map{},
+	}
+}
+
+// Wait blocks until a request with the method can be sent to the host, or until the
+// context is canceled.
+func (l *Limiters) Wait(ctx context.Context, method string, host string) error {
+	l.sweep()
+	h := l.lockHost(host)
+	h.lastWait = time.Now()
+	wait := time.Until(h.pause)
+	h.mu.Unlock()
+	if wait > 0 {
+		err := sleep(ctx, wait)
+		if err != nil {
+			return err
+		}
+	}
+
+	limiters := []*rate.Limiter{h.limiter(method)}
+	if domain := l.domain(host); domain != nil {
+		limiters = append(limiters, domain)
+	}
+	if ip := l.ip(host); ip != nil {
+		limiters = append(limiters, ip)
+	}
+	return waitAll(ctx, limiters)
+}
+
+// Delay holds back all the requests to the host until the given time, for example when
+// it answered with a Retry-After header.
+func (l *Limiters) Delay(host string, until time.Time) {
+	h := l.lockHost(host)
+	defer h.mu.Unlock()
+	// Only extend the pause, concurrent responses may ask for shorter ones
+	if until.After(h.pause) {
+		h.pause = until
+	}
+}
+
+// SetCrawlDelay makes the host limiters send at most one request every delay if that is
+// slower than the max rate, as asked by the Crawl-delay of its robots.txt.
+func (l *Limiters) SetCrawlDelay(host string, delay time.Duration) {
+	if delay <= 0 || rate.Every(delay) >= l.max {
+		return
+	}
+	h := l.lockHost(host)
+	defer h.mu.Unlock()
+	h.ceiling = rate.Every(delay)
+	if h.get.Limit() > h.ceiling {
+		l.setLimit(h, h.ceiling)
+	}
+}
+
+// Observe adapts the rate of the host to the outcome of a request sent to it.
+func (l *Limiters) Observe(host string, outcome Outcome, latency time.Duration) {
+	h := l.lockHost(host)
+	defer h.mu.Unlock()
+	// Without rate limiting there is nothing to adapt
+	if h.ceiling == rate.Inf {
+		return
+	}
+
+	if outcome == Success {
+		slow := h.samples >= latencySamples &&
+			latency > minSlowLatency &&
+			latency > latencyFactor*h.latency
+		if h.samples == 0 {
+			h.latency = latency
+		} else {
+			h.latency += time.Duration(latencyWeight * float64(latency-h.latency))
+		}
+		h.samples++
+		if !slow {
+			l.increase(h)
+			return
+		}
+	}
+	l.decrease(h)
+}
+
+// Limit returns the current rate of the limiter of the method and host.
+func (l *Limiters) Limit(method string, host string) rate.Limit {
+	return l.host(host).limiter(method).Limit()
+}
+
+func (l *Limiters) increase(h *hostLimiters) {
+	h.successes++
+	current := h.get.Limit()
+	if h.successes < increaseAfter || current >= h.ceiling {
+		return
+	}
+	l.setLimit(h, min(current+h.ceiling/increaseSteps, h.ceiling))
+}
+
+func (l *Limiters) decrease(h *hostLimiters) {
+	h.successes = 0
+	current := h.get.Limit()
+	interval := max(time.Duration(float64(time.Second)/float64(current)), minDecreaseInterval)
+	if time.Since(h.lastDecrease) < interval {
+		return
+	}
+	h.lastDecrease = time.Now()
+	// The Crawl-delay may be slower than the min rate, it wins then
+	l.setLimit(h, max(current*decreaseFactor, min(l.min, h.ceiling)))
+}
+
+// Must be called with the lock of the host
+func (l *Limiters) setLimit(h *hostLimiters, limit rate.Limit) {
+	wasSlowed := h.get.Limit() < l.max
+	h.head.SetLimit(limit)
+	h.get.SetLimit(limit)
+	h.successes = 0
+	isSlowed := limit < l.max
+	if isSlowed {
+		telemetry.HostRateLimit.WithLabelValues(h.name).Set(float64(limit))
+	} else if wasSlowed {
+		// Only the slowed hosts are exported so that the series don't grow with every host
+		telemetry.HostRateLimit.DeleteLabelValues(h.name)
+	}
+	if isSlowed != wasSlowed {
+		if isSlowed {
+			telemetry.SlowedHosts.Inc()
+		} else {
+			telemetry.SlowedHosts.Dec()
+		}
+	}
+}
+
+// Forget the limiters that have been idle for idleTTL, if the latest sweep is older than
+// sweepInterval. A host is marked removed under its lock so that the callers that got it
+// before it was deleted look it up again instead of using a forgotten entry. The limiters of domains and IP addresses are forgotten once their bucket
+// is full again: they would behave like new ones.
+func (l *Limiters) sweep() {
+	now := time.Now()
+	last := l.lastSweep.Load()
+	if now.UnixNano()-last < int64(sweepInterval) || !l.lastSweep.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+
+	l.hosts.Range(func(key, value any) bool {
+		h := value.(*hostLimiters)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.ceiling != l.max || now.Sub(h.lastWait) < idleTTL || now.Before(h.pause) {
+			return true
+		}
+		h.removed = true
+		l.hosts.CompareAndDelete(key, h)
+		if h.get.Limit() < l.max {
+			telemetry.SlowedHosts.Dec()
+			telemetry.HostRateLimit.DeleteLabelValues(h.name)
+		}
+		return true
+	})
+	for _, limiters := range []*sync.Map{l.domains, l.ips} {
+		limiters.Range(func(key, value any) bool {
+			if value.(*rate.Limiter).TokensAt(now) >= 1 {
+				limiters.Delete(key)
+			}
+			return true
+		})
+	}
+	l.addresses.Range(func(key, value any) bool {
+		if now.After(value.(*address).expires) {
+			l.addresses.Delete(key)
+		}
+		return true
+	})
+}
+
+// Return the limiter of the registrable domain of the host, nil if there is no limit
+func (l *Limiters) domain(host string) *rate.Limiter {
+	if l.domainLimit == rate.Inf {
+		return nil
+	}
+	hostname := hostnameOf(host)
+	// The IP level already covers the hosts that are addresses
+	if net.ParseIP(hostname) != nil {
+		return nil
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(hostname)
+	if err != nil {
+		domain = hostname // The host is a public suffix itself, like localhost
+	}
+	v, ok := l.domains.Load(domain)
+	if !ok {
+		v, _ = l.domains.LoadOrStore(domain, rate.NewLimiter(l.domainLimit, 1))
+	}
+	return v.(*rate.Limiter)
+}
+
+// Return the limiter of the IP address the host resolves to, nil if there is no limit or
+// if the address of the host is not known yet
+func (l *Limiters) ip(host string) *rate.Limiter {
+	if l.ipLimit == rate.Inf {
+		return nil
+	}
+	hostname := hostnameOf(host)
+	ip := hostname
+	if net.ParseIP(hostname) == nil {
+		ip = l.resolve(hostname)
+		if ip == "" {
+			return nil
+		}
+	}
+	v, ok := l.ips.Load(ip)
+	if !ok {
+		v, _ = l.ips.LoadOrStore(ip, rate.NewLimiter(l.ipLimit, 1))
+	}
+	return v.(*rate.Limiter)
+}
+
+// Return the first address of the host, the one the dialer tries first, or "" if it is
+// not known yet. The host is resolved in the background so that a slow DNS server never
+// holds the requests, an expired address is still used until the new one is known.
+func (l *Limiters) resolve(hostname string) string {
+	ip := ""
+	if v, ok := l.addresses.Load(hostname); ok {
+		ip = v.(*address).ip
+		if time.Now().Before(v.(*address).expires) {
+			return ip
+		}
+	}
+	if _, resolving := l.lookups.LoadOrStore(hostname, struct{}{}); !resolving {
+		go l.lookup(hostname)
+	}
+	return ip
+}
+
+func (l *Limiters) lookup(hostname string) {
+	defer l.lookups.Delete(hostname)
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	ip := ""
+	addrs, err := l.resolver.LookupIPAddr(ctx, hostname)
+	if err == nil && len(addrs) > 0 {
+		ip = addrs[0].IP.String()
+	}
+	l.addresses.Store(hostname, &address{ip: ip, expires: time.Now().Add(addressTTL)})
+}
+
+func (l *Limiters) host(host string) *hostLimiters {
+	v, ok := l.hosts.Load(host)
+	if !ok {
+		v, _ = l.hosts.LoadOrStore(host, &hostLimiters{
+			name:    host,
+			head:    rate.NewLimiter(l.max, 1),
+			get:     rate.NewLimiter(l.max, 1),
+			ceiling: l.max,
+		})
+	}
+	return v.(*hostLimiters)
+}
+
+// Return the limiters of the host, locked. An entry forgotten by the sweep after it was
+// looked up is replaced by a new one.
+func (l *Limiters) lockHost(host string) *hostLimiters {
+	for {
+		h := l.host(host)
+		h.mu.Lock()
+		if !h.removed {
+			return h
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *hostLimiters) limiter(method string) *rate.Limiter {
+	if method == "HEAD" {
+		return h.head
+	}
+	return h.get
+}
+
+// Wait until all the limiters allow a request. Each level is reserved at the time the
+// previous ones allow the request, rather than now, so that a level held back by another
+// does not count the request before it is sent. The reservations are given back if the
+// wait is canceled.
+func waitAll(ctx context.Context, limiters []*rate.Limiter) error {
+	now := time.Now()
+	at := now
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	for _, limiter := range limiters {
+		reservation := limiter.ReserveN(at, 1)
+		reservations = append(reservations, reservation)
+		at = at.Add(reservation.DelayFrom(at))
+	}
+	err := sleep(ctx, at.Sub(now))
+	if err != nil {
+		for _, reservation := range reservations {
+			reservation.Cancel()
+		}
+	}
+	return err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Remove the port of the host of an url and lower it
+func hostnameOf(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
@@ -0,0 +1,346 @@
+package politeness
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/telemetry"
+	"golang.org/x/time/rate"
+)
+
+// Let the next failure decrease the rate without waiting for the cooldown
+func resetCooldown(l *Limiters, host string) {
+	h := l.host(host)
+	h.mu.Lock()
+	h.lastDecrease = time.Time{}
+	h.mu.Unlock()
+}
+
+func TestDecrease(t *testing.T) {
+	tests := map[string]struct {
+		outcome Outcome
+		latency time.Duration
+	}{
+		"overloaded": {Overloaded, 100 * time.Millisecond},
+		"timed out":  {TimedOut, 30 * time.Second},
+		"slow":       {Success, 2 * time.Second},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			limiters := NewLimiters(1, 8, rate.Inf, rate.Inf, nil)
+			for range latencySamples {
+				limiters.Observe("test.com", Success, 100*time.Millisecond)
+			}
+
+			limiters.Observe("test.com", test.outcome, test.latency)
+			if limiters.Limit("GET", "test.com") != 4 || limiters.Limit("HEAD", "test.com") != 4 {
+				t.Fatalf("the rate should be halved: got %.2f req/s", limiters.Limit("GET", "test.com"))
+			}
+			// Failures of the requests in flight are the same signal
+			limiters.Observe("test.com", test.outcome, test.latency)
+			if limiters.Limit("GET", "test.com") != 4 {
+				t.Fatalf("the rate should be halved once: got %.2f req/s", limiters.Limit("GET", "test.com"))
+			}
+		})
+	}
+}
+
+func TestDecreaseBounds(t *testing.T) {
+	limiters := NewLimiters(1, 8, rate.Inf, rate.Inf, nil)
+	for range 10 {
+		resetCooldown(limiters, "test.com")
+		limiters.Observe("test.com", Overloaded, 0)
+	}
+	if limiters.Limit("GET", "test.com") != 1 {
+		t.Fatalf("the rate should stop at the min: got %.2f req/s", limiters.Limit("GET", "test.com"))
+	}
+
+	// The Crawl-delay wins over the min
+	limiters.SetCrawlDelay("test.com", 4*time.Second)
+	resetCooldown(limiters, "test.com")
+	limiters.Observe("test.com", Overloaded, 0)
+	if limiters.Limit("GET", "test.com") != rate.Every(4*time.Second) {
+		t.Fatalf("the rate should respect the Crawl-delay: got %.2f req/s", limiters.Limit("GET", "test.com"))
+	}
+}
+
+func TestIncrease(t *testing.T) {
+	limiters := NewLimiters(1, 8, rate.Inf, rate.Inf, nil)
+	limiters.Observe("test.com", Overloaded, 0)
+	for range increaseAfter - 1 {
+		limiters.Observe("test.com", Success, 100*time.Millisecond)
+	}
+	if limiters.Limit("GET", "test.com") != 4 {
+		t.Fatalf("the rate should not increase before %d successes: got %.2f req/s", increaseAfter, limiters.Limit("GET", "test.com"))
+	}
+	limiters.Observe("test.com", Success, 100*time.Millisecond)
+	if limiters.Limit("GET", "test.com") != 4.8 {
+		t.Fatalf("the rate should increase additively: got %.2f req/s", limiters.Limit("GET", "test.com"))
+	}
+
+	for range 10 * increaseAfter {
+		limiters.Observe("test.com", Success, 100*time.Millisecond)
+	}
+	if limiters.Limit("GET", "test.com") != 8 {
+		t.Fatalf("the rate should stop at the max: got %.2f req/s", limiters.Limit("GET", "test.com"))
+	}
+
+	limiters.SetCrawlDelay("test.com", time.Second)
+	for range 10 * increaseAfter {
+		limiters.Observe("test.com", Success, 100*time.Millisecond)
+	}
+	if limiters.Limit("GET", "test.com") != 1 {
+		t.Fatalf("the rate should stop at the Crawl-delay: got %.2f req/s", limiters.Limit("GET", "test.com"))
+	}
+}
+
+func TestNoRateLimit(t *testing.T) {
+	limiters := NewLimiters(rate.Inf, rate.Inf, rate.Inf, rate.Inf, nil)
+	limiters.Observe("test.com", Overloaded, 0)
+	if limiters.Limit("GET", "test.com") != rate.Inf {
+		t.Fatalf("disabled rate limiting should not adapt: got %.2f req/s", limiters.Limit("GET", "test.com"))
+	}
+}
+
+func TestDelay(t *testing.T) {
+	limiters := NewLimiters(rate.Inf, rate.Inf, rate.Inf, rate.Inf, nil)
+	limiters.Delay("test.com", time.Now().Add(50*time.Millisecond))
+	limiters.Delay("test.com", time.Now()) // Shorter pauses are ignored
+
+	t0 := time.Now()
+	err := limiters.Wait(context.Background(), "GET", "other.com")
+	if err != nil || time.Since(t0) > 10*time.Millisecond {
+		t.Fatalf("other hosts should not be delayed: waited %s (%v)", time.Since(t0), err)
+	}
+	err = limiters.Wait(context.Background(), "GET", "test.com")
+	if err != nil || time.Since(t0) < 50*time.Millisecond {
+		t.Fatalf("the host should be delayed: waited %s (%v)", time.Since(t0), err)
+	}
+}
+
+type fakeResolver map[string]string
+
+func (r fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ip, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+// Resolve the hosts and wait for their addresses, the lookups happen in the background
+func resolveAll(t *testing.T, l *Limiters, hosts ...string) {
+	t.Helper()
+	for _, host := range hosts {
+		hostname := hostnameOf(host)
+		if net.ParseIP(hostname) != nil {
+			continue
+		}
+		l.resolve(hostname)
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, ok := l.addresses.Load(hostname); ok {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not resolved", host)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestSharedLimits(t *testing.T) {
+	resolver := fakeResolver{
+		"a.test.com":     "10.0.0.1",
+		"b.test.com":     "10.0.0.2",
+		"a.test.co.uk":   "10.0.0.3",
+		"b.test.co.uk":   "10.0.0.4",
+		"other.com":      "10.0.0.5",
+		"cdn-a.com":      "10.0.0.6",
+		"cdn-b.com":      "10.0.0.6",
+		"a.github.io":    "10.0.0.7",
+		"b.github.io":    "10.0.0.8",
+		"unresolved.com": "",
+	}
+	interval := 50 * time.Millisecond
+	tests := map[string]struct {
+		first   string
+		second  string
+		limited bool
+	}{
+		"same domain":          {"a.test.com", "b.test.com:8080", true},
+		"multi-label suffix":   {"a.test.co.uk", "b.test.co.uk", true},
+		"other domain":         {"a.test.com", "other.com", false},
+		"same ip":              {"cdn-a.com", "cdn-b.com", true},
+		"same ip literal":      {"10.0.0.9", "10.0.0.9:8080", true},
+		"public suffix domain": {"a.github.io", "b.github.io", false},
+		"unresolved host":      {"unresolved.com", "other.com", false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			limiters := NewLimiters(rate.Inf, rate.Inf, rate.Every(interval), rate.Every(interval), resolver)
+			resolveAll(t, limiters, test.first, test.second)
+			limiters.Wait(context.Background(), "GET", test.first)
+
+			t0 := time.Now()
+			err := limiters.Wait(context.Background(), "GET", test.second)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			limited := time.Since(t0) > interval/2
+			if limited != test.limited {
+				t.Fatalf("bad shared limit between %s and %s: want limited=%t; waited %s", test.first, test.second, test.limited, time.Since(t0))
+			}
+		})
+	}
+}
+
+func TestSharedDomainHeldHost(t *testing.T) {
+	interval := 20 * time.Millisecond
+	limiters := NewLimiters(rate.Inf, rate.Inf, rate.Every(interval), rate.Inf, nil)
+	// a.test.com is held back by its Crawl-delay, b.test.com only by the domain
+	limiters.SetCrawlDelay("a.test.com", 5*interval)
+	limiters.Wait(context.Background(), "GET", "a.test.com")
+
+	var mu sync.Mutex
+	sent := make([]time.Time, 0)
+	send := func(host string) {
+		err := limiters.Wait(context.Background(), "GET", host)
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		mu.Lock()
+		sent = append(sent, time.Now())
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		send("a.test.com")
+	}()
+	time.Sleep(interval / 4)
+	for range 4 {
+		send("b.test.com")
+	}
+	wg.Wait()
+
+	// The domain only counts the request of a.test.com when its host lets it go
+	slices.SortFunc(sent, time.Time.Compare)
+	for i := 1; i < len(sent); i++ {
+		if gap := sent[i].Sub(sent[i-1]); gap < interval/2 {
+			t.Fatalf("requests to the same domain sent %s apart: want at least %s", gap, interval/2)
+		}
+	}
+}
+
+// Never answers until the test ends
+type blockingResolver chan struct{}
+
+func (r blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-r
+	return nil, errors.New("no such host")
+}
+
+func TestWaitSlowResolver(t *testing.T) {
+	resolver := make(blockingResolver)
+	defer close(resolver)
+	limiters := NewLimiters(rate.Inf, rate.Inf, rate.Inf, rate.Every(time.Hour), resolver)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for range 2 {
+		err := limiters.Wait(ctx, "GET", "test.com")
+		if err != nil {
+			t.Fatalf("the requests should not wait for the lookup: got %s", err)
+		}
+	}
+}
+
+func TestWaitAllCanceled(t *testing.T) {
+	fast := rate.NewLimiter(rate.Inf, 1)
+	slow := rate.NewLimiter(rate.Every(time.Hour), 1)
+	slow.Allow()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := waitAll(ctx, []*rate.Limiter{fast, slow})
+	if err == nil {
+		t.Fatal("expected the context error")
+	}
+	// The token reserved on the slow level is given back
+	if delay := slow.Reserve().Delay(); delay > time.Hour {
+		t.Fatalf("the reservations should be canceled: the next token is in %s", delay)
+	}
+}
+
+func TestSweepIdleHosts(t *testing.T) {
+	limiters := NewLimiters(1, 8, rate.Inf, rate.Inf, nil)
+	for _, host := range []string{"idle.com", "delayed.com", "active.com"} {
+		limiters.Wait(context.Background(), "GET", host)
+	}
+	limiters.SetCrawlDelay("delayed.com", 10*time.Second)
+	for _, host := range []string{"idle.com", "delayed.com"} {
+		h := limiters.host(host)
+		h.mu.Lock()
+		h.lastWait = time.Now().Add(-idleTTL)
+		h.mu.Unlock()
+	}
+
+	// A slowed host that is idle is forgotten with its gauge
+	limiters.Observe("slowed-idle.com", Overloaded, 0)
+	h := limiters.host("slowed-idle.com")
+	h.mu.Lock()
+	h.lastWait = time.Now().Add(-idleTTL)
+	h.mu.Unlock()
+
+	swept := limiters.host("idle.com")
+	limiters.lastSweep.Store(0)
+	limiters.sweep()
+	tests := map[string]bool{"idle.com": false, "slowed-idle.com": false, "delayed.com": true, "active.com": true}
+	for host, kept := range tests {
+		if _, ok := limiters.hosts.Load(host); ok != kept {
+			t.Fatalf("bad sweep of %s: want kept=%t", host, kept)
+		}
+	}
+	if limiters.Limit("GET", "delayed.com") != rate.Every(10*time.Second) {
+		t.Fatal("the Crawl-delay should be kept")
+	}
+	if telemetry.HostRateLimit.DeleteLabelValues("slowed-idle.com") {
+		t.Fatal("the gauge of a forgotten host should be deleted")
+	}
+
+	// A caller that looked the host up before the sweep uses the new entry
+	limiters.Delay("idle.com", time.Now().Add(time.Hour))
+	if h := limiters.host("idle.com"); h == swept || h.pause.IsZero() {
+		t.Fatal("the forgotten entry should be replaced by a new one")
+	}
+}
+
+func TestHostRateLimitGauge(t *testing.T) {
+	limiters := NewLimiters(1, 8, rate.Inf, rate.Inf, nil)
+	limiters.Observe("slowed.com", Overloaded, 0)
+	if !telemetry.HostRateLimit.DeleteLabelValues("slowed.com") {
+		t.Fatal("a slowed host should be exported")
+	}
+
+	limiters.Observe("gauge.com", Overloaded, 0)
+
+	// Back at the max rate, the host is no longer exported
+	h := limiters.lockHost("gauge.com")
+	limiters.setLimit(h, 8)
+	h.mu.Unlock()
+	if telemetry.HostRateLimit.DeleteLabelValues("gauge.com") {
+		t.Fatal("the gauge of a host at the max rate should be deleted")
+	}
+}
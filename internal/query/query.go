@@ -0,0 +1,152 @@
+package query
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/controller"
+)
+
+type Direction string
+
+const (
+	Backlinks Direction = "backlinks"
+	Outlinks  Direction = "outlinks"
+)
+
+type Format string
+
+const (
+	FormatTable Format = "table"
+	FormatJSONL Format = "jsonl"
+	FormatCSV   Format = "csv"
+)
+
+// Size of the pages requested to the reader
+const pageSize = 1000
+
+type row struct {
+	Source string   `json:"source"`
+	Target string   `json:"target"`
+	Text   string   `json:"text"`
+	Rel    []string `json:"rel"`
+	Title  string   `json:"title"`
+}
+
+var header = []string{"source", "target", "text", "rel", "title"}
+
+func (r row) fields() []string {
+	return []string{r.Source, r.Target, r.Text, strings.Join(r.Rel, " "), r.Title}
+}
+
+// Collect follows the cursors of the reader until limit links are found or there is no
+// more results. A limit of 0 means no limit.
+func Collect(
+	ctx context.Context,
+	reader controller.GraphReader,
+	direction Direction,
+	q controller.LinkQuery,
+	limit int,
+) ([]commons.Link, error) {
+	links := make([]commons.Link, 0)
+	for {
+		q.Limit = pageSize
+		if limit > 0 {
+			q.Limit = min(pageSize, limit-len(links))
+		}
+
+		var page *controller.LinkPage
+		var err error
+		switch direction {
+		case Backlinks:
+			page, err = reader.Backlinks(ctx, q)
+		case Outlinks:
+			page, err = reader.Outlinks(ctx, q)
+		default:
+			return nil, fmt.Errorf("invalid direction: %s", direction)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		links = append(links, page.Links...)
+		if page.Next == "" || (limit > 0 && len(links) >= limit) {
+			return links, nil
+		}
+		q.Cursor = page.Next
+	}
+}
+
+func Write(w io.Writer, format Format, links []commons.Link) error {
+	rows := make([]row, 0, len(links))
+	for _, link := range links {
+		rel := link.Rel
+		if rel == nil {
+			rel = []string{}
+		}
+		rows = append(rows, row{
+			Source: link.From.String(),
+			Target: link.To.String(),
+			Text:   link.Text,
+			Rel:    rel,
+			Title:  link.Title,
+		})
+	}
+
+	switch format {
+	case FormatTable:
+		return writeTable(w, rows)
+	case FormatJSONL:
+		return writeJSONL(w, rows)
+	case FormatCSV:
+		return writeCSV(w, rows)
+	default:
+		return fmt.Errorf("invalid format: %s", format)
+	}
+}
+
+func writeTable(w io.Writer, rows []row) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	writeTableLine(tw, header)
+	for _, r := range rows {
+		writeTableLine(tw, r.fields())
+	}
+	return tw.Flush()
+}
+
+func writeTableLine(w io.Writer, fields []string) {
+	for i, field := range fields {
+		if i > 0 {
+			io.WriteString(w, "\t")
+		}
+		io.WriteString(w, field)
+	}
+	io.WriteString(w, "\n")
+}
+
+func writeJSONL(w io.Writer, rows []row) error {
+	encoder := json.NewEncoder(w)
+	for _, r := range rows {
+		err := encoder.Encode(r)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, rows []row) error {
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, r := range rows {
+		cw.Write(r.fields())
+	}
+	cw.Flush()
+	return cw.Error()
+}
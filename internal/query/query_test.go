@@ -0,0 +1,92 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/controller"
+)
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("invalid test url %s: %s", rawURL, err)
+	}
+	return u
+}
+
+func TestCollectFollowCursors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := controller.NewInMemoryController(ctx, 0, controller.RevisitPolicy{}, 0, controller.RevisitPolicy{})
+	target := mustParse(t, "http://target.com")
+	for i := 0; i < pageSize+10; i++ {
+		from := &url.URL{Scheme: "http", Host: "source.com", Path: "/" + strings.Repeat("a", i)}
+		store.Add(&commons.LinkGroup{From: from, Links: []commons.Link{{To: target}}})
+	}
+
+	links, err := Collect(ctx, store, Backlinks, controller.LinkQuery{URL: target}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(links) != pageSize+10 {
+		t.Fatalf("bad number of links: want %d; got %d", pageSize+10, len(links))
+	}
+
+	links, err = Collect(ctx, store, Backlinks, controller.LinkQuery{URL: target}, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(links) != 5 {
+		t.Fatalf("limit not respected: want 5; got %d", len(links))
+	}
+}
+
+func TestWrite(t *testing.T) {
+	links := []commons.Link{
+		{From: mustParse(t, "http://a.com/x"), To: mustParse(t, "http://target.com"), Text: "home"},
+		{
+			From:  mustParse(t, "http://b.com/y,z"),
+			To:    mustParse(t, "http://target.com"),
+			Rel:   []string{"nofollow", "ugc"},
+			Title: "Target",
+		},
+	}
+
+	tests := map[Format]string{
+		FormatTable: "source            target             text  rel           title\n" +
+			"http://a.com/x    http://target.com  home                \n" +
+			"http://b.com/y,z  http://target.com        nofollow ugc  Target\n",
+		FormatJSONL: `{"source":"http://a.com/x","target":"http://target.com","text":"home","rel":[],"title":""}` + "\n" +
+			`{"source":"http://b.com/y,z","target":"http://target.com","text":"","rel":["nofollow","ugc"],"title":"Target"}` + "\n",
+		FormatCSV: "source,target,text,rel,title\n" +
+			"http://a.com/x,http://target.com,home,,\n" +
+			"\"http://b.com/y,z\",http://target.com,,nofollow ugc,Target\n",
+	}
+
+	for format, expected := range tests {
+		t.Run(string(format), func(t *testing.T) {
+			t.Parallel()
+			var buf bytes.Buffer
+			err := Write(&buf, format, links)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if buf.String() != expected {
+				t.Fatalf("bad output: want\n%s\ngot\n%s", expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestWriteInvalidFormat(t *testing.T) {
+	err := Write(&bytes.Buffer{}, Format("xml"), nil)
+	if err == nil {
+		t.Fatal("invalid format should be rejected")
+	}
+}
@@ -0,0 +1,115 @@
+package robot
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/jimsmart/grobotstxt"
+)
+
+// Some sites ask for hours between two requests, we would rather not crawl them at all
+// than block a crawler goroutine for that long.
+const maxCrawlDelay = time.Minute
+
+// CrawlDelay returns the Crawl-delay of the group matching our user agent, or of the
+// global group if there is none, and 0 if neither asks for one. It is capped to
+// maxCrawlDelay.
+func (r Robots) CrawlDelay() time.Duration {
+	p := &directivesParser{specificDelay: -1, globalDelay: -1}
+	grobotstxt.Parse(r.Body, p)
+
+	seconds := p.specificDelay
+	if seconds < 0 {
+		seconds = p.globalDelay
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	return min(time.Duration(seconds*float64(time.Second)), maxCrawlDelay)
+}
+
+// Sitemaps returns the normalized urls of the Sitemap directives, they apply whatever
+// the user agent.
+func (r Robots) Sitemaps() []*url.URL {
+	sitemaps := make([]*url.URL, 0)
+	for _, raw := range grobotstxt.Sitemaps(r.Body) {
+		sitemap, err := url.Parse(raw)
+		if err != nil || !sitemap.IsAbs() {
+			slog.Warn(fmt.Sprintf("invalid sitemap url in robot.txt: %s", raw))
+			continue
+		}
+		sitemap, err = commons.NormalizeUrl(sitemap)
+		if err != nil {
+			continue
+		}
+		sitemaps = append(sitemaps, sitemap)
+	}
+	return sitemaps
+}
+
+// directivesParser implements grobotstxt.ParseHandler to read the Crawl-delay of the
+// groups that apply to us. A group starts with one or more User-agent lines.
+type directivesParser struct {
+	inUserAgents  bool // The previous directive was a User-agent line
+	groupSpecific bool // The current group applies to our user agent
+	groupGlobal   bool // The current group applies to every user agent
+	specificDelay float64
+	globalDelay   float64
+}
+
+func (p *directivesParser) HandleRobotsStart() {}
+
+func (p *directivesParser) HandleRobotsEnd() {}
+
+func (p *directivesParser) HandleUserAgent(lineNum int, value string) {
+	if !p.inUserAgents {
+		p.groupSpecific = false
+		p.groupGlobal = false
+	}
+	p.inUserAgents = true
+
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "*") {
+		p.groupGlobal = true
+	} else if fields := strings.FieldsFunc(value, isNotTokenChar); len(fields) > 0 && strings.EqualFold(fields[0], userAgent) {
+		p.groupSpecific = true
+	}
+}
+
+func (p *directivesParser) HandleAllow(lineNum int, value string) {
+	p.inUserAgents = false
+}
+
+func (p *directivesParser) HandleDisallow(lineNum int, value string) {
+	p.inUserAgents = false
+}
+
+func (p *directivesParser) HandleSitemap(lineNum int, value string) {}
+
+func (p *directivesParser) HandleUnknownAction(lineNum int, action string, value string) {
+	p.inUserAgents = false
+	if !strings.EqualFold(action, "crawl-delay") {
+		return
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || seconds < 0 {
+		return
+	}
+	// The first value of a group wins
+	if p.groupSpecific && p.specificDelay < 0 {
+		p.specificDelay = seconds
+	}
+	if p.groupGlobal && p.globalDelay < 0 {
+		p.globalDelay = seconds
+	}
+}
+
+// User agent names only contain letters, underscores and hyphens
+func isNotTokenChar(c rune) bool {
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '-')
+}
@@ -0,0 +1,71 @@
+package robot
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRobotCrawlDelay(t *testing.T) {
+	tests := map[string]struct {
+		robotTxt string
+		delay    time.Duration
+	}{
+		"no crawl delay": {
+			robotTxt: "User-agent: *\nDisallow: /private",
+			delay:    0,
+		},
+		"global crawl delay": {
+			robotTxt: "User-agent: *\nCrawl-delay: 5",
+			delay:    5 * time.Second,
+		},
+		"fractional crawl delay": {
+			robotTxt: "User-agent: *\ncrawl-delay: 0.5",
+			delay:    500 * time.Millisecond,
+		},
+		"specific crawl delay wins": {
+			robotTxt: "User-agent: *\nCrawl-delay: 5\n\nUser-agent: BacklinksBot\nCrawl-delay: 2",
+			delay:    2 * time.Second,
+		},
+		"grouped user agents": {
+			robotTxt: "User-agent: OtherBot\nUser-agent: BacklinksBot/1.0\nCrawl-delay: 3",
+			delay:    3 * time.Second,
+		},
+		"other bot crawl delay": {
+			robotTxt: "User-agent: OtherBot\nCrawl-delay: 5\n\nUser-agent: *\nDisallow: /private",
+			delay:    0,
+		},
+		"invalid crawl delay": {
+			robotTxt: "User-agent: *\nCrawl-delay: soon",
+			delay:    0,
+		},
+		"capped crawl delay": {
+			robotTxt: "User-agent: *\nCrawl-delay: 86400",
+			delay:    maxCrawlDelay,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			delay := Robots{Body: test.robotTxt}.CrawlDelay()
+			if delay != test.delay {
+				t.Fatalf("bad crawl delay: want %s; got %s", test.delay, delay)
+			}
+		})
+	}
+}
+
+func TestRobotSitemaps(t *testing.T) {
+	t.Parallel()
+	robots := Robots{Body: "Sitemap: http://test.com/sitemap.xml\nUser-agent: *\nDisallow: /\nSitemap: /relative.xml\nSitemap: https://cdn.test.com/Sitemap.xml"}
+
+	got := make([]string, 0)
+	for _, sitemap := range robots.Sitemaps() {
+		got = append(got, sitemap.String())
+	}
+	expect := []string{"http://test.com/sitemap.xml", "https://cdn.test.com/Sitemap.xml"}
+	if !slices.Equal(got, expect) {
+		t.Fatalf("bad sitemaps: want %s; got %s", expect, got)
+	}
+}
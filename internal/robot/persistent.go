@@ -0,0 +1,95 @@
+package robot
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/client"
+)
+
+// RobotStore persists the robots.txt of each scheme and host, it is shared by all the
+// crawler processes using the same database.
+type RobotStore interface {
+	// Load returns the stored robots.txt or nil if it was never fetched.
+	Load(ctx context.Context, scheme string, hostname string) (*Robots, error)
+	Save(ctx context.Context, scheme string, hostname string, robots Robots) error
+}
+
+// PersistentRobotPolicy keeps the robots.txt of each scheme and host in a RobotStore so they are
+// not fetched again on restart or by other crawler processes. Files are cached in memory
+// and fetched again once they are older than ttl.
+type PersistentRobotPolicy struct {
+	ctx    context.Context
+	client client.Fetcher
+	store  RobotStore
+	ttl    time.Duration
+	locks  *sync.Map
+	cache  *sync.Map
+}
+
+func NewPersistentRobotPolicy(
+	ctx context.Context,
+	fetcher client.Fetcher,
+	store RobotStore,
+	ttl time.Duration,
+) *PersistentRobotPolicy {
+	return &PersistentRobotPolicy{
+		ctx:    ctx,
+		client: fetcher,
+		store:  store,
+		ttl:    ttl,
+		locks:  &sync.Map{},
+		cache:  &sync.Map{},
+	}
+}
+
+func (r *PersistentRobotPolicy) IsAllowed(url *url.URL) bool {
+	return isAllowed(r.getRobots(url).Body, url)
+}
+
+func (r *PersistentRobotPolicy) CrawlDelay(url *url.URL) time.Duration {
+	return r.getRobots(url).CrawlDelay()
+}
+
+func (r *PersistentRobotPolicy) Sitemaps(url *url.URL) []*url.URL {
+	return r.getRobots(url).Sitemaps()
+}
+
+func (r *PersistentRobotPolicy) getRobots(url *url.URL) Robots {
+	key := origin(url)
+	anymu, _ := r.locks.LoadOrStore(key, &sync.Mutex{})
+	mu := anymu.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+	return r.loadRobots(key, url.Scheme, url.Hostname())
+}
+
+// Look for a fresh robots.txt in the cache then in the store, and only fetch it if
+// neither has one. Must be called with the lock of the key held.
+func (r *PersistentRobotPolicy) loadRobots(key string, scheme string, hostname string) Robots {
+	cached, ok := r.cache.Load(key)
+	if ok && cached.(Robots).IsFresh(r.ttl) {
+		return cached.(Robots)
+	}
+
+	stored, err := r.store.Load(r.ctx, scheme, hostname)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to load robot.txt of %s: %s", key, err))
+	}
+	if stored != nil && stored.IsFresh(r.ttl) {
+		r.cache.Store(key, *stored)
+		return *stored
+	}
+
+	robots := fetchRobots(r.ctx, r.client, scheme, hostname)
+	err = r.store.Save(r.ctx, scheme, hostname, robots)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to save robot.txt of %s: %s", key, err))
+	}
+	r.cache.Store(key, robots)
+	return robots
+}
@@ -0,0 +1,92 @@
+package robot
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/client"
+)
+
+type memoryRobotStore struct {
+	mu     sync.Mutex
+	robots map[string]Robots
+}
+
+func (s *memoryRobotStore) Load(ctx context.Context, scheme string, hostname string) (*Robots, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	robots, ok := s.robots[scheme+"://"+hostname]
+	if !ok {
+		return nil, nil
+	}
+	return &robots, nil
+}
+
+func (s *memoryRobotStore) Save(ctx context.Context, scheme string, hostname string, robots Robots) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.robots[scheme+"://"+hostname] = robots
+	return nil
+}
+
+func newRobotsTransport() *internal.MockTransport {
+	return internal.NewMockTransportWithCallback(nil, nil, func(m *internal.MockTransport) {
+		m.Response = &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{"Content-Type": []string{"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("User-agent: *\nDisallow: /private")),
+		}
+	})
+}
+
+func TestPersistentRobotPolicyShareStore(t *testing.T) {
+	t.Parallel()
+	store := &memoryRobotStore{robots: make(map[string]Robots)}
+	page := &url.URL{Scheme: "http", Host: "test.com", Path: "/private/page"}
+
+	mock := newRobotsTransport()
+	first := NewPersistentRobotPolicy(context.Background(), client.NewFetcher(&http.Client{Transport: mock}), store, time.Hour)
+	if first.IsAllowed(page) || first.IsAllowed(page) {
+		t.Fatal("robot.txt rule not respected")
+	}
+	if mock.NbCall != 1 {
+		t.Fatalf("robot.txt should be fetched once: got %d requests", mock.NbCall)
+	}
+
+	// A restarted process finds the stored robots.txt
+	mock = newRobotsTransport()
+	second := NewPersistentRobotPolicy(context.Background(), client.NewFetcher(&http.Client{Transport: mock}), store, time.Hour)
+	if second.IsAllowed(page) {
+		t.Fatal("stored robot.txt rule not respected")
+	}
+	if mock.NbCall != 0 {
+		t.Fatalf("stored robot.txt should not be fetched again: got %d requests", mock.NbCall)
+	}
+}
+
+func TestPersistentRobotPolicyRefreshAfterTTL(t *testing.T) {
+	t.Parallel()
+	store := &memoryRobotStore{robots: map[string]Robots{
+		"http://test.com": {Body: "", Status: 200, FetchedAt: time.Now().Add(-2 * time.Hour)},
+	}}
+	page := &url.URL{Scheme: "http", Host: "test.com", Path: "/private/page"}
+
+	mock := newRobotsTransport()
+	policy := NewPersistentRobotPolicy(context.Background(), client.NewFetcher(&http.Client{Transport: mock}), store, time.Hour)
+	if policy.IsAllowed(page) {
+		t.Fatal("expired robot.txt should be fetched again")
+	}
+	if mock.NbCall != 1 {
+		t.Fatalf("expired robot.txt should be fetched once: got %d requests", mock.NbCall)
+	}
+	if time.Since(store.robots["http://test.com"].FetchedAt) > time.Minute {
+		t.Fatal("the refreshed robot.txt was not saved")
+	}
+}
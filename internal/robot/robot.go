@@ -1,55 +1,123 @@
 package robot
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log/slog"
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/client"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/telemetry"
 	"github.com/jimsmart/grobotstxt"
 )
 
-const norobot = "#failed-to-get-robot.txt"
+// Following RFC 9309, a robots.txt that is unavailable (4xx) allows everything while
+// one that is unreachable (5xx or network error) disallows everything.
+const (
+	norobot     = "#failed-to-get-robot.txt"
+	disallowAll = "User-agent: *\nDisallow: /"
+)
+
+// Product token matched against the User-agent lines
+const userAgent = "BacklinksBot"
+
+const (
+	// Larger files are truncated, RFC 9309 requires parsing at least 500 KiB
+	maxRobotsSize = 500 * 1024
+	// Redirects followed before considering the robots.txt unavailable
+	maxRobotsRedirects = 5
+	// An unreachable robots.txt is fetched again after this delay instead of the TTL
+	unreachableRetry = time.Hour
+)
 
 type RobotPolicy interface {
 	IsAllowed(*url.URL) bool
+	// CrawlDelay returns the minimum time between two requests asked by the site, or 0.
+	CrawlDelay(*url.URL) time.Duration
+	// Sitemaps returns the sitemaps listed in the robots.txt of the url's scheme and host.
+	Sitemaps(*url.URL) []*url.URL
+}
+
+// Robots is the outcome of fetching the robots.txt of a scheme and host. Body is norobot
+// when the file is unavailable and disallowAll when it is unreachable, Status is 0 when
+// no response was received.
+type Robots struct {
+	Body      string
+	Status    int
+	FetchedAt time.Time
+}
+
+// IsFresh reports whether the robots.txt can still be used given the cache TTL, files
+// that were unreachable are retried sooner.
+func (r Robots) IsFresh(ttl time.Duration) bool {
+	if r.isUnreachable() {
+		ttl = min(ttl, unreachableRetry)
+	}
+	return time.Since(r.FetchedAt) < ttl
+}
+
+func (r Robots) isUnreachable() bool {
+	return r.Status == 0 || r.Status >= 500
 }
 
 type InMemoryRobotPolicy struct {
+	ctx           context.Context
 	client        client.Fetcher
+	ttl           time.Duration
 	locks         *sync.Map
 	robotPolicies *sync.Map
 }
 
-func NewInMemoryRobotPolicy(fetcher client.Fetcher) *InMemoryRobotPolicy {
+func NewInMemoryRobotPolicy(ctx context.Context, fetcher client.Fetcher, ttl time.Duration) *InMemoryRobotPolicy {
 	return &InMemoryRobotPolicy{
+		ctx:           ctx,
 		client:        fetcher,
+		ttl:           ttl,
 		locks:         &sync.Map{},
 		robotPolicies: &sync.Map{},
 	}
 }
 
 func (r *InMemoryRobotPolicy) IsAllowed(url *url.URL) bool {
+	return isAllowed(r.getRobots(url).Body, url)
+}
+
+func (r *InMemoryRobotPolicy) CrawlDelay(url *url.URL) time.Duration {
+	return r.getRobots(url).CrawlDelay()
+}
+
+func (r *InMemoryRobotPolicy) Sitemaps(url *url.URL) []*url.URL {
+	return r.getRobots(url).Sitemaps()
+}
+
+func (r *InMemoryRobotPolicy) getRobots(url *url.URL) Robots {
 	// This double locking kind of terrible but I could not find a better way to escure
 	// strictly one execution of getRobotPolicy (to use LoadOrStore you must have the value
 	// before hand but what i want is actually the fetch the value only if needed)
-	hostname := url.Hostname()
-	anymu, _ := r.locks.LoadOrStore(hostname, &sync.Mutex{})
+	key := origin(url)
+	anymu, _ := r.locks.LoadOrStore(key, &sync.Mutex{})
 	mu := anymu.(*sync.Mutex)
 	mu.Lock()
-	robotTxt, ok := r.robotPolicies.Load(hostname)
-	if !ok {
-		robotTxt = r.getRobotPolicy(hostname)
-		r.robotPolicies.Store(hostname, robotTxt)
+	robots, ok := r.robotPolicies.Load(key)
+	if !ok || !robots.(Robots).IsFresh(r.ttl) {
+		robots = fetchRobots(r.ctx, r.client, url.Scheme, url.Hostname())
+		r.robotPolicies.Store(key, robots)
 	}
 	mu.Unlock()
 
-	robotTxtStr := robotTxt.(string)
-	isAllowed := grobotstxt.AgentAllowed(robotTxtStr, "BacklinksBot", url.String())
+	return robots.(Robots)
+}
+
+// robots.txt files apply to a single scheme and host
+func origin(url *url.URL) string {
+	return url.Scheme + "://" + url.Hostname()
+}
+
+func isAllowed(robotTxt string, url *url.URL) bool {
+	isAllowed := grobotstxt.AgentAllowed(robotTxt, userAgent, url.String())
 	if isAllowed {
 		telemetry.RobotDisallowed.Add(1)
 	} else {
@@ -58,30 +126,49 @@ func (r *InMemoryRobotPolicy) IsAllowed(url *url.URL) bool {
 	return isAllowed
 }
 
-func (r *InMemoryRobotPolicy) getRobotPolicy(hostname string) string {
-	resp, err := r.client.Get("http://" + hostname + "/robots.txt")
+func fetchRobots(ctx context.Context, fetcher client.Fetcher, scheme string, hostname string) Robots {
+	robots := Robots{Body: disallowAll, FetchedAt: time.Now()}
+	result, err := fetcher.Fetch(ctx, client.FetchRequest{
+		URL:          scheme + "://" + hostname + "/robots.txt",
+		MaxBodySize:  maxRobotsSize,
+		MaxRedirects: maxRobotsRedirects,
+	})
+	if result.Err != nil && result.Err.Kind == client.ErrorTooManyRedirects {
+		slog.Warn(fmt.Sprintf("failed to get robot.txt for %s: too many redirects", hostname))
+		robots.Body = norobot
+		robots.Status = result.Status
+		return robots
+	}
 	if err != nil {
 		slog.Warn(fmt.Sprintf("failed to get robot.txt for %s: %s", hostname, err))
-		return norobot
+		return robots
+	}
+	robots.Status = result.Status
+
+	if result.Status >= 500 {
+		slog.Warn(fmt.Sprintf("failed to get robot.txt for %s: response with status %d", hostname, result.Status))
+		return robots
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		slog.Warn(fmt.Sprintf("failed to get robot.txt for %s: response with status %d", hostname, resp.StatusCode))
-		return norobot
+	// Anything else than a success, including too many redirects, means there is no
+	// robots.txt to respect
+	robots.Body = norobot
+	if result.Status < 200 || result.Status >= 300 {
+		slog.Debug(fmt.Sprintf("no robot.txt for %s: response with status %d", hostname, result.Status))
+		return robots
+	}
+	// Fetchers other than the crawl client follow more redirects
+	if len(result.Redirects) > maxRobotsRedirects {
+		slog.Warn(fmt.Sprintf("failed to get robot.txt for %s: too many redirects", hostname))
+		return robots
 	}
 
-	contentType := strings.ToLower(resp.Header.Get("content-Type"))
+	contentType := strings.ToLower(result.Header.Get("content-Type"))
 	if !strings.Contains(contentType, "text/plain") {
 		slog.Warn(fmt.Sprintf("failed to get robot.txt for %s: response with content-type %s", hostname, contentType))
-		return norobot
+		return robots
 	}
 
-	data := make([]byte, 512*1024)
-	n, err := resp.Body.Read(data)
-	if err != nil && err != io.EOF {
-		slog.Warn(fmt.Sprintf("failed to get robot.txt for %s: failed to read body: %s", hostname, err))
-		return norobot
-	}
-	return string(data[:n])
+	robots.Body = string(result.Body)
+	return robots
 }
@@ -1,13 +1,20 @@
 package robot
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/TheBigRoomXXL/backlinks-engine/internal"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/client"
 )
 
 func TestRobotGetPolicySuccess(t *testing.T) {
@@ -23,40 +30,54 @@ func TestRobotGetPolicySuccess(t *testing.T) {
 	response := recorder.Result()
 
 	mock := internal.NewMockTransport(response, nil)
-	client := &http.Client{Transport: mock}
-	robot := NewInMemoryRobotPolicy(client)
+	fetcher := client.NewFetcher(&http.Client{Transport: mock})
 
 	// Test
-	result := robot.getRobotPolicy("test.com")
-	if result != policy {
-		t.Fatalf("failed to get robot.txt: want '%s'; got'%s'\n (length %d vs %d)", policy, result, len(policy), len(result))
+	result := fetchRobots(context.Background(), fetcher, "http", "test.com")
+	if result.Body != policy {
+		t.Fatalf("failed to get robot.txt: want '%s'; got'%s'\n (length %d vs %d)", policy, result.Body, len(policy), len(result.Body))
 	}
 }
 
 func TestRobotGetPolicyBadResponseStatus(t *testing.T) {
-	badStatus := []int{400, 401, 402, 403, 404, 405, 406, 407, 408, 425, 429, 409, 410, 411, 412, 413, 414, 415, 416, 417, 418, 421, 422, 423, 501, 505, 506, 507, 508, 510, 511, 500, 502, 503, 504}
+	unavailable := []int{400, 401, 402, 403, 404, 405, 406, 407, 408, 425, 429, 409, 410, 411, 412, 413, 414, 415, 416, 417, 418, 421, 422, 423}
+	unreachable := []int{501, 505, 506, 507, 508, 510, 511, 500, 502, 503, 504}
 	// Setup
-	for _, statusCode := range badStatus {
+	for _, statusCode := range append(unavailable, unreachable...) {
 		t.Run("Robot handle "+strconv.Itoa(statusCode), func(t *testing.T) {
 			t.Parallel()
 			recorder := httptest.NewRecorder()
 			recorder.Header().Set("Content-type", "text/plain")
-			recorder.WriteHeader(500)
+			recorder.WriteHeader(statusCode)
 			response := recorder.Result()
 
 			mock := internal.NewMockTransport(response, nil)
-			client := &http.Client{Transport: mock}
-			robot := NewInMemoryRobotPolicy(client)
+			fetcher := client.NewFetcher(&http.Client{Transport: mock})
 
 			// Test
-			result := robot.getRobotPolicy("test.com")
-			if result != norobot {
-				t.Fatalf("failed to handle bad status: want '%s'; got '%s'\n", norobot, result)
+			expect := norobot
+			if statusCode >= 500 {
+				expect = disallowAll
+			}
+			result := fetchRobots(context.Background(), fetcher, "http", "test.com")
+			if result.Body != expect || result.Status != statusCode {
+				t.Fatalf("failed to handle bad status: want '%s'; got '%s' (status %d)\n", expect, result.Body, result.Status)
 			}
 		})
 	}
 }
 
+func TestRobotGetPolicyUnreachable(t *testing.T) {
+	t.Parallel()
+	mock := internal.NewMockTransport(nil, errors.New("connection refused"))
+	fetcher := client.NewFetcher(&http.Client{Transport: mock})
+
+	result := fetchRobots(context.Background(), fetcher, "http", "test.com")
+	if result.Body != disallowAll || result.Status != 0 {
+		t.Fatalf("failed to handle unreachable host: want '%s'; got '%s' (status %d)", disallowAll, result.Body, result.Status)
+	}
+}
+
 func TestRobotGetPolicyBadContentType(t *testing.T) {
 	badContentType := []string{"text/html", "application/json"}
 	// Setup
@@ -65,17 +86,131 @@ func TestRobotGetPolicyBadContentType(t *testing.T) {
 			t.Parallel()
 			recorder := httptest.NewRecorder()
 			recorder.Header().Set("Content-type", ct)
-			recorder.WriteHeader(500)
+			recorder.WriteHeader(200)
 			response := recorder.Result()
 
 			mock := internal.NewMockTransport(response, nil)
-			client := &http.Client{Transport: mock}
-			robot := NewInMemoryRobotPolicy(client)
+			fetcher := client.NewFetcher(&http.Client{Transport: mock})
 
 			// Test
-			result := robot.getRobotPolicy("test.com")
-			if result != norobot {
-				t.Fatalf("failed to handle bad status: want '%s'; got '%s'\n", norobot, result)
+			result := fetchRobots(context.Background(), fetcher, "http", "test.com")
+			if result.Body != norobot {
+				t.Fatalf("failed to handle bad content-type: want '%s'; got '%s'\n", norobot, result.Body)
+			}
+		})
+	}
+}
+
+func TestRobotGetPolicyTruncate(t *testing.T) {
+	t.Parallel()
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("Content-type", "text/plain")
+	recorder.WriteHeader(200)
+	recorder.WriteString(strings.Repeat("# comment\n", maxRobotsSize))
+	response := recorder.Result()
+
+	mock := internal.NewMockTransport(response, nil)
+	fetcher := client.NewFetcher(&http.Client{Transport: mock})
+
+	result := fetchRobots(context.Background(), fetcher, "http", "test.com")
+	if len(result.Body) != maxRobotsSize {
+		t.Fatalf("failed to truncate robot.txt: want %d bytes; got %d", maxRobotsSize, len(result.Body))
+	}
+}
+
+func TestRobotGetPolicyTooManyRedirects(t *testing.T) {
+	t.Parallel()
+	recorder := httptest.NewRecorder()
+	recorder.Header().Set("Content-type", "text/plain")
+	recorder.WriteHeader(200)
+	recorder.WriteString("User-agent: *\nDisallow: /")
+	response := recorder.Result()
+
+	// Chain the requests as the http client does when it follows redirects
+	request := &http.Request{URL: &url.URL{Scheme: "http", Host: "test.com", Path: "/robots.txt"}}
+	for i := 0; i < maxRobotsRedirects+1; i++ {
+		next := &url.URL{Scheme: "http", Host: "test.com", Path: "/robots" + strconv.Itoa(i) + ".txt"}
+		request = &http.Request{URL: next, Response: &http.Response{StatusCode: 301, Request: request}}
+	}
+	response.Request = request
+
+	mock := internal.NewMockTransport(response, nil)
+	fetcher := client.NewFetcher(&http.Client{Transport: mock})
+
+	result := fetchRobots(context.Background(), fetcher, "http", "test.com")
+	if result.Body != norobot {
+		t.Fatalf("failed to handle too many redirects: want '%s'; got '%s'", norobot, result.Body)
+	}
+}
+
+func TestRobotGetPolicyRedirectLimit(t *testing.T) {
+	t.Parallel()
+	// Six redirects lead to the robots.txt, one more than allowed by RFC 9309
+	var final atomic.Int32
+	mux := http.NewServeMux()
+	mux.Handle("/robots.txt", http.RedirectHandler("/robots1.txt", http.StatusMovedPermanently))
+	for i := 1; i < 6; i++ {
+		mux.Handle("/robots"+strconv.Itoa(i)+".txt", http.RedirectHandler("/robots"+strconv.Itoa(i+1)+".txt", http.StatusMovedPermanently))
+	}
+	mux.HandleFunc("/robots6.txt", func(w http.ResponseWriter, req *http.Request) {
+		final.Add(1)
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "User-agent: *\nDisallow: /")
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	serverUrl, _ := url.Parse(server.URL)
+
+	result := fetchRobots(context.Background(), client.NewCrawlClient(context.Background(), 0, 0, nil), "http", serverUrl.Host)
+	if result.Body != norobot || result.Status != http.StatusMovedPermanently {
+		t.Fatalf("failed to stop after %d redirects: want '%s'; got '%s' (status %d)", maxRobotsRedirects, norobot, result.Body, result.Status)
+	}
+	if final.Load() != 0 {
+		t.Fatal("the sixth redirect should not be followed")
+	}
+}
+
+func TestRobotGetPolicyRedirectLoop(t *testing.T) {
+	t.Parallel()
+	// The client stops following the redirects and returns the last one
+	mock := internal.NewMockTransport(&http.Response{
+		StatusCode: 302,
+		Header:     http.Header{"Location": {"/robots.txt"}},
+		Body:       http.NoBody,
+	}, nil)
+	fetcher := client.NewFetcher(&http.Client{
+		Transport: mock,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return client.ErrTooManyRedirects
+		},
+	})
+
+	result := fetchRobots(context.Background(), fetcher, "http", "test.com")
+	if result.Body != norobot || result.Status != 302 || mock.NbCall != 1 {
+		t.Fatalf("failed to handle a redirect loop: want '%s'; got '%s' (status %d)", norobot, result.Body, result.Status)
+	}
+}
+
+func TestRobotIsFresh(t *testing.T) {
+	tests := map[string]struct {
+		status int
+		age    time.Duration
+		fresh  bool
+	}{
+		"success":             {status: 200, age: 2 * time.Hour, fresh: true},
+		"expired success":     {status: 200, age: 25 * time.Hour, fresh: false},
+		"unavailable":         {status: 404, age: 2 * time.Hour, fresh: true},
+		"unreachable":         {status: 503, age: 10 * time.Minute, fresh: true},
+		"retry unreachable":   {status: 503, age: 2 * time.Hour, fresh: false},
+		"retry network error": {status: 0, age: 2 * time.Hour, fresh: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			robots := Robots{Status: test.status, FetchedAt: time.Now().Add(-test.age)}
+			if robots.IsFresh(24*time.Hour) != test.fresh {
+				t.Fatalf("bad freshness: want %t; got %t", test.fresh, !test.fresh)
 			}
 		})
 	}
@@ -92,6 +227,16 @@ func TestRobotIsAllowed(t *testing.T) {
 			robotTxt:  "",
 			IsAllowed: true,
 		},
+		"unavailable robot.txt": {
+			path:      "/",
+			robotTxt:  norobot,
+			IsAllowed: true,
+		},
+		"unreachable robot.txt": {
+			path:      "/",
+			robotTxt:  disallowAll,
+			IsAllowed: false,
+		},
 		"dIsAllowed all": {
 			path:      "/",
 			robotTxt:  "User-agent: *\nDisallow: /",
@@ -133,8 +278,8 @@ func TestRobotIsAllowed(t *testing.T) {
 		t.Run(name, func(t *testing.T) {
 			t.Parallel()
 			// Setup
-			robot := NewInMemoryRobotPolicy(http.DefaultClient)
-			robot.robotPolicies.Store("test.com", test.robotTxt)
+			robot := NewInMemoryRobotPolicy(context.Background(), client.NewFetcher(http.DefaultClient), 24*time.Hour)
+			robot.robotPolicies.Store("http://test.com", Robots{Body: test.robotTxt, Status: 200, FetchedAt: time.Now()})
 
 			url := &url.URL{Scheme: "http", Host: "test.com", Path: test.path}
 			result := robot.IsAllowed(url)
@@ -145,3 +290,17 @@ func TestRobotIsAllowed(t *testing.T) {
 
 	}
 }
+
+func TestRobotPerScheme(t *testing.T) {
+	t.Parallel()
+	robot := NewInMemoryRobotPolicy(context.Background(), client.NewFetcher(http.DefaultClient), 24*time.Hour)
+	robot.robotPolicies.Store("http://test.com", Robots{Body: "User-agent: *\nDisallow: /", Status: 200, FetchedAt: time.Now()})
+	robot.robotPolicies.Store("https://test.com", Robots{Body: "", Status: 200, FetchedAt: time.Now()})
+
+	if robot.IsAllowed(&url.URL{Scheme: "http", Host: "test.com", Path: "/"}) {
+		t.Fatal("the robot.txt of http was not respected")
+	}
+	if !robot.IsAllowed(&url.URL{Scheme: "https", Host: "test.com", Path: "/"}) {
+		t.Fatal("the robot.txt of http was applied to https")
+	}
+}
@@ -2,6 +2,7 @@ package settings
 
 import (
 	"log/slog"
+	"net/url"
 	"os"
 	"strconv"
 	"sync"
@@ -12,18 +13,34 @@ import (
 )
 
 type Settings struct {
-	DB_USER                string
-	DB_PASSWORD            string
-	DB_HOSTNAME            string
-	DB_PORT                string
-	DB_NAME                string
-	DB_OPTIONS             string
-	HTTP_TIMEOUT           time.Duration // in seconds
-	HTTP_RATE_LIMIT        rate.Limit    // per domaine rate limit in req/s
-	HTTP_MAX_RETRY         int
-	CRAWLER_MAX_CONCURENCY int
-	LOG_PATH               string
-	TELEMETRY_PORT         string
+	DB_USER                 string
+	DB_PASSWORD             string
+	DB_HOSTNAME             string
+	DB_PORT                 string
+	DB_NAME                 string
+	DB_OPTIONS              string
+	DB_AUTO_MIGRATE         bool          // apply pending migrations when the crawler starts
+	DB_BATCH_SIZE           int           // number of rows buffered before a bulk insert
+	DB_FLUSH_INTERVAL       time.Duration // in milliseconds, max time a partial batch is buffered
+	DB_LEASE_DURATION       time.Duration // in seconds, time a crawler has to report a page
+	STORAGE_BACKEND         string        // postgres or memory
+	HTTP_TIMEOUT            time.Duration // in seconds
+	HTTP_RATE_LIMIT         rate.Limit    // per domaine rate limit in req/s
+	HTTP_RATE_LIMIT_MIN     rate.Limit    // per domaine rate limit in req/s that adaptive slowing down never goes below
+	HTTP_RATE_LIMIT_DOMAIN  rate.Limit    // rate limit in req/s shared by the hosts of a registrable domain
+	HTTP_RATE_LIMIT_IP      rate.Limit    // rate limit in req/s shared by the hosts of an IP address
+	HTTP_MAX_RETRY          int
+	CRAWLER_MAX_CONCURENCY  int
+	CRAWLER_REVISIT_MIN     time.Duration // in hours, min time between two visits of a page
+	CRAWLER_REVISIT_MAX     time.Duration // in hours, max time between two visits, 0 to never revisit
+	CRAWLER_LINK_MAX_MISSES int           // crawls in a row a link can be missing before its deletion, 0 to never delete
+	CRAWLER_ROBOTS_TTL      time.Duration // in hours, time before a robots.txt is fetched again
+	CRAWLER_FEED_POLL_MIN   time.Duration // in minutes, min time between two polls of a feed
+	CRAWLER_FEED_POLL_MAX   time.Duration // in minutes, max time between two polls of a feed
+	LOG_PATH                string
+	TELEMETRY_PORT          string
+	API_PORT                string
+	WEBSUB_CALLBACK_URL     *url.URL // public url of the API server for the WebSub hubs, nil to disable WebSub
 }
 
 var (
@@ -80,6 +97,70 @@ func initSettings() {
 		dbName = ""
 	}
 
+	var dbAutoMigrate bool
+	dbAutoMigrateStr, ok := os.LookupEnv("DB_AUTO_MIGRATE")
+	if !ok {
+		dbAutoMigrate = true
+	} else {
+		dbAutoMigrate, err = strconv.ParseBool(dbAutoMigrateStr)
+		if err != nil {
+			initOk = false
+			slog.Warn("failed to parse DB_AUTO_MIGRATE as a bool (defaulting to true): " + err.Error())
+			dbAutoMigrate = true
+		}
+	}
+
+	var dbBatchSize int
+	dbBatchSizeStr, ok := os.LookupEnv("DB_BATCH_SIZE")
+	if !ok {
+		dbBatchSize = 4096
+	} else {
+		dbBatchSize, err = strconv.Atoi(dbBatchSizeStr)
+		if err != nil || dbBatchSize < 1 {
+			initOk = false
+			slog.Warn("failed to parse DB_BATCH_SIZE as a positive int (defaulting to 4096): " + dbBatchSizeStr)
+			dbBatchSize = 4096
+		}
+	}
+
+	var dbFlushInterval time.Duration
+	dbFlushIntervalStr, ok := os.LookupEnv("DB_FLUSH_INTERVAL")
+	if !ok {
+		dbFlushInterval = 1000 * time.Millisecond
+	} else {
+		i, err := strconv.Atoi(dbFlushIntervalStr)
+		if err != nil || i < 1 {
+			initOk = false
+			slog.Warn("failed to parse DB_FLUSH_INTERVAL as a positive int (defaulting to 1000ms): " + dbFlushIntervalStr)
+			i = 1000
+		}
+		dbFlushInterval = time.Duration(i * int(time.Millisecond))
+	}
+
+	var dbLeaseDuration time.Duration
+	dbLeaseDurationStr, ok := os.LookupEnv("DB_LEASE_DURATION")
+	if !ok {
+		dbLeaseDuration = 600 * time.Second
+	} else {
+		i, err := strconv.Atoi(dbLeaseDurationStr)
+		if err != nil || i < 1 {
+			initOk = false
+			slog.Warn("failed to parse DB_LEASE_DURATION as a positive int (defaulting to 600s): " + dbLeaseDurationStr)
+			i = 600
+		}
+		dbLeaseDuration = time.Duration(i * int(time.Second))
+	}
+
+	storageBackend, ok := os.LookupEnv("STORAGE_BACKEND")
+	if !ok {
+		storageBackend = "postgres"
+	}
+	if storageBackend != "postgres" && storageBackend != "memory" {
+		initOk = false
+		slog.Warn("STORAGE_BACKEND must be postgres or memory (defaulting to postgres): " + storageBackend)
+		storageBackend = "postgres"
+	}
+
 	var httpTimeout time.Duration
 	httpTimeoutStr, ok := os.LookupEnv("HTTP_TIMEOUT")
 	if !ok {
@@ -111,6 +192,52 @@ func initSettings() {
 		httpRateLimit = rate.Limit(rate.Every(time.Duration(i * int(time.Millisecond))))
 	}
 
+	var httpRateLimitMin rate.Limit
+	httpRateLimitMinStr, ok := os.LookupEnv("HTTP_RATE_LIMIT_MIN")
+	if !ok {
+		httpRateLimitMin = rate.Limit(rate.Every(60000 * time.Millisecond))
+	} else {
+		i, err := strconv.Atoi(httpRateLimitMinStr)
+		if err != nil {
+			initOk = false
+			slog.Warn("failed to parse HTTP_RATE_LIMIT_MIN as an int (defaulting to 60000ms): " + err.Error())
+			i = 60000
+		}
+		httpRateLimitMin = rate.Limit(rate.Every(time.Duration(i * int(time.Millisecond))))
+	}
+	if httpRateLimitMin > httpRateLimit {
+		slog.Warn("HTTP_RATE_LIMIT_MIN is faster than HTTP_RATE_LIMIT (defaulting to HTTP_RATE_LIMIT)")
+		httpRateLimitMin = httpRateLimit
+	}
+
+	var httpRateLimitDomain rate.Limit
+	httpRateLimitDomainStr, ok := os.LookupEnv("HTTP_RATE_LIMIT_DOMAIN")
+	if !ok {
+		httpRateLimitDomain = rate.Limit(rate.Every(1000 * time.Millisecond))
+	} else {
+		i, err := strconv.Atoi(httpRateLimitDomainStr)
+		if err != nil {
+			initOk = false
+			slog.Warn("failed to parse HTTP_RATE_LIMIT_DOMAIN as an int (defaulting to 1000ms): " + err.Error())
+			i = 1000
+		}
+		httpRateLimitDomain = rate.Limit(rate.Every(time.Duration(i * int(time.Millisecond))))
+	}
+
+	var httpRateLimitIP rate.Limit
+	httpRateLimitIPStr, ok := os.LookupEnv("HTTP_RATE_LIMIT_IP")
+	if !ok {
+		httpRateLimitIP = rate.Limit(rate.Every(200 * time.Millisecond))
+	} else {
+		i, err := strconv.Atoi(httpRateLimitIPStr)
+		if err != nil {
+			initOk = false
+			slog.Warn("failed to parse HTTP_RATE_LIMIT_IP as an int (defaulting to 200ms): " + err.Error())
+			i = 200
+		}
+		httpRateLimitIP = rate.Limit(rate.Every(time.Duration(i * int(time.Millisecond))))
+	}
+
 	var httpMaxRetry int
 	httpMaxRetryStr, ok := os.LookupEnv("HTTP_MAX_RETRY")
 	if !ok {
@@ -137,6 +264,99 @@ func initSettings() {
 		}
 	}
 
+	var crawlerRevisitMin time.Duration
+	crawlerRevisitMinStr, ok := os.LookupEnv("CRAWLER_REVISIT_MIN")
+	if !ok {
+		crawlerRevisitMin = 24 * time.Hour
+	} else {
+		i, err := strconv.Atoi(crawlerRevisitMinStr)
+		if err != nil || i < 1 {
+			initOk = false
+			slog.Warn("failed to parse CRAWLER_REVISIT_MIN as a positive int (defaulting to 24h): " + crawlerRevisitMinStr)
+			i = 24
+		}
+		crawlerRevisitMin = time.Duration(i * int(time.Hour))
+	}
+
+	var crawlerRevisitMax time.Duration
+	crawlerRevisitMaxStr, ok := os.LookupEnv("CRAWLER_REVISIT_MAX")
+	if !ok {
+		crawlerRevisitMax = 720 * time.Hour
+	} else {
+		i, err := strconv.Atoi(crawlerRevisitMaxStr)
+		if err != nil || i < 0 {
+			initOk = false
+			slog.Warn("failed to parse CRAWLER_REVISIT_MAX as an int (defaulting to 720h): " + crawlerRevisitMaxStr)
+			i = 720
+		}
+		crawlerRevisitMax = time.Duration(i * int(time.Hour))
+	}
+	if crawlerRevisitMax != 0 && crawlerRevisitMax < crawlerRevisitMin {
+		initOk = false
+		slog.Warn("CRAWLER_REVISIT_MAX is lower than CRAWLER_REVISIT_MIN (using CRAWLER_REVISIT_MIN for both)")
+		crawlerRevisitMax = crawlerRevisitMin
+	}
+
+	var crawlerLinkMaxMisses int
+	crawlerLinkMaxMissesStr, ok := os.LookupEnv("CRAWLER_LINK_MAX_MISSES")
+	if !ok {
+		crawlerLinkMaxMisses = 3
+	} else {
+		crawlerLinkMaxMisses, err = strconv.Atoi(crawlerLinkMaxMissesStr)
+		if err != nil || crawlerLinkMaxMisses < 0 {
+			initOk = false
+			slog.Warn("failed to parse CRAWLER_LINK_MAX_MISSES as a positive int (defaulting to 3): " + crawlerLinkMaxMissesStr)
+			crawlerLinkMaxMisses = 3
+		}
+	}
+
+	var crawlerRobotsTTL time.Duration
+	crawlerRobotsTTLStr, ok := os.LookupEnv("CRAWLER_ROBOTS_TTL")
+	if !ok {
+		crawlerRobotsTTL = 24 * time.Hour
+	} else {
+		i, err := strconv.Atoi(crawlerRobotsTTLStr)
+		if err != nil || i < 1 {
+			initOk = false
+			slog.Warn("failed to parse CRAWLER_ROBOTS_TTL as a positive int (defaulting to 24h): " + crawlerRobotsTTLStr)
+			i = 24
+		}
+		crawlerRobotsTTL = time.Duration(i * int(time.Hour))
+	}
+
+	var crawlerFeedPollMin time.Duration
+	crawlerFeedPollMinStr, ok := os.LookupEnv("CRAWLER_FEED_POLL_MIN")
+	if !ok {
+		crawlerFeedPollMin = 15 * time.Minute
+	} else {
+		i, err := strconv.Atoi(crawlerFeedPollMinStr)
+		if err != nil || i < 1 {
+			initOk = false
+			slog.Warn("failed to parse CRAWLER_FEED_POLL_MIN as a positive int (defaulting to 15min): " + crawlerFeedPollMinStr)
+			i = 15
+		}
+		crawlerFeedPollMin = time.Duration(i * int(time.Minute))
+	}
+
+	var crawlerFeedPollMax time.Duration
+	crawlerFeedPollMaxStr, ok := os.LookupEnv("CRAWLER_FEED_POLL_MAX")
+	if !ok {
+		crawlerFeedPollMax = 1440 * time.Minute
+	} else {
+		i, err := strconv.Atoi(crawlerFeedPollMaxStr)
+		if err != nil || i < 1 {
+			initOk = false
+			slog.Warn("failed to parse CRAWLER_FEED_POLL_MAX as a positive int (defaulting to 1440min): " + crawlerFeedPollMaxStr)
+			i = 1440
+		}
+		crawlerFeedPollMax = time.Duration(i * int(time.Minute))
+	}
+	if crawlerFeedPollMax < crawlerFeedPollMin {
+		initOk = false
+		slog.Warn("CRAWLER_FEED_POLL_MAX is lower than CRAWLER_FEED_POLL_MIN (using CRAWLER_FEED_POLL_MIN for both)")
+		crawlerFeedPollMax = crawlerFeedPollMin
+	}
+
 	logPath, ok := os.LookupEnv("LOG_PATH")
 	if !ok {
 		logPath = "errors.log"
@@ -147,18 +367,50 @@ func initSettings() {
 		telemetryPort = "4009"
 	}
 
+	apiPort, ok := os.LookupEnv("API_PORT")
+	if !ok {
+		apiPort = "4013"
+	}
+
+	var websubCallbackUrl *url.URL
+	websubCallbackUrlStr, ok := os.LookupEnv("WEBSUB_CALLBACK_URL")
+	if ok && websubCallbackUrlStr != "" {
+		websubCallbackUrl, err = url.Parse(websubCallbackUrlStr)
+		if err != nil || (websubCallbackUrl.Scheme != "http" && websubCallbackUrl.Scheme != "https") {
+			initOk = false
+			slog.Warn("failed to parse WEBSUB_CALLBACK_URL as an http url (disabling WebSub): " + websubCallbackUrlStr)
+			websubCallbackUrl = nil
+		}
+	}
+
 	settings = &Settings{
-		DB_USER:                dbUser,
-		DB_PASSWORD:            dbPassword,
-		DB_HOSTNAME:            dbHostname,
-		DB_PORT:                dbPort,
-		DB_NAME:                dbName,
-		DB_OPTIONS:             dbOptions,
-		HTTP_TIMEOUT:           httpTimeout,
-		HTTP_RATE_LIMIT:        httpRateLimit,
-		HTTP_MAX_RETRY:         httpMaxRetry,
-		CRAWLER_MAX_CONCURENCY: crawlerMaxConcurency,
-		LOG_PATH:               logPath,
-		TELEMETRY_PORT:         telemetryPort,
+		DB_USER:                 dbUser,
+		DB_PASSWORD:             dbPassword,
+		DB_HOSTNAME:             dbHostname,
+		DB_PORT:                 dbPort,
+		DB_NAME:                 dbName,
+		DB_OPTIONS:              dbOptions,
+		DB_AUTO_MIGRATE:         dbAutoMigrate,
+		DB_BATCH_SIZE:           dbBatchSize,
+		DB_FLUSH_INTERVAL:       dbFlushInterval,
+		DB_LEASE_DURATION:       dbLeaseDuration,
+		STORAGE_BACKEND:         storageBackend,
+		HTTP_TIMEOUT:            httpTimeout,
+		HTTP_RATE_LIMIT:         httpRateLimit,
+		HTTP_RATE_LIMIT_MIN:     httpRateLimitMin,
+		HTTP_RATE_LIMIT_DOMAIN:  httpRateLimitDomain,
+		HTTP_RATE_LIMIT_IP:      httpRateLimitIP,
+		HTTP_MAX_RETRY:          httpMaxRetry,
+		CRAWLER_MAX_CONCURENCY:  crawlerMaxConcurency,
+		CRAWLER_REVISIT_MIN:     crawlerRevisitMin,
+		CRAWLER_REVISIT_MAX:     crawlerRevisitMax,
+		CRAWLER_LINK_MAX_MISSES: crawlerLinkMaxMisses,
+		CRAWLER_ROBOTS_TTL:      crawlerRobotsTTL,
+		CRAWLER_FEED_POLL_MIN:   crawlerFeedPollMin,
+		CRAWLER_FEED_POLL_MAX:   crawlerFeedPollMax,
+		LOG_PATH:                logPath,
+		TELEMETRY_PORT:          telemetryPort,
+		API_PORT:                apiPort,
+		WEBSUB_CALLBACK_URL:     websubCallbackUrl,
 	}
 }
@@ -0,0 +1,101 @@
+package sitemap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+
+	clientpkg "github.com/TheBigRoomXXL/backlinks-engine/internal/client"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+// Sitemap indexes should not list other indexes but some do, deeper sitemaps are ignored
+const maxIndexDepth = 2
+
+// Hinter receives the pages found in sitemaps, like controller.Controller.
+type Hinter interface {
+	Hint(hints []*commons.PageHint)
+}
+
+// Processor hands the pages of sitemaps to the controller with their lastmod and
+// priority.
+type Processor struct {
+	ctx        context.Context
+	fetcher    clientpkg.Fetcher
+	controller Hinter
+}
+
+func NewProcessor(ctx context.Context, fetcher clientpkg.Fetcher, controller Hinter) *Processor {
+	return &Processor{ctx: ctx, fetcher: fetcher, controller: controller}
+}
+
+// Process parses the sitemap found at u and hints its pages to the controller. If it is an
+// index, the sitemaps it lists are returned so the caller can decide how to fetch them. The
+// pages of a sitemap that is too large are still hinted. Like sitemaps.org requires, the
+// urls of another host than the one of the sitemap are ignored, unless u is nil like for
+// a local file.
+func (p *Processor) Process(u *url.URL, body io.Reader) ([]*url.URL, error) {
+	sitemap, err := Parse(body)
+	if sitemap == nil {
+		return nil, err
+	}
+	onHost := func(v *url.URL) bool {
+		return u == nil || strings.EqualFold(u.Host, v.Host)
+	}
+
+	pages := make([]*commons.PageHint, 0, len(sitemap.Pages))
+	for _, page := range sitemap.Pages {
+		if onHost(page.URL) {
+			pages = append(pages, page)
+		}
+	}
+	sitemaps := make([]*url.URL, 0, len(sitemap.Sitemaps))
+	for _, s := range sitemap.Sitemaps {
+		if onHost(s) {
+			sitemaps = append(sitemaps, s)
+		}
+	}
+	if ignored := len(sitemap.Pages) + len(sitemap.Sitemaps) - len(pages) - len(sitemaps); ignored > 0 {
+		slog.Warn(fmt.Sprintf("ignoring %d urls of sitemap %s: not on its host", ignored, u))
+	}
+
+	p.controller.Hint(pages)
+	return sitemaps, err
+}
+
+// Fetch downloads and processes a sitemap then, if it is an index, the sitemaps it lists.
+func (p *Processor) Fetch(u *url.URL) error {
+	return p.fetch(u, 0)
+}
+
+func (p *Processor) fetch(u *url.URL, depth int) error {
+	result, err := p.fetcher.Fetch(p.ctx, clientpkg.FetchRequest{URL: u.String(), MaxBodySize: MaxSize})
+	if err != nil {
+		return fmt.Errorf("failed to get sitemap %s: %w", u, err)
+	}
+	if result.Status < 200 || result.Status > 299 {
+		return fmt.Errorf("failed to get sitemap %s: response with status %d", u, result.Status)
+	}
+
+	sitemaps, err := p.Process(u, bytes.NewReader(result.Body))
+	if err != nil {
+		return fmt.Errorf("failed to process sitemap %s: %w", u, err)
+	}
+	if depth >= maxIndexDepth {
+		if len(sitemaps) > 0 {
+			slog.Warn(fmt.Sprintf("ignoring the sitemaps listed by %s: index nested too deep", u))
+		}
+		return nil
+	}
+	for _, sitemap := range sitemaps {
+		err := p.fetch(sitemap, depth+1)
+		if err != nil {
+			slog.Warn(err.Error())
+		}
+	}
+	return nil
+}
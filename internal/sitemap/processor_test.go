@@ -0,0 +1,87 @@
+package sitemap
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	clientpkg "github.com/TheBigRoomXXL/backlinks-engine/internal/client"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+type recordingHinter struct {
+	hints []*commons.PageHint
+}
+
+func (r *recordingHinter) Hint(hints []*commons.PageHint) {
+	r.hints = append(r.hints, hints...)
+}
+
+// Serve fixed documents, everything else is a 404
+type documentsTransport map[string][]byte
+
+func (d documentsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	body, ok := d[req.URL.String()]
+	if !ok {
+		recorder.WriteHeader(404)
+	} else {
+		recorder.WriteHeader(200)
+		recorder.Write(body)
+	}
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+func TestProcessorFetchIndex(t *testing.T) {
+	t.Parallel()
+	fetcher := clientpkg.NewFetcher(&http.Client{Transport: documentsTransport{
+		"http://test.com/index.xml":       []byte(index),
+		"http://test.com/sitemap1.xml":    []byte("http://test.com/one\n"),
+		"http://test.com/sitemap2.xml.gz": gzipped(t, urlset),
+	}})
+	hinter := &recordingHinter{}
+	processor := NewProcessor(context.Background(), fetcher, hinter)
+
+	err := processor.Fetch(&url.URL{Scheme: "http", Host: "test.com", Path: "/index.xml"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	got := make([]string, 0)
+	for _, hint := range hinter.hints {
+		got = append(got, hint.URL.String())
+	}
+	expect := []string{"http://test.com/one", "http://test.com", "http://test.com/page"}
+	if !slices.Equal(got, expect) {
+		t.Fatalf("bad hints: want %s; got %s", expect, got)
+	}
+}
+
+func TestProcessorOtherHost(t *testing.T) {
+	t.Parallel()
+	hinter := &recordingHinter{}
+	processor := NewProcessor(context.Background(), clientpkg.NewFetcher(&http.Client{Transport: documentsTransport{}}), hinter)
+
+	body := "http://test.com/one\nhttp://other.com/two\nhttp://sub.test.com/three\n"
+	_, err := processor.Process(&url.URL{Scheme: "http", Host: "test.com", Path: "/sitemap.txt"}, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(hinter.hints) != 1 || hinter.hints[0].URL.String() != "http://test.com/one" {
+		t.Fatalf("only the pages of test.com should be hinted: got %v", hinter.hints)
+	}
+}
+
+func TestProcessorFetchBadStatus(t *testing.T) {
+	t.Parallel()
+	processor := NewProcessor(context.Background(), clientpkg.NewFetcher(&http.Client{Transport: documentsTransport{}}), &recordingHinter{})
+	err := processor.Fetch(&url.URL{Scheme: "http", Host: "test.com", Path: "/sitemap.xml"})
+	if err == nil {
+		t.Fatal("a missing sitemap should be an error")
+	}
+}
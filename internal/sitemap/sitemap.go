@@ -0,0 +1,202 @@
+package sitemap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+)
+
+// Limits of the sitemap protocol, larger sitemaps are truncated
+const (
+	MaxSize = 50 * 1024 * 1024 // Uncompressed
+	maxURLs = 50_000
+)
+
+// Priority of the urls that don't have one, as defined by the sitemap protocol
+const defaultPriority = 0.5
+
+var ErrTooLarge = errors.New("sitemap exceeds 50 MiB")
+
+// Sitemap is the content of a sitemap: the pages of a urlset or the sitemaps of an
+// index. Plain text sitemaps only have pages.
+type Sitemap struct {
+	Pages    []*commons.PageHint
+	Sitemaps []*url.URL
+}
+
+// Parse reads an XML sitemap, a sitemap index or a plain text sitemap, compressed with
+// gzip or not. Once maxURLs urls are read the rest is ignored, if the sitemap is larger
+// than MaxSize the urls read so far are returned alongside ErrTooLarge.
+func Parse(body io.Reader) (*Sitemap, error) {
+	reader := bufio.NewReader(body)
+	magic, _ := reader.Peek(2)
+	if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress sitemap: %w", err)
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+	}
+	limited := &limitedReader{r: reader, remaining: MaxSize}
+	reader = bufio.NewReader(limited)
+
+	sitemap := &Sitemap{Pages: make([]*commons.PageHint, 0), Sitemaps: make([]*url.URL, 0)}
+	var err error
+	if isXML(reader) {
+		err = parseXML(reader, sitemap)
+	} else {
+		err = parseText(reader, sitemap)
+	}
+	if limited.exceeded {
+		return sitemap, ErrTooLarge
+	}
+	return sitemap, err
+}
+
+// XML sitemaps start with a tag, possibly after a byte order mark and whitespaces
+func isXML(reader *bufio.Reader) bool {
+	head, _ := reader.Peek(512)
+	head = bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))
+	head = bytes.TrimLeft(head, " \t\r\n")
+	return len(head) > 0 && head[0] == '<'
+}
+
+type xmlEntry struct {
+	Loc      string `xml:"loc"`
+	LastMod  string `xml:"lastmod"`
+	Priority string `xml:"priority"`
+}
+
+func parseXML(reader io.Reader, sitemap *Sitemap) error {
+	decoder := xml.NewDecoder(reader)
+	for len(sitemap.Pages)+len(sitemap.Sitemaps) < maxURLs {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse sitemap: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || (start.Name.Local != "url" && start.Name.Local != "sitemap") {
+			continue
+		}
+
+		entry := xmlEntry{}
+		err = decoder.DecodeElement(&entry, &start)
+		if err != nil {
+			return fmt.Errorf("failed to parse sitemap: %w", err)
+		}
+		loc, err := parseLoc(entry.Loc)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("invalid url in sitemap: %s", err))
+			continue
+		}
+		if start.Name.Local == "sitemap" {
+			sitemap.Sitemaps = append(sitemap.Sitemaps, loc)
+			continue
+		}
+		sitemap.Pages = append(sitemap.Pages, &commons.PageHint{
+			URL:      loc,
+			LastMod:  parseLastMod(entry.LastMod),
+			Priority: parsePriority(entry.Priority),
+		})
+	}
+	return nil
+}
+
+// Plain text sitemaps have one url per line
+func parseText(reader io.Reader, sitemap *Sitemap) error {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() && len(sitemap.Pages) < maxURLs {
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" {
+			continue
+		}
+		loc, err := parseLoc(line)
+		if err != nil {
+			slog.Warn(fmt.Sprintf("invalid url in sitemap: %s", err))
+			continue
+		}
+		sitemap.Pages = append(sitemap.Pages, &commons.PageHint{URL: loc, Priority: defaultPriority})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read sitemap: %w", err)
+	}
+	return nil
+}
+
+func parseLoc(raw string) (*url.URL, error) {
+	loc, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, err
+	}
+	if !loc.IsAbs() {
+		return nil, fmt.Errorf("%s is not absolute", raw)
+	}
+	return commons.NormalizeUrl(loc)
+}
+
+// Sitemaps use the W3C Datetime format which allows dropping the end of the date
+var lastModLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+// Return the zero time if the date is missing or invalid
+func parseLastMod(raw string) time.Time {
+	raw = strings.TrimSpace(raw)
+	for _, layout := range lastModLayouts {
+		lastmod, err := time.Parse(layout, raw)
+		if err == nil {
+			return lastmod
+		}
+	}
+	return time.Time{}
+}
+
+func parsePriority(raw string) float64 {
+	priority, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil || priority < 0 || priority > 1 {
+		return defaultPriority
+	}
+	return priority
+}
+
+// limitedReader is like io.LimitedReader but remembers whether the limit was reached so
+// a truncated sitemap can be told apart from a complete one.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining <= 0 {
+		// Make sure there is more to read before saying the limit was exceeded
+		n, _ := l.r.Read(make([]byte, 1))
+		l.exceeded = n > 0
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.remaining {
+		p = p[:l.remaining]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,154 @@
+package sitemap
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const urlset = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url>
+		<loc>http://test.com/</loc>
+		<lastmod>2024-03-01</lastmod>
+		<priority>0.8</priority>
+	</url>
+	<url>
+		<loc> http://test.com/page </loc>
+		<lastmod>2024-03-01T10:30:00+01:00</lastmod>
+	</url>
+	<url>
+		<loc>/relative</loc>
+	</url>
+</urlset>`
+
+const index = `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>http://test.com/sitemap1.xml</loc></sitemap>
+	<sitemap><loc>http://test.com/sitemap2.xml.gz</loc><lastmod>2024-03-01</lastmod></sitemap>
+</sitemapindex>`
+
+func gzipped(t *testing.T, content string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(content))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+func pageUrls(sitemap *Sitemap) []string {
+	urls := make([]string, 0, len(sitemap.Pages))
+	for _, page := range sitemap.Pages {
+		urls = append(urls, page.URL.String())
+	}
+	return urls
+}
+
+func TestParseUrlset(t *testing.T) {
+	t.Parallel()
+	sitemap, err := Parse(strings.NewReader(urlset))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expect := []string{"http://test.com", "http://test.com/page"}
+	if !slices.Equal(pageUrls(sitemap), expect) || len(sitemap.Sitemaps) != 0 {
+		t.Fatalf("bad pages: want %s; got %s", expect, pageUrls(sitemap))
+	}
+	first, second := sitemap.Pages[0], sitemap.Pages[1]
+	if first.Priority != 0.8 || !first.LastMod.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("bad hints for the first page: %+v", first)
+	}
+	if second.Priority != defaultPriority || !second.LastMod.Equal(time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)) {
+		t.Fatalf("bad hints for the second page: %+v", second)
+	}
+}
+
+func TestParseIndex(t *testing.T) {
+	t.Parallel()
+	sitemap, err := Parse(strings.NewReader(index))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sitemap.Pages) != 0 || len(sitemap.Sitemaps) != 2 || sitemap.Sitemaps[1].String() != "http://test.com/sitemap2.xml.gz" {
+		t.Fatalf("bad sitemaps: got %v", sitemap.Sitemaps)
+	}
+}
+
+func TestParseGzip(t *testing.T) {
+	t.Parallel()
+	sitemap, err := Parse(bytes.NewReader(gzipped(t, urlset)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sitemap.Pages) != 2 {
+		t.Fatalf("bad number of pages: want 2; got %d", len(sitemap.Pages))
+	}
+}
+
+func TestParseText(t *testing.T) {
+	t.Parallel()
+	sitemap, err := Parse(strings.NewReader("\ufeffhttp://test.com/a\n\n  http://test.com/b  \nnot an url\n"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expect := []string{"http://test.com/a", "http://test.com/b"}
+	if !slices.Equal(pageUrls(sitemap), expect) {
+		t.Fatalf("bad pages: want %s; got %s", expect, pageUrls(sitemap))
+	}
+}
+
+func TestParseMaxURLs(t *testing.T) {
+	t.Parallel()
+	var text strings.Builder
+	for i := 0; i < maxURLs+10; i++ {
+		fmt.Fprintf(&text, "http://test.com/%d\n", i)
+	}
+	sitemap, err := Parse(strings.NewReader(text.String()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sitemap.Pages) != maxURLs {
+		t.Fatalf("bad number of pages: want %d; got %d", maxURLs, len(sitemap.Pages))
+	}
+}
+
+func TestParseTooLarge(t *testing.T) {
+	t.Parallel()
+	body := "<urlset><url><loc>http://test.com/</loc></url>" + strings.Repeat(" ", MaxSize) + "</urlset>"
+	sitemap, err := Parse(bytes.NewReader(gzipped(t, body)))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("bad error: want %s; got %v", ErrTooLarge, err)
+	}
+	if len(sitemap.Pages) != 1 {
+		t.Fatalf("the pages read before the limit should be kept: got %d", len(sitemap.Pages))
+	}
+}
+
+func TestParseLastMod(t *testing.T) {
+	tests := map[string]time.Time{
+		"2024":                      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		"2024-03":                   time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		"2024-03-05":                time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC),
+		"2024-03-05T10:20Z":         time.Date(2024, 3, 5, 10, 20, 0, 0, time.UTC),
+		"2024-03-05T10:20:30.5Z":    time.Date(2024, 3, 5, 10, 20, 30, 5e8, time.UTC),
+		"2024-03-05T10:20:30-02:00": time.Date(2024, 3, 5, 12, 20, 30, 0, time.UTC),
+		"yesterday":                 {},
+	}
+	for raw, expect := range tests {
+		t.Run(raw, func(t *testing.T) {
+			t.Parallel()
+			if got := parseLastMod(raw); !got.Equal(expect) {
+				t.Fatalf("bad lastmod: want %s; got %s", expect, got)
+			}
+		})
+	}
+}
@@ -82,6 +82,21 @@ var (
 			Help:      "How many second it takes to save links",
 		},
 	)
+	SlowedHosts = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "backlinkbot",
+			Name:      "slowed_hosts",
+			Help:      "Number of hosts whose rate limit is below the max rate",
+		},
+	)
+	HostRateLimit = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "backlinkbot",
+			Name:      "host_rate_limit",
+			Help:      "Current rate limit in req/s of the hosts that were slowed down",
+		},
+		[]string{"host"},
+	)
 )
 
 func init() {
@@ -94,6 +109,8 @@ func init() {
 	prometheus.MustRegister(IsCrawlableDuration2)
 	prometheus.MustRegister(ExtractLinksDuration)
 	prometheus.MustRegister(AddDuration)
+	prometheus.MustRegister(SlowedHosts)
+	prometheus.MustRegister(HostRateLimit)
 }
 
 func MetricsReport(ctx context.Context) {
@@ -0,0 +1,360 @@
+package websub
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/feed"
+)
+
+// CallbackPath is where the Subscriber must be mounted on the HTTP server, each
+// subscription has its own callback below it.
+const CallbackPath = "/websub/"
+
+const (
+	// Lease we ask the hubs for, they are free to grant another one
+	defaultLease = 10 * 24 * time.Hour
+	// Subscriptions are renewed once this fraction of their lease has elapsed
+	renewAt = 0.9
+	// Subscriptions the hub did not verify after this delay are given up, the next
+	// Subscribe to their topic asks the hub again
+	verifyTimeout = 5 * time.Minute
+)
+
+// Hinter receives the entries pushed by the hubs, like controller.Controller.
+type Hinter interface {
+	Hint(hints []*commons.PageHint)
+}
+
+// Subscriber subscribes to the WebSub hubs of feeds and hints the entries they push to
+// the controller as fresh pages. Subscriptions are only kept in memory: after a restart
+// they are made again as the feeds are polled.
+type Subscriber struct {
+	ctx        context.Context
+	client     *http.Client
+	controller Hinter
+	callback   *url.URL
+	mu         sync.Mutex
+	byID       map[string]*subscription
+	byTopic    map[string]*subscription
+}
+
+type subscription struct {
+	id        string
+	hub       *url.URL
+	topic     *url.URL
+	secret    string
+	verified  bool
+	requested time.Time // Latest subscription request, the hub verifies it after
+}
+
+// NewSubscriber creates a Subscriber whose callbacks are below callback, the public url
+// of the HTTP server it is mounted on.
+func NewSubscriber(ctx context.Context, client *http.Client, controller Hinter, callback *url.URL) *Subscriber {
+	return &Subscriber{
+		ctx:        ctx,
+		client:     client,
+		controller: controller,
+		callback:   callback,
+		byID:       make(map[string]*subscription),
+		byTopic:    make(map[string]*subscription),
+	}
+}
+
+// Subscribe asks the hub to push the updates of topic. It does nothing if the topic is
+// already subscribed or waiting for the verification of the hub, unless the hub did not
+// verify it in time.
+func (s *Subscriber) Subscribe(hub *url.URL, topic *url.URL) error {
+	s.mu.Lock()
+	if sub, ok := s.byTopic[topic.String()]; ok {
+		if sub.verified || time.Since(sub.requested) < verifyTimeout {
+			s.mu.Unlock()
+			return nil
+		}
+		slog.Warn(fmt.Sprintf("websub subscription to %s was not verified by %s, subscribing again", topic, sub.hub))
+		delete(s.byID, sub.id)
+		delete(s.byTopic, topic.String())
+	}
+	id, err := randomHex(16)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	sub := &subscription{id: id, hub: hub, topic: topic, secret: secret, requested: time.Now()}
+	s.byID[id] = sub
+	s.byTopic[topic.String()] = sub
+	s.mu.Unlock()
+
+	err = s.request(sub)
+	if err != nil {
+		s.remove(sub)
+		return err
+	}
+	return nil
+}
+
+// Send the subscription request, the hub then verifies it by calling the callback
+func (s *Subscriber) request(sub *subscription) error {
+	form := url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {sub.topic.String()},
+		"hub.callback":      {s.callback.JoinPath(CallbackPath, sub.id).String()},
+		"hub.secret":        {sub.secret},
+		"hub.lease_seconds": {strconv.Itoa(int(defaultLease.Seconds()))},
+	}
+	req, err := http.NewRequestWithContext(s.ctx, "POST", sub.hub.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", sub.topic, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", sub.topic, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to subscribe to %s: hub %s answered with status %d", sub.topic, sub.hub, resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *Subscriber) renew(sub *subscription) {
+	if s.ctx.Err() != nil {
+		return
+	}
+	err := s.request(sub)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to renew websub subscription: %s", err))
+		s.remove(sub)
+	}
+}
+
+func (s *Subscriber) remove(sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byID, sub.id)
+	if s.byTopic[sub.topic.String()] == sub {
+		delete(s.byTopic, sub.topic.String())
+	}
+}
+
+func (s *Subscriber) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, CallbackPath)
+	s.mu.Lock()
+	sub, ok := s.byID[id]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		s.verify(w, req, sub)
+	case "POST":
+		s.receive(w, req, sub)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Answer the verification of intent of the hub. We never unsubscribe so any other
+// verification than the one of our subscription is refused.
+func (s *Subscriber) verify(w http.ResponseWriter, req *http.Request, sub *subscription) {
+	params := req.URL.Query()
+	if params.Get("hub.topic") != sub.topic.String() {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch params.Get("hub.mode") {
+	case "subscribe":
+		lease := defaultLease
+		seconds, err := strconv.Atoi(params.Get("hub.lease_seconds"))
+		if err == nil && seconds > 0 {
+			lease = time.Duration(seconds) * time.Second
+		}
+		s.mu.Lock()
+		renewal := !sub.verified
+		sub.verified = true
+		s.mu.Unlock()
+		// Hubs may verify again when we renew, the renewal is already scheduled then
+		if renewal {
+			s.scheduleRenewal(sub, lease)
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, params.Get("hub.challenge"))
+	case "denied":
+		slog.Warn(fmt.Sprintf("websub subscription to %s was denied: %s", sub.topic, params.Get("hub.reason")))
+		s.remove(sub)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (s *Subscriber) scheduleRenewal(sub *subscription, lease time.Duration) {
+	time.AfterFunc(time.Duration(float64(lease)*renewAt), func() {
+		s.mu.Lock()
+		// The subscription was replaced in the meantime
+		if s.byID[sub.id] != sub {
+			s.mu.Unlock()
+			return
+		}
+		sub.verified = false
+		sub.requested = time.Now()
+		s.mu.Unlock()
+		s.renew(sub)
+	})
+}
+
+// Hint the entries of the content pushed by the hub. Content with an invalid signature
+// is acknowledged like the rest so that its sender can't tell it was ignored.
+func (s *Subscriber) receive(w http.ResponseWriter, req *http.Request, sub *subscription) {
+	body, err := io.ReadAll(io.LimitReader(req.Body, feed.MaxSize+1))
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to read websub content of %s: %s", sub.topic, err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(body) > feed.MaxSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	err = checkSignature(req.Header.Get("X-Hub-Signature"), sub.secret, body)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("ignored websub content of %s: %s", sub.topic, err))
+		return
+	}
+	pushed, err := feed.Parse(sub.topic, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn(fmt.Sprintf("failed to parse websub content of %s: %s", sub.topic, err))
+		return
+	}
+	if len(pushed.Entries) > 0 {
+		s.controller.Hint(pushed.Entries)
+	}
+}
+
+var errBadSignature = errors.New("invalid signature")
+
+// The signature is the HMAC of the body with our secret, in the form method=hexdigest
+func checkSignature(header string, secret string, body []byte) error {
+	method, signature, ok := strings.Cut(header, "=")
+	if !ok {
+		return errBadSignature
+	}
+	var newHash func() hash.Hash
+	switch method {
+	case "sha1":
+		newHash = sha1.New
+	case "sha256":
+		newHash = sha256.New
+	case "sha384":
+		newHash = sha512.New384
+	case "sha512":
+		newHash = sha512.New
+	default:
+		return fmt.Errorf("unsupported signature method %q", method)
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return errBadSignature
+	}
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// Discover returns the hubs and the topic of a feed from the headers of its response and
+// its final url. The Link headers take precedence over the links of the feed, the topic
+// defaults to the feed url.
+func Discover(header http.Header, feedUrl *url.URL, parsed *feed.Feed) ([]*url.URL, *url.URL) {
+	hubs := make([]*url.URL, 0)
+	var topic *url.URL
+	for _, value := range header.Values("Link") {
+		for _, link := range strings.Split(value, ",") {
+			target, rel, ok := parseLink(feedUrl, link)
+			if !ok {
+				continue
+			}
+			rels := strings.Fields(rel)
+			if slices.Contains(rels, "hub") {
+				hubs = append(hubs, target)
+			}
+			if slices.Contains(rels, "self") && topic == nil {
+				topic = target
+			}
+		}
+	}
+	if len(hubs) == 0 {
+		hubs = parsed.Hubs
+	}
+	if topic == nil {
+		topic = parsed.Self
+	}
+	if topic == nil {
+		topic = feedUrl
+	}
+	return hubs, topic
+}
+
+// Parse a value of a Link header like <https://hub.example.com/>; rel="hub"
+func parseLink(base *url.URL, link string) (*url.URL, string, bool) {
+	parts := strings.Split(link, ";")
+	target := strings.TrimSpace(parts[0])
+	if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+		return nil, "", false
+	}
+	u, err := base.Parse(strings.Trim(target, "<>"))
+	if err != nil {
+		return nil, "", false
+	}
+	for _, param := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(name, "rel") {
+			return u, strings.ToLower(strings.Trim(value, `"`)), true
+		}
+	}
+	return nil, "", false
+}
+
+func randomHex(size int) (string, error) {
+	b := make([]byte, size)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
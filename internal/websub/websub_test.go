@@ -0,0 +1,313 @@
+package websub
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/feed"
+)
+
+const pushedFeed = `<feed xmlns="http://www.w3.org/2005/Atom">
+	<entry><link href="http://test.com/new-post"/></entry>
+</feed>`
+
+type hintRecorder struct {
+	mu    sync.Mutex
+	hints []*commons.PageHint
+}
+
+func (h *hintRecorder) Hint(hints []*commons.PageHint) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hints = append(h.hints, hints...)
+}
+
+func (h *hintRecorder) urls() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	urls := make([]string, 0, len(h.hints))
+	for _, hint := range h.hints {
+		urls = append(urls, hint.URL.String())
+	}
+	return urls
+}
+
+// A stand-in hub that verifies the intent of the subscriber like a real one would
+type standInHub struct {
+	t        *testing.T
+	callback string
+	secret   string
+	verified chan string // Challenge echoed by the subscriber
+}
+
+func (h *standInHub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil || req.PostForm.Get("hub.mode") != "subscribe" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.callback = req.PostForm.Get("hub.callback")
+	h.secret = req.PostForm.Get("hub.secret")
+	topic := req.PostForm.Get("hub.topic")
+	w.WriteHeader(http.StatusAccepted)
+
+	go func() {
+		verification, _ := url.Parse(h.callback)
+		verification.RawQuery = url.Values{
+			"hub.mode":          {"subscribe"},
+			"hub.topic":         {topic},
+			"hub.challenge":     {"challenge"},
+			"hub.lease_seconds": {"3600"},
+		}.Encode()
+		resp, err := http.Get(verification.String())
+		if err != nil {
+			h.verified <- ""
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		h.verified <- string(body)
+	}()
+}
+
+// Push the content to the subscriber, signed with the given secret
+func (h *standInHub) publish(secret string, content string) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(content))
+	req, _ := http.NewRequest("POST", h.callback, strings.NewReader(content))
+	req.Header.Set("Content-Type", "application/atom+xml")
+	req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		h.t.Fatalf("failed to publish: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		h.t.Fatalf("bad status of the content distribution: want 202; got %d", resp.StatusCode)
+	}
+}
+
+func setupSubscriber(t *testing.T, ctx context.Context) (*Subscriber, *standInHub, *url.URL, *hintRecorder) {
+	var subscriber *Subscriber
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		subscriber.ServeHTTP(w, req)
+	}))
+	t.Cleanup(callbackServer.Close)
+	hub := &standInHub{t: t, verified: make(chan string, 1)}
+	hubServer := httptest.NewServer(hub)
+	t.Cleanup(hubServer.Close)
+
+	callback, _ := url.Parse(callbackServer.URL)
+	recorder := &hintRecorder{}
+	subscriber = NewSubscriber(ctx, hubServer.Client(), recorder, callback)
+	hubUrl, _ := url.Parse(hubServer.URL)
+	return subscriber, hub, hubUrl, recorder
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscriber, hub, hubUrl, recorder := setupSubscriber(t, ctx)
+
+	topic, _ := url.Parse("http://test.com/feed")
+	err := subscriber.Subscribe(hubUrl, topic)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case challenge := <-hub.verified:
+		if challenge != "challenge" {
+			t.Fatalf("bad challenge echoed: got %q", challenge)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the hub did not verify the subscription")
+	}
+	if !strings.Contains(hub.callback, CallbackPath) {
+		t.Fatalf("the callback should be below %s: got %s", CallbackPath, hub.callback)
+	}
+
+	hub.publish("wrong secret", pushedFeed)
+	if len(recorder.urls()) != 0 {
+		t.Fatal("content with a bad signature should be ignored")
+	}
+	hub.publish(hub.secret, pushedFeed)
+	urls := recorder.urls()
+	if len(urls) != 1 || urls[0] != "http://test.com/new-post" {
+		t.Fatalf("the pushed entries should be hinted: got %s", urls)
+	}
+
+	// Subscribing again to the same topic does not contact the hub
+	err = subscriber.Subscribe(hubUrl, topic)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	select {
+	case <-hub.verified:
+		t.Fatal("the topic was subscribed twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSubscribeUnverified(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// A hub that accepts the subscriptions but never verifies them
+	requests := make(chan string, 2)
+	hubServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		requests <- req.PostForm.Get("hub.callback")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hubServer.Close()
+	callback, _ := url.Parse("http://callback.test.com")
+	subscriber := NewSubscriber(ctx, hubServer.Client(), &hintRecorder{}, callback)
+	hubUrl, _ := url.Parse(hubServer.URL)
+	topic, _ := url.Parse("http://test.com/feed")
+
+	for range 2 {
+		err := subscriber.Subscribe(hubUrl, topic)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	first := <-requests
+	if len(requests) != 0 {
+		t.Fatal("a subscription waiting for its verification should not be requested again")
+	}
+
+	// Once the hub had the time to verify, the subscription is requested again
+	subscriber.mu.Lock()
+	subscriber.byTopic[topic.String()].requested = time.Now().Add(-verifyTimeout)
+	subscriber.mu.Unlock()
+	err := subscriber.Subscribe(hubUrl, topic)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	second := <-requests
+	if second == first {
+		t.Fatal("the expired subscription should be replaced by a new one")
+	}
+
+	// The callback of the expired subscription is gone
+	recorder := httptest.NewRecorder()
+	params := url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic.String()}, "hub.challenge": {"challenge"}}
+	req := httptest.NewRequest("GET", CallbackPath+path.Base(first)+"?"+params.Encode(), nil)
+	subscriber.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("bad status: want 404; got %d", recorder.Code)
+	}
+}
+
+func TestVerifyUnknownIntent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	subscriber, hub, hubUrl, _ := setupSubscriber(t, ctx)
+	topic, _ := url.Parse("http://test.com/feed")
+	err := subscriber.Subscribe(hubUrl, topic)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	<-hub.verified
+	id := path.Base(hub.callback)
+
+	tests := map[string]struct {
+		path   string
+		params url.Values
+	}{
+		"unknown callback": {CallbackPath + "unknown", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {topic.String()}}},
+		"other topic":      {CallbackPath + id, url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"http://other.com/feed"}}},
+		"unsubscribe":      {CallbackPath + id, url.Values{"hub.mode": {"unsubscribe"}, "hub.topic": {topic.String()}}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", test.path+"?"+test.params.Encode(), nil)
+			subscriber.ServeHTTP(recorder, req)
+			if recorder.Code != http.StatusNotFound {
+				t.Fatalf("bad status: want 404; got %d", recorder.Code)
+			}
+		})
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	body := []byte("content")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	valid := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := map[string]struct {
+		header string
+		ok     bool
+	}{
+		"valid":          {valid, true},
+		"missing":        {"", false},
+		"bad method":     {"md5=" + hex.EncodeToString(mac.Sum(nil)), false},
+		"bad encoding":   {"sha256=zz", false},
+		"bad signature":  {"sha256=" + strings.Repeat("00", 32), false},
+		"other method":   {"sha1=" + hex.EncodeToString(mac.Sum(nil)), false},
+		"truncated hmac": {valid[:len(valid)-2], false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			err := checkSignature(test.header, "secret", body)
+			if (err == nil) != test.ok {
+				t.Fatalf("bad result: want ok=%t; got %v", test.ok, err)
+			}
+		})
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	feedUrl, _ := url.Parse("http://test.com/feed")
+	hubUrl, _ := url.Parse("https://hub.test.com/")
+	selfUrl, _ := url.Parse("http://test.com/feed.xml")
+
+	tests := map[string]struct {
+		header http.Header
+		parsed *feed.Feed
+		hubs   int
+		topic  string
+	}{
+		"link headers": {
+			header: http.Header{"Link": {`<https://hub.test.com/>; rel="hub", </feed.atom>; rel="self"`}},
+			parsed: &feed.Feed{},
+			hubs:   1,
+			topic:  "http://test.com/feed.atom",
+		},
+		"feed links": {
+			header: http.Header{},
+			parsed: &feed.Feed{Hubs: []*url.URL{hubUrl}, Self: selfUrl},
+			hubs:   1,
+			topic:  "http://test.com/feed.xml",
+		},
+		"no hub": {
+			header: http.Header{},
+			parsed: &feed.Feed{},
+			hubs:   0,
+			topic:  "http://test.com/feed",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			hubs, topic := Discover(test.header, feedUrl, test.parsed)
+			if len(hubs) != test.hubs || topic.String() != test.topic {
+				t.Fatalf("bad discovery: want %d hubs and topic %s; got %s and %s", test.hubs, test.topic, hubs, topic)
+			}
+		})
+	}
+}
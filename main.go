@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
@@ -14,14 +16,20 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/api"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/client"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/commons"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/controller"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/crawler"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/politeness"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/query"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/robot"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/settings"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/sitemap"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/telemetry"
 	"github.com/TheBigRoomXXL/backlinks-engine/internal/vwww"
+	"github.com/TheBigRoomXXL/backlinks-engine/internal/websub"
+	"golang.org/x/time/rate"
 )
 
 func main() {
@@ -55,7 +63,7 @@ func cli(ctx context.Context) error {
 	}
 
 	if len(os.Args) < 2 {
-		return errors.New("a command (crawl or vwww) is expected as argument")
+		return errors.New("a command (crawl, seed, serve, query, migrate or vwww) is expected as argument")
 	}
 
 	cmd := os.Args[1]
@@ -67,23 +75,24 @@ func cli(ctx context.Context) error {
 		}
 		go telemetry.StartTelemetryServer("localhost:" + s.TELEMETRY_PORT)
 
-		PostgresURI := fmt.Sprintf(
-			"postgresql://%s:%s@%s:%s/%s?%s",
-			s.DB_USER,
-			s.DB_PASSWORD,
-			s.DB_HOSTNAME,
-			s.DB_PORT,
-			s.DB_NAME,
-			s.DB_OPTIONS,
+		controller, err := newController(ctx, s)
+		if err != nil {
+			return err
+		}
+		limiters := politeness.NewLimiters(
+			s.HTTP_RATE_LIMIT_MIN, s.HTTP_RATE_LIMIT, s.HTTP_RATE_LIMIT_DOMAIN, s.HTTP_RATE_LIMIT_IP, nil,
 		)
-		controller, err := controller.NewController(ctx, PostgresURI)
+		fetcher := client.NewCrawlClient(ctx, s.HTTP_TIMEOUT, s.HTTP_MAX_RETRY, limiters)
+		robot, err := newRobotPolicy(ctx, s, fetcher)
 		if err != nil {
-			return fmt.Errorf("failed init postgres connection pool: %w", err)
+			return err
+		}
+		subscriber, err := newSubscriber(ctx, s, controller)
+		if err != nil {
+			return err
 		}
-		fetcher := client.NewCrawlClient(ctx, s.HTTP_TIMEOUT)
-		robot := robot.NewInMemoryRobotPolicy(fetcher)
 		crawler := crawler.NewCrawler(
-			ctx, controller, fetcher, robot, s.CRAWLER_MAX_CONCURENCY, s.HTTP_RATE_LIMIT,
+			ctx, controller, fetcher, robot, s.CRAWLER_MAX_CONCURENCY, limiters, subscriber,
 		)
 
 		seeds, err := parseSeeds(os.Args[2:])
@@ -96,6 +105,164 @@ func cli(ctx context.Context) error {
 		return crawler.Run()
 	}
 
+	if cmd == "seed" {
+		flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+		sitemaps := flags.Bool("sitemap", false, "the arguments are sitemaps (files or urls) instead of pages")
+		err := flags.Parse(os.Args[2:])
+		if err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			return errors.New("seed expect at least one url or file after the options")
+		}
+
+		s, ok := settings.New()
+		if !ok {
+			return errors.New("failed to initialize setttings properly")
+		}
+		if s.STORAGE_BACKEND != "postgres" {
+			return errors.New("seed requires the postgres storage backend")
+		}
+		seeder, err := controller.NewPostgresSeeder(ctx, postgresURI(s), s.DB_AUTO_MIGRATE)
+		if err != nil {
+			return err
+		}
+
+		if !*sitemaps {
+			seeds, err := parseSeeds(flags.Args())
+			if err != nil {
+				return fmt.Errorf("fail to parse argument: %w", err)
+			}
+			seeder.Seed(seeds)
+			return nil
+		}
+		processor := sitemap.NewProcessor(ctx, client.NewCrawlClient(ctx, s.HTTP_TIMEOUT, s.HTTP_MAX_RETRY, nil), seeder)
+		for _, arg := range flags.Args() {
+			err := seedSitemap(processor, arg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if cmd == "serve" {
+		s, ok := settings.New()
+		if !ok {
+			return errors.New("failed to initialize setttings properly")
+		}
+		if s.STORAGE_BACKEND != "postgres" {
+			return errors.New("serve requires the postgres storage backend")
+		}
+		reader, err := controller.NewPostgresGraphReader(ctx, postgresURI(s))
+		if err != nil {
+			return err
+		}
+		return api.NewServer(reader).Serve(ctx, ":"+s.API_PORT)
+	}
+
+	if cmd == "query" {
+		if len(os.Args) < 3 {
+			return errors.New("query expect a subcommand (backlinks or outlinks) as argument")
+		}
+		direction := query.Direction(os.Args[2])
+		if direction != query.Backlinks && direction != query.Outlinks {
+			return errors.New("invalid subcommand: backlinks or outlinks is expected")
+		}
+
+		flags := flag.NewFlagSet("query "+os.Args[2], flag.ContinueOnError)
+		limit := flags.Int("limit", 100, "maximum number of links to print, 0 for no limit")
+		format := flags.String("format", "table", "output format: table, jsonl or csv")
+		domains := flags.Bool("domains", false, "only print one link per referring domain, slower on pages with many links")
+		sort := flags.String("sort", "id", "sort links by page id (discovery order) or by host, slower on pages with many links")
+		excludeRel := flags.String("exclude-rel", "", "comma separated rel values to skip, like nofollow,sponsored")
+		err := flags.Parse(os.Args[3:])
+		if err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errors.New("query expect exactly one url after the options")
+		}
+		if *sort != string(controller.SortByID) && *sort != string(controller.SortByHost) {
+			return errors.New("invalid sort: id or host is expected")
+		}
+		target, err := url.Parse(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("failed to parse url: %w", err)
+		}
+		target, err = commons.NormalizeUrl(target)
+		if err != nil {
+			return fmt.Errorf("failed to normalize url: %w", err)
+		}
+
+		s, ok := settings.New()
+		if !ok {
+			return errors.New("failed to initialize setttings properly")
+		}
+		if s.STORAGE_BACKEND != "postgres" {
+			return errors.New("query requires the postgres storage backend")
+		}
+		reader, err := controller.NewPostgresGraphReader(ctx, postgresURI(s))
+		if err != nil {
+			return err
+		}
+
+		q := controller.LinkQuery{
+			URL:           target,
+			Sort:          controller.LinkSort(*sort),
+			DistinctHosts: *domains,
+		}
+		if *excludeRel != "" {
+			q.ExcludeRel = strings.Split(strings.ToLower(*excludeRel), ",")
+		}
+		links, err := query.Collect(ctx, reader, direction, q, *limit)
+		if err != nil {
+			return fmt.Errorf("failed to query %s: %w", direction, err)
+		}
+		return query.Write(os.Stdout, query.Format(*format), links)
+	}
+
+	if cmd == "migrate" {
+		if len(os.Args) < 3 {
+			return errors.New("migrate expect a subcommand (up, down or status) as argument")
+		}
+		s, ok := settings.New()
+		if !ok {
+			return errors.New("failed to initialize setttings properly")
+		}
+		migrator, err := controller.NewMigrator(ctx, postgresURI(s))
+		if err != nil {
+			return err
+		}
+
+		subcmd := os.Args[2]
+		if subcmd == "up" {
+			return migrator.Up(ctx)
+		}
+
+		if subcmd == "down" {
+			n := 1
+			if len(os.Args) > 3 {
+				n, err = strconv.Atoi(os.Args[3])
+				if err != nil {
+					return fmt.Errorf("failed to parse number of migrations to revert: %w", err)
+				}
+			}
+			return migrator.Down(ctx, n)
+		}
+
+		if subcmd == "status" {
+			status, err := migrator.Status(ctx)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Schema version: %d (latest: %d, pending: %d)\n", status.Current, status.Latest, status.Pending())
+			return nil
+		}
+
+		return errors.New("invalid subcommand: up, down or status is expected")
+	}
+
 	if cmd == "vwww" {
 		if len(os.Args) < 3 {
 			return errors.New("vwww expect a subcommand (generate or serve) as argument")
@@ -134,7 +301,130 @@ func cli(ctx context.Context) error {
 		return errors.New("invalid subcommand: generate or serve is expected")
 	}
 
-	return errors.New("invalid command: crawl or vwww is expected")
+	return errors.New("invalid command: crawl, seed, serve, query, migrate or vwww is expected")
+}
+
+func newController(ctx context.Context, s *settings.Settings) (controller.Controller, error) {
+	if s.STORAGE_BACKEND == "memory" {
+		return controller.NewInMemoryController(ctx, hostDelay(s), revisitPolicy(s), s.CRAWLER_LINK_MAX_MISSES, feedPollPolicy(s)), nil
+	}
+
+	c, err := controller.NewPostgresController(
+		ctx,
+		postgresURI(s),
+		s.DB_AUTO_MIGRATE,
+		s.DB_BATCH_SIZE,
+		s.DB_FLUSH_INTERVAL,
+		s.DB_LEASE_DURATION,
+		hostDelay(s),
+		revisitPolicy(s),
+		s.CRAWLER_LINK_MAX_MISSES,
+		feedPollPolicy(s),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed init postgres controller: %w", err)
+	}
+	return c, nil
+}
+
+// With WebSub enabled, the API server is started alongside the crawler to receive the
+// content pushed by the hubs. It returns nil when WebSub is disabled.
+func newSubscriber(ctx context.Context, s *settings.Settings, c controller.Controller) (*websub.Subscriber, error) {
+	if s.WEBSUB_CALLBACK_URL == nil {
+		return nil, nil
+	}
+
+	reader, ok := c.(controller.GraphReader)
+	if !ok {
+		var err error
+		reader, err = controller.NewPostgresGraphReader(ctx, postgresURI(s))
+		if err != nil {
+			return nil, err
+		}
+	}
+	subscriber := websub.NewSubscriber(ctx, &http.Client{Timeout: s.HTTP_TIMEOUT}, c, s.WEBSUB_CALLBACK_URL)
+	server := api.NewServer(reader)
+	server.Handle(websub.CallbackPath, subscriber)
+	go func() {
+		err := server.Serve(ctx, ":"+s.API_PORT)
+		if err != nil {
+			slog.Error(fmt.Sprintf("api server stopped: %s", err))
+		}
+	}()
+	return subscriber, nil
+}
+
+func newRobotPolicy(ctx context.Context, s *settings.Settings, fetcher client.Fetcher) (robot.RobotPolicy, error) {
+	if s.STORAGE_BACKEND == "memory" {
+		return robot.NewInMemoryRobotPolicy(ctx, fetcher, s.CRAWLER_ROBOTS_TTL), nil
+	}
+
+	store, err := controller.NewPostgresRobotStore(ctx, postgresURI(s))
+	if err != nil {
+		return nil, fmt.Errorf("failed init postgres robot store: %w", err)
+	}
+	return robot.NewPersistentRobotPolicy(ctx, fetcher, store, s.CRAWLER_ROBOTS_TTL), nil
+}
+
+// Minimum time between two pages of the same host handed out by the controller, it
+// matches the rate limit of the crawler so that its goroutines rarely wait on a host.
+func hostDelay(s *settings.Settings) time.Duration {
+	if s.HTTP_RATE_LIMIT == rate.Inf || s.HTTP_RATE_LIMIT <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / float64(s.HTTP_RATE_LIMIT))
+}
+
+func revisitPolicy(s *settings.Settings) controller.RevisitPolicy {
+	return controller.RevisitPolicy{Min: s.CRAWLER_REVISIT_MIN, Max: s.CRAWLER_REVISIT_MAX}
+}
+
+func feedPollPolicy(s *settings.Settings) controller.RevisitPolicy {
+	return controller.RevisitPolicy{Min: s.CRAWLER_FEED_POLL_MIN, Max: s.CRAWLER_FEED_POLL_MAX}
+}
+
+func postgresURI(s *settings.Settings) string {
+	return fmt.Sprintf(
+		"postgresql://%s:%s@%s:%s/%s?%s",
+		s.DB_USER,
+		s.DB_PASSWORD,
+		s.DB_HOSTNAME,
+		s.DB_PORT,
+		s.DB_NAME,
+		s.DB_OPTIONS,
+	)
+}
+
+// Process a sitemap from a file or an url, the sitemaps listed by an index file are
+// fetched.
+func seedSitemap(processor *sitemap.Processor, arg string) error {
+	_, err := os.Stat(arg)
+	if errors.Is(err, os.ErrNotExist) {
+		u, err := url.Parse(arg)
+		if err != nil {
+			return fmt.Errorf("failed to parse sitemap url: %w", err)
+		}
+		return processor.Fetch(u)
+	}
+
+	file, err := os.Open(arg)
+	if err != nil {
+		return fmt.Errorf("error opening sitemap file: %w", err)
+	}
+	defer file.Close()
+	sitemaps, err := processor.Process(nil, file)
+	if errors.Is(err, sitemap.ErrTooLarge) {
+		slog.Warn(fmt.Sprintf("sitemap %s was truncated: %s", arg, err))
+	} else if err != nil {
+		return fmt.Errorf("failed to process sitemap %s: %w", arg, err)
+	}
+	for _, u := range sitemaps {
+		err := processor.Fetch(u)
+		if err != nil {
+			slog.Warn(err.Error())
+		}
+	}
+	return nil
 }
 
 func parseSeeds(args []string) ([]*url.URL, error) {